@@ -0,0 +1,83 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/shamanec/GADS-devices-provider/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultAppiumLogsLimit = 100
+	maxAppiumLogsLimit     = 1000
+)
+
+// Get Appium logs for a device from its capped `appium_logs` collection
+// Logs are returned in insertion order starting after the provided cursor(document ID)
+func GetAppiumLogs(udid string, query models.AppiumLogsQuery) (models.AppiumLogsResponse, error) {
+	response := models.AppiumLogsResponse{Logs: []models.AppiumLogEntry{}}
+
+	ctx, cancel := context.WithTimeout(mongoClientCtx, 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{}
+	if query.SessionID != "" {
+		filter["session_id"] = query.SessionID
+	}
+	if query.LogType != "" {
+		filter["log_type"] = query.LogType
+	}
+	if query.From != 0 || query.To != 0 {
+		tsFilter := bson.M{}
+		if query.From != 0 {
+			tsFilter["$gte"] = query.From
+		}
+		if query.To != 0 {
+			tsFilter["$lte"] = query.To
+		}
+		filter["ts"] = tsFilter
+	}
+	if query.Text != "" {
+		filter["msg"] = primitive.Regex{Pattern: regexp.QuoteMeta(query.Text), Options: "i"}
+	}
+	if query.Cursor != "" {
+		cursorID, err := primitive.ObjectIDFromHex(query.Cursor)
+		if err != nil {
+			return response, fmt.Errorf("GetAppiumLogs: Invalid cursor `%s` - %s", query.Cursor, err)
+		}
+		filter["_id"] = bson.M{"$gt": cursorID}
+	}
+
+	limit := query.Limit
+	if limit <= 0 {
+		limit = defaultAppiumLogsLimit
+	}
+	if limit > maxAppiumLogsLimit {
+		limit = maxAppiumLogsLimit
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(limit)
+	cursor, err := mongoClient.Database("appium_logs").Collection(udid).Find(ctx, filter, opts)
+	if err != nil {
+		return response, fmt.Errorf("GetAppiumLogs: Could not get db cursor for device `%s` Appium logs - %s", udid, err)
+	}
+	defer cursor.Close(ctx)
+
+	if err := cursor.All(ctx, &response.Logs); err != nil {
+		return response, fmt.Errorf("GetAppiumLogs: Could not decode Appium logs for device `%s` - %s", udid, err)
+	}
+
+	// Always return a cursor so clients can keep polling for newer logs
+	// If nothing was found we return the same cursor we received
+	response.NextCursor = query.Cursor
+	if len(response.Logs) > 0 {
+		response.NextCursor = response.Logs[len(response.Logs)-1].ID.Hex()
+	}
+
+	return response, nil
+}
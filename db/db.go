@@ -122,6 +122,50 @@ func GetConfiguredDevice(udid string) (*models.Device, error) {
 	return &deviceInfo, nil
 }
 
+// Get the operator labels configured for a device in the DB
+// Labels are managed outside the provider so they are read separately and never upserted by it
+func GetDeviceLabels(udid string) ([]string, error) {
+	var deviceLabels struct {
+		Labels []string `bson:"labels"`
+	}
+	ctx, cancel := context.WithTimeout(mongoClientCtx, 10*time.Second)
+	defer cancel()
+
+	collection := mongoClient.Database("gads").Collection("devices")
+	filter := bson.D{{Key: "udid", Value: udid}}
+
+	err := collection.FindOne(ctx, filter).Decode(&deviceLabels)
+	if err == mongo.ErrNoDocuments {
+		return []string{}, nil
+	}
+	if err != nil {
+		return []string{}, err
+	}
+	return deviceLabels.Labels, nil
+}
+
+// Get the stream settings overrides configured for a device in the DB
+// Like labels they are managed outside the provider and never upserted by it
+func GetDeviceStreamSettings(udid string) (models.StreamSettings, error) {
+	var deviceSettings struct {
+		StreamSettings models.StreamSettings `bson:"stream_settings"`
+	}
+	ctx, cancel := context.WithTimeout(mongoClientCtx, 10*time.Second)
+	defer cancel()
+
+	collection := mongoClient.Database("gads").Collection("devices")
+	filter := bson.D{{Key: "udid", Value: udid}}
+
+	err := collection.FindOne(ctx, filter).Decode(&deviceSettings)
+	if err == mongo.ErrNoDocuments {
+		return models.StreamSettings{}, nil
+	}
+	if err != nil {
+		return models.StreamSettings{}, err
+	}
+	return deviceSettings.StreamSettings, nil
+}
+
 func UpsertDeviceDB(device models.Device) error {
 	update := bson.M{
 		"$set": device,
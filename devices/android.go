@@ -2,13 +2,19 @@ package devices
 
 import (
 	"bytes"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"os/exec"
+	"regexp"
+	"strconv"
 	"strings"
+	"unicode/utf16"
 
 	"github.com/shamanec/GADS-devices-provider/config"
 	"github.com/shamanec/GADS-devices-provider/logger"
 	"github.com/shamanec/GADS-devices-provider/models"
+	"github.com/shamanec/GADS-devices-provider/util"
 )
 
 // Check if the GADS-stream service is running on the device
@@ -29,11 +35,31 @@ func isGadsStreamServiceRunning(device *models.Device) (bool, error) {
 	return true, nil
 }
 
+// Get the version of GADS-stream installed on the device, ok is false if it is not installed
+func getGadsStreamVersion(device *models.Device) (version models.AndroidPackageVersion, ok bool, err error) {
+	output, err := adbShell(device, "dumpsys", "package", "com.shamanec.stream")
+	if err != nil {
+		return version, false, fmt.Errorf("getGadsStreamVersion: %s", err)
+	}
+
+	// The output lists the package under `Packages:` only if it is installed
+	codeMatch := regexp.MustCompile(`versionCode=(\d+)`).FindStringSubmatch(output)
+	if codeMatch == nil {
+		return version, false, nil
+	}
+	version.VersionCode, _ = strconv.ParseInt(codeMatch[1], 10, 64)
+	if nameMatch := regexp.MustCompile(`versionName=(\S+)`).FindStringSubmatch(output); nameMatch != nil {
+		version.VersionName = nameMatch[1]
+	}
+
+	return version, true, nil
+}
+
 // Install gads-stream.apk on the device
 func installGadsStream(device *models.Device) error {
 	logger.ProviderLogger.LogInfo("android_device_setup", fmt.Sprintf("Installing GADS-stream apk on device `%v`", device.UDID))
 
-	cmd := exec.CommandContext(device.Context, "adb", "-s", device.UDID, "install", "-r", fmt.Sprintf("%s/conf/gads-stream.apk", config.Config.EnvConfig.ProviderFolder))
+	cmd := exec.CommandContext(device.Context, "adb", "-s", device.UDID, "install", "-r", util.GadsStreamApkPath())
 	err := cmd.Run()
 	if err != nil {
 		return fmt.Errorf("installGadsStream: Error executing `%s` - %s", cmd.Path, err)
@@ -194,3 +220,373 @@ func installAppAndroid(device *models.Device, appName string) error {
 
 	return nil
 }
+
+// Run an adb shell command on the device and return its output
+func adbShell(device *models.Device, args ...string) (string, error) {
+	var outBuffer bytes.Buffer
+	cmd := exec.CommandContext(device.Context, "adb", append([]string{"-s", device.UDID, "shell"}, args...)...)
+	cmd.Stdout = &outBuffer
+	cmd.Stderr = &outBuffer
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("Error executing `adb shell %s` - %s - %s", strings.Join(args, " "), err, strings.TrimSpace(outBuffer.String()))
+	}
+	return outBuffer.String(), nil
+}
+
+// Get the result data of an `am broadcast` to the Appium Settings app
+// The app is installed on the device by the UiAutomator2 driver
+func appiumSettingsBroadcast(device *models.Device, receiver, action string) (string, error) {
+	output, err := adbShell(device, "am", "broadcast", "-n", "io.appium.settings/.receivers."+receiver, "-a", action)
+	if err != nil {
+		return "", err
+	}
+
+	match := regexp.MustCompile(`data="(.*)"`).FindStringSubmatch(output)
+	if match == nil {
+		return "", fmt.Errorf("No data returned by the Appium Settings app, make sure `io.appium.settings` is installed - %s", strings.TrimSpace(output))
+	}
+	return match[1], nil
+}
+
+// Get the current screen orientation of an Android device with adb
+func GetOrientationAndroid(device *models.Device) (string, error) {
+	output, err := adbShell(device, "dumpsys", "input")
+	if err != nil {
+		return "", fmt.Errorf("GetOrientationAndroid: %s", err)
+	}
+
+	rotation := ""
+	if match := regexp.MustCompile(`SurfaceOrientation: (\d)`).FindStringSubmatch(output); match != nil {
+		rotation = match[1]
+	} else {
+		// Newer Android versions don't report the surface orientation, fall back to the user rotation setting
+		output, err = adbShell(device, "settings", "get", "system", "user_rotation")
+		if err != nil {
+			return "", fmt.Errorf("GetOrientationAndroid: %s", err)
+		}
+		rotation = strings.TrimSpace(output)
+	}
+
+	switch rotation {
+	case "0", "2":
+		return "PORTRAIT", nil
+	case "1", "3":
+		return "LANDSCAPE", nil
+	default:
+		return "", fmt.Errorf("GetOrientationAndroid: Unknown rotation `%s`", rotation)
+	}
+}
+
+// Set the screen orientation of an Android device with adb, auto-rotation is disabled so the orientation sticks
+func SetOrientationAndroid(device *models.Device, orientation string) error {
+	rotation := "0"
+	if orientation == "LANDSCAPE" {
+		rotation = "1"
+	}
+
+	_, err := adbShell(device, "settings", "put", "system", "accelerometer_rotation", "0")
+	if err != nil {
+		return fmt.Errorf("SetOrientationAndroid: %s", err)
+	}
+	_, err = adbShell(device, "settings", "put", "system", "user_rotation", rotation)
+	if err != nil {
+		return fmt.Errorf("SetOrientationAndroid: %s", err)
+	}
+	return nil
+}
+
+// Android 10+ only allows the foreground app to read the clipboard so it can't be read with adb
+var ErrClipboardUnavailable = errors.New("the clipboard can't be read without an Appium session on Android 10 and newer")
+
+// Get the base64 encoded clipboard text of an Android device through the Appium Settings app
+// Only a broadcast is sent so the foreground app is not changed
+// Reads with an Appium session go through UiAutomator2 instead
+func GetClipboardAndroid(device *models.Device) (string, error) {
+	content, err := appiumSettingsBroadcast(device, "ClipboardReceiver", "io.appium.settings.clipboard.get")
+	if err != nil {
+		return "", fmt.Errorf("GetClipboardAndroid: %s", err)
+	}
+
+	// The background receiver gets an empty clipboard on Android 10+, which can't be told apart from an empty one
+	if content == "" {
+		output, err := adbShell(device, "getprop", "ro.build.version.sdk")
+		if err != nil {
+			return "", fmt.Errorf("GetClipboardAndroid: Could not get SDK version - %s", err)
+		}
+		sdkVersion, err := strconv.Atoi(strings.TrimSpace(output))
+		if err != nil || sdkVersion >= 29 {
+			return "", ErrClipboardUnavailable
+		}
+	}
+	return content, nil
+}
+
+// Get the mocked or last known location of an Android device through the Appium Settings app
+func GetGeolocationAndroid(device *models.Device) (models.DeviceGeolocation, error) {
+	var location models.DeviceGeolocation
+
+	data, err := appiumSettingsBroadcast(device, "LocationInfoReceiver", "io.appium.settings.location")
+	if err != nil {
+		return location, fmt.Errorf("GetGeolocationAndroid: %s", err)
+	}
+
+	// The data is `latitude longitude altitude`
+	_, err = fmt.Sscanf(data, "%g %g %g", &location.Latitude, &location.Longitude, &location.Altitude)
+	if err != nil {
+		return location, fmt.Errorf("GetGeolocationAndroid: Could not parse location `%s` - %s", data, err)
+	}
+	return location, nil
+}
+
+// Mock the location of an Android device through the Appium Settings app
+func SetGeolocationAndroid(device *models.Device, location models.DeviceGeolocation) error {
+	_, err := adbShell(device, "appops", "set", "io.appium.settings", "android:mock_location", "allow")
+	if err != nil {
+		return fmt.Errorf("SetGeolocationAndroid: %s", err)
+	}
+
+	_, err = adbShell(device, "am", "start-foreground-service", "--user", "0", "-n", "io.appium.settings/.LocationService",
+		"--es", "latitude", strconv.FormatFloat(location.Latitude, 'f', -1, 64),
+		"--es", "longitude", strconv.FormatFloat(location.Longitude, 'f', -1, 64),
+		"--es", "altitude", strconv.FormatFloat(location.Altitude, 'f', -1, 64))
+	if err != nil {
+		return fmt.Errorf("SetGeolocationAndroid: %s", err)
+	}
+	return nil
+}
+
+// Start an app fresh with adb, stopping it first if it is running
+func LaunchAppAndroid(device *models.Device, packageName string) error {
+	err := TerminateAppAndroid(device, packageName)
+	if err != nil {
+		return fmt.Errorf("LaunchAppAndroid: %s", err)
+	}
+	err = ActivateAppAndroid(device, packageName)
+	if err != nil {
+		return fmt.Errorf("LaunchAppAndroid: %s", err)
+	}
+	return nil
+}
+
+// Bring an app to the foreground with adb, starting it if it is not running
+func ActivateAppAndroid(device *models.Device, packageName string) error {
+	output, err := adbShell(device, "monkey", "-p", packageName, "-c", "android.intent.category.LAUNCHER", "1")
+	if err != nil {
+		return fmt.Errorf("ActivateAppAndroid: %s", err)
+	}
+	if strings.Contains(output, "No activities found") {
+		return fmt.Errorf("ActivateAppAndroid: No launchable activity found for `%s`", packageName)
+	}
+	return nil
+}
+
+// Stop an app with adb
+func TerminateAppAndroid(device *models.Device, packageName string) error {
+	_, err := adbShell(device, "am", "force-stop", packageName)
+	if err != nil {
+		return fmt.Errorf("TerminateAppAndroid: %s", err)
+	}
+	return nil
+}
+
+// Get the state of an app with adb
+func GetAppStateAndroid(device *models.Device, packageName string) (string, error) {
+	output, err := adbShell(device, "pm", "path", packageName)
+	if err != nil || strings.TrimSpace(output) == "" {
+		// `pm path` fails for packages that are not installed
+		return models.AppStateNotInstalled, nil
+	}
+
+	// `pidof` fails when there is no such process
+	output, err = adbShell(device, "pidof", packageName)
+	if err != nil || strings.TrimSpace(output) == "" {
+		return models.AppStateNotRunning, nil
+	}
+
+	output, err = adbShell(device, "dumpsys", "activity", "activities")
+	if err != nil {
+		return "", fmt.Errorf("GetAppStateAndroid: %s", err)
+	}
+	for _, line := range strings.Split(output, "\n") {
+		if strings.Contains(line, "ResumedActivity") && strings.Contains(line, packageName+"/") {
+			return models.AppStateForeground, nil
+		}
+	}
+	return models.AppStateBackground, nil
+}
+
+// Open a deep link with adb, optionally restricted to a package
+func OpenURLAndroid(device *models.Device, url, packageName string) error {
+	args := []string{"am", "start", "-W", "-a", "android.intent.action.VIEW", "-d", fmt.Sprintf("'%s'", strings.ReplaceAll(url, "'", `'\''`))}
+	if packageName != "" {
+		args = append(args, packageName)
+	}
+
+	output, err := adbShell(device, args...)
+	if err != nil {
+		return fmt.Errorf("OpenURLAndroid: %s", err)
+	}
+	if strings.Contains(output, "Error:") {
+		return fmt.Errorf("OpenURLAndroid: Could not open `%s` - %s", url, strings.TrimSpace(output))
+	}
+	return nil
+}
+
+// Take a PNG screenshot of an Android device with adb
+func TakeScreenshotAndroid(device *models.Device) ([]byte, error) {
+	var outBuffer, errBuffer bytes.Buffer
+	cmd := exec.CommandContext(device.Context, "adb", "-s", device.UDID, "exec-out", "screencap", "-p")
+	cmd.Stdout = &outBuffer
+	cmd.Stderr = &errBuffer
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("TakeScreenshotAndroid: Error executing `%s` - %s - %s", cmd.Path, err, strings.TrimSpace(errBuffer.String()))
+	}
+	return outBuffer.Bytes(), nil
+}
+
+// Input method from the Appium Settings app that decodes modified UTF-7 text sent with `input text`
+const appiumUnicodeIME = "io.appium.settings/.UnicodeIME"
+
+// Returned when typing failed after part of the text was already typed
+var ErrPartialTextInput = errors.New("text was only partially typed")
+
+// Characters that have to be escaped for the device shell when passed to `input text`
+const inputTextShellChars = "()<>|;&*\\~\"'`$?[]{}#!"
+
+// Type text on an Android device with adb
+// Text that is not printable ASCII is typed through the Appium Settings unicode IME, new lines are sent as enter presses
+func InputTextAndroid(device *models.Device, text string) error {
+	unicode := false
+	for _, r := range text {
+		if (r < 0x20 || r > 0x7e) && r != '\n' {
+			unicode = true
+			break
+		}
+	}
+
+	if unicode {
+		previousIME, err := adbShell(device, "settings", "get", "secure", "default_input_method")
+		if err != nil {
+			return fmt.Errorf("InputTextAndroid: Could not get current input method - %s", err)
+		}
+		previousIME = strings.TrimSpace(previousIME)
+
+		if _, err := adbShell(device, "ime", "enable", appiumUnicodeIME); err != nil {
+			return fmt.Errorf("InputTextAndroid: Could not enable unicode input method, make sure `io.appium.settings` is installed - %s", err)
+		}
+		if _, err := adbShell(device, "ime", "set", appiumUnicodeIME); err != nil {
+			return fmt.Errorf("InputTextAndroid: Could not set unicode input method - %s", err)
+		}
+		defer func() {
+			if previousIME != "" && previousIME != "null" && previousIME != appiumUnicodeIME {
+				if _, err := adbShell(device, "ime", "set", previousIME); err != nil {
+					device.Logger.LogWarn("text_input", fmt.Sprintf("Could not restore input method `%s` - %s", previousIME, err))
+				}
+			}
+		}()
+	}
+
+	typed := false
+	for i, line := range strings.Split(text, "\n") {
+		if i > 0 {
+			if err := PressKeycodeAndroid(device, 66); err != nil {
+				return inputTextError(typed, fmt.Errorf("InputTextAndroid: Could not type new line - %s", err))
+			}
+			typed = true
+		}
+		if unicode {
+			line = encodeModifiedUTF7(line)
+		}
+		for _, chunk := range inputTextChunks(line) {
+			if _, err := adbShell(device, "input", "text", escapeInputText(chunk)); err != nil {
+				return inputTextError(typed, fmt.Errorf("InputTextAndroid: Could not type text - %s", err))
+			}
+			typed = true
+		}
+	}
+	return nil
+}
+
+// Mark the error as partial input if part of the text was already typed
+func inputTextError(typed bool, err error) error {
+	if typed {
+		return fmt.Errorf("%w - %s", ErrPartialTextInput, err)
+	}
+	return err
+}
+
+// Press a key on an Android device by its keycode with adb
+func PressKeycodeAndroid(device *models.Device, keycode int) error {
+	_, err := adbShell(device, "input", "keyevent", strconv.Itoa(keycode))
+	if err != nil {
+		return fmt.Errorf("PressKeycodeAndroid: Could not press keycode %v - %s", keycode, err)
+	}
+	return nil
+}
+
+// Split text so a literal `%s` is not typed as a space by `input text`
+func inputTextChunks(text string) []string {
+	var chunks []string
+	start := 0
+	for i := 0; i < len(text)-1; i++ {
+		if text[i] == '%' && text[i+1] == 's' {
+			chunks = append(chunks, text[start:i+1])
+			start = i + 1
+		}
+	}
+	if start < len(text) {
+		chunks = append(chunks, text[start:])
+	}
+	return chunks
+}
+
+// Escape text for `input text` - spaces are sent as `%s` and shell characters are backslash escaped
+func escapeInputText(text string) string {
+	var escaped strings.Builder
+	for _, r := range text {
+		switch {
+		case r == ' ':
+			escaped.WriteString("%s")
+		case strings.ContainsRune(inputTextShellChars, r):
+			escaped.WriteRune('\\')
+			escaped.WriteRune(r)
+		default:
+			escaped.WriteRune(r)
+		}
+	}
+	return escaped.String()
+}
+
+// Encode text in the IMAP modified UTF-7 format expected by the Appium Settings unicode IME
+func encodeModifiedUTF7(text string) string {
+	encoding := base64.StdEncoding.WithPadding(base64.NoPadding)
+
+	var encoded strings.Builder
+	var pending []rune
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		var utf16Bytes []byte
+		for _, unit := range utf16.Encode(pending) {
+			utf16Bytes = append(utf16Bytes, byte(unit>>8), byte(unit))
+		}
+		encoded.WriteString("&" + strings.ReplaceAll(encoding.EncodeToString(utf16Bytes), "/", ",") + "-")
+		pending = nil
+	}
+
+	for _, r := range text {
+		if r >= 0x20 && r <= 0x7e {
+			flush()
+			if r == '&' {
+				encoded.WriteString("&-")
+			} else {
+				encoded.WriteRune(r)
+			}
+			continue
+		}
+		pending = append(pending, r)
+	}
+	flush()
+	return encoded.String()
+}
@@ -5,24 +5,24 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
-	"slices"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/danielpaulus/go-ios/ios"
-	"github.com/pelletier/go-toml"
 	"github.com/shamanec/GADS-devices-provider/config"
 	"github.com/shamanec/GADS-devices-provider/constants"
 	"github.com/shamanec/GADS-devices-provider/db"
+	"github.com/shamanec/GADS-devices-provider/grid"
 	"github.com/shamanec/GADS-devices-provider/logger"
 	"github.com/shamanec/GADS-devices-provider/models"
+	"github.com/shamanec/GADS-devices-provider/recorder"
 	"github.com/shamanec/GADS-devices-provider/util"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -176,78 +176,50 @@ func Setup() {
 	}
 }
 
-func setupAndroidDevice(device *models.Device) {
-	device.ProviderState = "preparing"
-
-	logger.ProviderLogger.LogInfo("android_device_setup", fmt.Sprintf("Running setup for device `%v`", device.UDID))
-
-	err := updateScreenSize(device)
+// Install and start GADS-stream if it is not running or its version differs from the provider apk
+// and forward its port to the device stream port
+func setupGadsStream(device *models.Device) error {
+	isStreamAvailable, err := isGadsStreamServiceRunning(device)
 	if err != nil {
-		logger.ProviderLogger.LogError("android_device_setup", fmt.Sprintf("Could not update screen dimensions with adb for device `%v` - %v", device.UDID, err))
-		resetLocalDevice(device)
-		return
+		return fmt.Errorf("Could not check if GADS-stream is running - %s", err)
 	}
-	getModel(device)
-	getAndroidOSVersion(device)
 
-	// If Selenium Grid is used attempt to create a TOML file for the grid connection
-	if config.Config.EnvConfig.UseSeleniumGrid {
-		err := createGridTOML(device)
-		if err != nil {
-			logger.ProviderLogger.LogError("ios_device_setup", fmt.Sprintf("Selenium Grid use is enabled but couldn't create TOML for device `%s` - %s", device.UDID, err))
-			resetLocalDevice(device)
-			return
-		}
-	}
-
-	isStreamAvailable, err := isGadsStreamServiceRunning(device)
+	installedVersion, isInstalled, err := getGadsStreamVersion(device)
 	if err != nil {
-		logger.ProviderLogger.LogError("android_device_setup", fmt.Sprintf("Could not check if GADS-stream is running on device `%v` - %v", device.UDID, err))
-		resetLocalDevice(device)
-		return
+		return fmt.Errorf("Could not get the installed GADS-stream version - %s", err)
 	}
 
-	streamPort, err := util.GetFreePort()
-	if err != nil {
-		logger.ProviderLogger.LogError("android_device_setup", fmt.Sprintf("Could not allocate free host port for GADS-stream for device `%v` - %v", device.UDID, err))
-		resetLocalDevice(device)
-		return
+	// The versions are compared only if the provider apk version could be read
+	needsUpgrade := false
+	if isInstalled && util.GadsStreamVersion.VersionCode != 0 && installedVersion != util.GadsStreamVersion {
+		logger.ProviderLogger.LogInfo("android_device_setup", fmt.Sprintf("GADS-stream %s on device `%v` differs from the provider apk %s, it will be reinstalled", installedVersion, device.UDID, util.GadsStreamVersion))
+		needsUpgrade = true
 	}
-	device.StreamPort = streamPort
 
-	if !isStreamAvailable {
-		apps := getInstalledAppsAndroid(device)
-		if slices.Contains(apps, "com.shamanec.stream") {
+	if !isStreamAvailable || needsUpgrade {
+		if isInstalled {
 			err = uninstallGadsStream(device)
 			if err != nil {
-				logger.ProviderLogger.LogError("android_device_setup", fmt.Sprintf("Could not uninstall GADS-stream from Android device - %v:\n %v", device.UDID, err))
-				resetLocalDevice(device)
-				return
+				return fmt.Errorf("Could not uninstall GADS-stream - %s", err)
 			}
 			time.Sleep(1 * time.Second)
 		}
 
 		err = installGadsStream(device)
 		if err != nil {
-			logger.ProviderLogger.LogError("android_device_setup", fmt.Sprintf("Could not install GADS-stream on Android device - %v:\n %v", device.UDID, err))
-			resetLocalDevice(device)
-			return
+			return fmt.Errorf("Could not install GADS-stream - %s", err)
 		}
 		time.Sleep(1 * time.Second)
 
 		err = addGadsStreamRecordingPermissions(device)
 		if err != nil {
-			logger.ProviderLogger.LogError("android_device_setup", fmt.Sprintf("Could not set GADS-stream recording permissions on Android device - %v:\n %v", device.UDID, err))
-			resetLocalDevice(device)
-			return
+			return fmt.Errorf("Could not set GADS-stream recording permissions - %s", err)
 		}
 		time.Sleep(1 * time.Second)
 
 		err = startGadsStreamApp(device)
 		if err != nil {
-			logger.ProviderLogger.LogError("android_device_setup", fmt.Sprintf("Could not start GADS-stream app on Android device - %v:\n %v", device.UDID, err))
-			resetLocalDevice(device)
-			return
+			return fmt.Errorf("Could not start GADS-stream app - %s", err)
 		}
 		time.Sleep(1 * time.Second)
 
@@ -256,16 +228,49 @@ func setupAndroidDevice(device *models.Device) {
 
 	err = forwardGadsStream(device)
 	if err != nil {
-		logger.ProviderLogger.LogError("android_device_setup", fmt.Sprintf("Could not forward GADS-stream port to host port %v for Android device - %v:\n %v", device.StreamPort, device.UDID, err))
+		return fmt.Errorf("Could not forward GADS-stream port to host port %v - %s", device.StreamPort, err)
+	}
+	return nil
+}
+
+func setupAndroidDevice(device *models.Device) {
+	device.ProviderState = "preparing"
+
+	logger.ProviderLogger.LogInfo("android_device_setup", fmt.Sprintf("Running setup for device `%v`", device.UDID))
+
+	err := updateScreenSize(device)
+	if err != nil {
+		logger.ProviderLogger.LogError("android_device_setup", fmt.Sprintf("Could not update screen dimensions with adb for device `%v` - %v", device.UDID, err))
 		resetLocalDevice(device)
 		return
 	}
+	getModel(device)
+	getAndroidOSVersion(device)
+	updateLabels(device)
+	updateStreamSettings(device)
+
+	streamPort, err := util.GetFreePort()
+	if err != nil {
+		logger.ProviderLogger.LogError("android_device_setup", fmt.Sprintf("Could not allocate free host port for GADS-stream for device `%v` - %v", device.UDID, err))
+		resetLocalDevice(device)
+		return
+	}
+	device.StreamPort = streamPort
+
+	// Devices that can't run GADS-stream still go live with a slower stream from adb screenshots
+	err = setupGadsStream(device)
+	if err != nil {
+		logger.ProviderLogger.LogWarn("android_device_setup", fmt.Sprintf("Could not set up GADS-stream on device `%v`, falling back to degraded screencap stream - %v", device.UDID, err))
+		device.StreamType = models.StreamTypeScreencap
+	} else {
+		device.StreamType = models.StreamTypeGadsStream
+	}
 
 	device.InstalledApps = getInstalledAppsAndroid(device)
 
 	go startAppium(device)
 	if config.Config.EnvConfig.UseSeleniumGrid {
-		go startGridNode(device)
+		grid.StartNode(device)
 	}
 
 	// Mark the device as 'live'
@@ -310,16 +315,6 @@ func setupIOSDevice(device *models.Device) {
 		return
 	}
 
-	// If Selenium Grid is used attempt to create a TOML file for the grid connection
-	if config.Config.EnvConfig.UseSeleniumGrid {
-		err := createGridTOML(device)
-		if err != nil {
-			logger.ProviderLogger.LogError("ios_device_setup", fmt.Sprintf("Selenium Grid use is enabled but couldn't create TOML for device `%s` - %s", device.UDID, err))
-			resetLocalDevice(device)
-			return
-		}
-	}
-
 	// Update the screen dimensions of the device using data from the IOSDeviceDimensions map
 	err = updateScreenSize(device)
 	if err != nil {
@@ -328,6 +323,8 @@ func setupIOSDevice(device *models.Device) {
 		return
 	}
 	getModel(device)
+	updateLabels(device)
+	updateStreamSettings(device)
 
 	wdaPort, err := util.GetFreePort()
 	if err != nil {
@@ -402,7 +399,7 @@ func setupIOSDevice(device *models.Device) {
 
 	go startAppium(device)
 	if config.Config.EnvConfig.UseSeleniumGrid {
-		go startGridNode(device)
+		grid.StartNode(device)
 	}
 
 	device.InstalledApps = getInstalledAppsIOS(device)
@@ -490,7 +487,7 @@ func resetLocalDevice(device *models.Device) {
 		logger.ProviderLogger.LogInfo("provider", fmt.Sprintf("Resetting LocalDevice for device `%v` after error. Cancelling context, setting ProviderState to `init`, Healthy to `false` and updating the DB", device.UDID))
 
 		device.IsResetting = true
-		device.CtxCancel()
+		CancelDeviceContext(device)
 		device.ProviderState = "init"
 		device.IsResetting = false
 
@@ -502,6 +499,15 @@ func resetLocalDevice(device *models.Device) {
 	}
 }
 
+// Remove the device from the Selenium Grid and cancel its context to stop all goroutines related to the device
+// The Grid node is drained first so no new sessions are routed to a device that is going away
+func CancelDeviceContext(device *models.Device) {
+	if config.Config.EnvConfig.UseSeleniumGrid {
+		grid.StopNode(device)
+	}
+	device.CtxCancel()
+}
+
 // Set a context for a device to enable cancelling running goroutines related to that device when its disconnected
 func setContext(device *models.Device) {
 	ctx, cancelFunc := context.WithCancel(context.Background())
@@ -510,31 +516,7 @@ func setContext(device *models.Device) {
 }
 
 func startAppium(device *models.Device) {
-	var capabilities models.AppiumServerCapabilities
-
-	if device.OS == "ios" {
-		capabilities = models.AppiumServerCapabilities{
-			UDID:                  device.UDID,
-			WdaURL:                "http://localhost:" + device.WDAPort,
-			WdaMjpegPort:          device.WDAStreamPort,
-			WdaLocalPort:          device.WDAPort,
-			WdaLaunchTimeout:      "120000",
-			WdaConnectionTimeout:  "240000",
-			ClearSystemFiles:      "false",
-			PreventWdaAttachments: "true",
-			SimpleIsVisibleCheck:  "false",
-			AutomationName:        "XCUITest",
-			PlatformName:          "iOS",
-			DeviceName:            device.Name,
-		}
-	} else if device.OS == "android" {
-		capabilities = models.AppiumServerCapabilities{
-			UDID:           device.UDID,
-			AutomationName: "UiAutomator2",
-			PlatformName:   "Android",
-			DeviceName:     device.Name,
-		}
-	}
+	capabilities := appiumServerCapabilities(device)
 
 	capabilitiesJson, _ := json.Marshal(capabilities)
 
@@ -570,7 +552,11 @@ func startAppium(device *models.Device) {
 
 	for scanner.Scan() {
 		line := scanner.Text()
+		previousSessionID := device.AppiumSessionID
 		device.AppiumLogger.Log(device, line)
+		if device.AppiumSessionID != previousSessionID {
+			handleAppiumSessionChange(device)
+		}
 	}
 
 	err = cmd.Wait()
@@ -580,93 +566,95 @@ func startAppium(device *models.Device) {
 	}
 }
 
-func createGridTOML(device *models.Device) error {
-	automationName := ""
+// Default capabilities the Appium server of a device is started with
+func appiumServerCapabilities(device *models.Device) models.AppiumServerCapabilities {
+	var capabilities models.AppiumServerCapabilities
+
 	if device.OS == "ios" {
-		automationName = "XCUITest"
-	} else {
-		automationName = "UiAutomator2"
-	}
-
-	url := fmt.Sprintf("http://%s:%v/device/%s/appium", config.Config.EnvConfig.HostAddress, config.Config.EnvConfig.Port, device.UDID)
-	configs := fmt.Sprintf(`{"appium:deviceName": "%s", "platformName": "%s", "appium:platformVersion": "%s", "appium:automationName": "%s"}`, device.Name, device.OS, device.OSVersion, automationName)
-
-	port, _ := util.GetFreePort()
-	portInt, _ := strconv.Atoi(port)
-	conf := models.AppiumTomlConfig{
-		Server: models.AppiumTomlServer{
-			Port: portInt,
-		},
-		Node: models.AppiumTomlNode{
-			DetectDrivers: false,
-		},
-		Relay: models.AppiumTomlRelay{
-			URL:            url,
-			StatusEndpoint: "/status",
-			Configs: []string{
-				"1",
-				configs,
-			},
-		},
-	}
-
-	res, err := toml.Marshal(conf)
-	if err != nil {
-		return fmt.Errorf("Failed marshalling TOML Appium config - %s", err)
+		capabilities = models.AppiumServerCapabilities{
+			UDID:                  device.UDID,
+			WdaURL:                "http://localhost:" + device.WDAPort,
+			WdaMjpegPort:          device.WDAStreamPort,
+			WdaLocalPort:          device.WDAPort,
+			WdaLaunchTimeout:      "120000",
+			WdaConnectionTimeout:  "240000",
+			ClearSystemFiles:      "false",
+			PreventWdaAttachments: "true",
+			SimpleIsVisibleCheck:  "false",
+			AutomationName:        "XCUITest",
+			PlatformName:          "iOS",
+			DeviceName:            device.Name,
+		}
+	} else if device.OS == "android" {
+		capabilities = models.AppiumServerCapabilities{
+			UDID:           device.UDID,
+			AutomationName: "UiAutomator2",
+			PlatformName:   "Android",
+			DeviceName:     device.Name,
+		}
 	}
 
-	file, err := os.Create(fmt.Sprintf("%s/conf/%s.toml", config.Config.EnvConfig.ProviderFolder, device.UDID))
-	if err != nil {
-		return fmt.Errorf("Failed creating TOML Appium config file - %s", err)
-	}
-	defer file.Close()
+	return capabilities
+}
 
-	_, err = io.WriteString(file, string(res))
-	if err != nil {
-		return fmt.Errorf("Failed writing to TOML Appium config file - %s", err)
+// Capabilities that are managed by the provider and should not be overridden by Appium sessions
+// These are the device identity, driver and ports that the provider set up for the device
+func ManagedAppiumCapabilities(device *models.Device) map[string]interface{} {
+	serverCapabilities := appiumServerCapabilities(device)
+
+	managed := map[string]interface{}{
+		"appium:udid":           serverCapabilities.UDID,
+		"appium:automationName": serverCapabilities.AutomationName,
+		"platformName":          serverCapabilities.PlatformName,
+	}
+	if device.OS == "ios" {
+		managed["appium:webDriverAgentUrl"] = serverCapabilities.WdaURL
+		managed["appium:wdaLocalPort"] = serverCapabilities.WdaLocalPort
+		managed["appium:mjpegServerPort"] = serverCapabilities.WdaMjpegPort
 	}
 
-	return nil
+	return managed
 }
 
-func startGridNode(device *models.Device) {
-	time.Sleep(5 * time.Second)
-	cmd := exec.CommandContext(device.Context,
-		"java",
-		"-jar",
-		fmt.Sprintf("%s/conf/%s", config.Config.EnvConfig.ProviderFolder, config.Config.EnvConfig.SeleniumJarFile),
-		"node",
-		"--host",
-		config.Config.EnvConfig.HostAddress,
-		"--config",
-		fmt.Sprintf("%s/conf/%s.toml", config.Config.EnvConfig.ProviderFolder, device.UDID),
-		"--grid-url",
-		config.Config.EnvConfig.SeleniumGrid,
-	)
+// Serializes the session recording changes of each device
+var sessionRecordingLocks = make(map[string]*sync.Mutex)
+var sessionRecordingLocksMu sync.Mutex
 
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		logger.ProviderLogger.LogError("device_setup", fmt.Sprintf("Error creating stdoutpipe while starting Selenium Grid node for device `%v` - %v", device.UDID, err))
-		resetLocalDevice(device)
+// Start or stop recording the device stream when an Appium session is created or removed
+// Stopping waits for the video to be finalized so it is not done in the Appium log scanner
+func handleAppiumSessionChange(device *models.Device) {
+	if !config.Config.EnvConfig.RecordAppiumSessions {
 		return
 	}
 
-	if err := cmd.Start(); err != nil {
-		logger.ProviderLogger.LogError("device_setup", fmt.Sprintf("Could not start Selenium Grid node for device `%v` - %v", device.UDID, err))
-		resetLocalDevice(device)
-		return
+	go syncSessionRecording(device)
+}
+
+// Record the current Appium session of the device, changes that were already superseded are skipped
+func syncSessionRecording(device *models.Device) {
+	sessionRecordingLocksMu.Lock()
+	lock, ok := sessionRecordingLocks[device.UDID]
+	if !ok {
+		lock = &sync.Mutex{}
+		sessionRecordingLocks[device.UDID] = lock
 	}
+	sessionRecordingLocksMu.Unlock()
 
-	scanner := bufio.NewScanner(stdout)
+	lock.Lock()
+	defer lock.Unlock()
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		device.Logger.LogDebug("grid-node", strings.TrimSpace(line))
+	sessionID := device.AppiumSessionID
+	if sessionID == "" {
+		recorder.StopSessionRecording(device)
+		return
+	}
+	if recorder.IsRecording(device.UDID, sessionID) {
+		return
 	}
 
-	if err := cmd.Wait(); err != nil {
-		logger.ProviderLogger.LogError("device_setup", fmt.Sprintf("Error waiting for Selenium Grid node command to finish, it errored out or device `%v` was disconnected - %v", device.UDID, err))
-		resetLocalDevice(device)
+	err := recorder.StartSessionRecording(device, sessionID)
+	if err != nil {
+		device.Logger.LogError("session_recording", fmt.Sprintf("Could not start recording Appium session `%s` - %s", sessionID, err))
 	}
 }
 
@@ -683,6 +671,8 @@ func updateScreenSize(device *models.Device) error {
 		if err != nil {
 			return err
 		}
+		// Appium uses physical pixels on Android
+		device.ScreenScale = 1
 	}
 
 	return nil
@@ -717,6 +707,93 @@ func getModel(device *models.Device) {
 	}
 }
 
+// Get the operator labels for the device from the DB
+func updateLabels(device *models.Device) {
+	labels, err := db.GetDeviceLabels(device.UDID)
+	if err != nil {
+		device.Logger.LogWarn("device_setup", fmt.Sprintf("Could not get device labels from DB - %s", err))
+		labels = []string{}
+	}
+	device.Labels = labels
+}
+
+// Returned when the stream of a device can't be reconfigured at runtime
+var ErrStreamSettingsUnsupported = errors.New("stream settings can't be changed at runtime for this device stream")
+
+// Built-in stream settings used when neither the provider nor the device configure them
+var defaultStreamSettings = models.StreamSettings{
+	TargetFPS:     30,
+	JpegQuality:   75,
+	ScalingFactor: 100,
+}
+
+// Resolve the stream settings of the device from the built-in defaults, the provider config and the device overrides in the DB
+func updateStreamSettings(device *models.Device) {
+	settings := MergeStreamSettings(defaultStreamSettings, config.Config.EnvConfig.StreamSettings)
+
+	deviceSettings, err := db.GetDeviceStreamSettings(device.UDID)
+	if err != nil {
+		device.Logger.LogWarn("device_setup", fmt.Sprintf("Could not get device stream settings from DB - %s", err))
+	}
+	settings = MergeStreamSettings(settings, deviceSettings)
+
+	if err := ValidateStreamSettings(settings); err != nil {
+		device.Logger.LogWarn("device_setup", fmt.Sprintf("Configured stream settings are invalid, using defaults - %s", err))
+		settings = defaultStreamSettings
+	}
+	device.StreamSettings = settings
+}
+
+// Override the base stream settings with the values that are set in the override
+func MergeStreamSettings(base, override models.StreamSettings) models.StreamSettings {
+	if override.TargetFPS != 0 {
+		base.TargetFPS = override.TargetFPS
+	}
+	if override.JpegQuality != 0 {
+		base.JpegQuality = override.JpegQuality
+	}
+	if override.ScalingFactor != 0 {
+		base.ScalingFactor = override.ScalingFactor
+	}
+	return base
+}
+
+// Check that the stream settings are within the ranges WebDriverAgent accepts
+func ValidateStreamSettings(settings models.StreamSettings) error {
+	if settings.TargetFPS < 1 || settings.TargetFPS > 60 {
+		return fmt.Errorf("target_fps must be between 1 and 60, got %v", settings.TargetFPS)
+	}
+	if settings.JpegQuality < 1 || settings.JpegQuality > 100 {
+		return fmt.Errorf("jpeg_quality must be between 1 and 100, got %v", settings.JpegQuality)
+	}
+	if settings.ScalingFactor < 1 || settings.ScalingFactor > 100 {
+		return fmt.Errorf("scaling_factor must be between 1 and 100, got %v", settings.ScalingFactor)
+	}
+	return nil
+}
+
+// Apply new stream settings to the running device stream
+// Only the WebDriverAgent MJPEG server and the Android screencap fallback stream can be reconfigured at runtime
+func UpdateStreamSettings(device *models.Device, settings models.StreamSettings) error {
+	if device.OS == "android" && device.StreamType == models.StreamTypeScreencap {
+		// The screencap stream reads the device settings for each frame
+		device.StreamSettings = settings
+		return nil
+	}
+	if device.OS != "ios" || config.Config.EnvConfig.UseGadsIosStream {
+		return ErrStreamSettingsUnsupported
+	}
+
+	previous := device.StreamSettings
+	device.StreamSettings = settings
+	err := updateWebDriverAgentStreamSettings(device)
+	if err != nil {
+		device.StreamSettings = previous
+		return err
+	}
+	return nil
+}
+
 func getAndroidOSVersion(device *models.Device) {
 	if device.OS == "ios" {
 
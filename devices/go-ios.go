@@ -1,8 +1,12 @@
 package devices
 
 import (
+	"errors"
 	"fmt"
 
+	"github.com/danielpaulus/go-ios/ios/installationproxy"
+	"github.com/danielpaulus/go-ios/ios/instruments"
+	"github.com/danielpaulus/go-ios/ios/screenshotr"
 	"github.com/danielpaulus/go-ios/ios/zipconduit"
 	"github.com/shamanec/GADS-devices-provider/logger"
 	"github.com/shamanec/GADS-devices-provider/models"
@@ -21,3 +25,122 @@ func InstallAppWithDevice(device *models.Device, filePath string) error {
 	}
 	return nil
 }
+
+// Start an app fresh with go-ios, stopping it first if it is running
+func LaunchAppIOS(device *models.Device, bundleID string) error {
+	err := TerminateAppIOS(device, bundleID)
+	if err != nil {
+		return fmt.Errorf("LaunchAppIOS: %s", err)
+	}
+
+	processControl, err := instruments.NewProcessControl(device.GoIOSDeviceEntry)
+	if err != nil {
+		return fmt.Errorf("LaunchAppIOS: Failed creating process control with go-ios - %s", err)
+	}
+	defer processControl.Close()
+
+	_, err = processControl.LaunchApp(bundleID)
+	if err != nil {
+		return fmt.Errorf("LaunchAppIOS: Failed launching `%s` with go-ios - %s", bundleID, err)
+	}
+	return nil
+}
+
+// Stop an app with go-ios if it is running
+func TerminateAppIOS(device *models.Device, bundleID string) error {
+	pid, err := getAppPidIOS(device, bundleID)
+	if err != nil {
+		return fmt.Errorf("TerminateAppIOS: %s", err)
+	}
+	if pid == 0 {
+		return nil
+	}
+
+	processControl, err := instruments.NewProcessControl(device.GoIOSDeviceEntry)
+	if err != nil {
+		return fmt.Errorf("TerminateAppIOS: Failed creating process control with go-ios - %s", err)
+	}
+	defer processControl.Close()
+
+	err = processControl.KillProcess(pid)
+	if err != nil {
+		return fmt.Errorf("TerminateAppIOS: Failed killing `%s` with go-ios - %s", bundleID, err)
+	}
+	return nil
+}
+
+// Get the state of an app with go-ios
+// go-ios can't tell which app is in the foreground so running apps are reported as `background`
+func GetAppStateIOS(device *models.Device, bundleID string) (string, error) {
+	pid, err := getAppPidIOS(device, bundleID)
+	if errors.Is(err, errAppNotInstalled) {
+		return models.AppStateNotInstalled, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("GetAppStateIOS: %s", err)
+	}
+	if pid == 0 {
+		return models.AppStateNotRunning, nil
+	}
+	return models.AppStateBackground, nil
+}
+
+var errAppNotInstalled = errors.New("app is not installed")
+
+// Get the process ID of a running app by matching its executable name, 0 if it is not running
+func getAppPidIOS(device *models.Device, bundleID string) (uint64, error) {
+	installationProxy, err := installationproxy.New(device.GoIOSDeviceEntry)
+	if err != nil {
+		return 0, fmt.Errorf("Failed creating installation proxy with go-ios - %s", err)
+	}
+	defer installationProxy.Close()
+
+	apps, err := installationProxy.BrowseAllApps()
+	if err != nil {
+		return 0, fmt.Errorf("Failed getting installed apps with go-ios - %s", err)
+	}
+
+	executable := ""
+	for _, app := range apps {
+		if app.CFBundleIdentifier == bundleID {
+			executable = app.CFBundleExecutable
+			break
+		}
+	}
+	if executable == "" {
+		return 0, errAppNotInstalled
+	}
+
+	deviceInfo, err := instruments.NewDeviceInfoService(device.GoIOSDeviceEntry)
+	if err != nil {
+		return 0, fmt.Errorf("Failed creating device info service with go-ios - %s", err)
+	}
+	defer deviceInfo.Close()
+
+	processes, err := deviceInfo.ProcessList()
+	if err != nil {
+		return 0, fmt.Errorf("Failed getting process list with go-ios - %s", err)
+	}
+	for _, process := range processes {
+		if process.IsApplication && process.Name == executable {
+			return process.Pid, nil
+		}
+	}
+	return 0, nil
+}
+
+// Take a PNG screenshot of an iOS device with the go-ios screenshot service
+// The developer disk image has to be mounted on the device
+func TakeScreenshotIOS(device *models.Device) ([]byte, error) {
+	conn, err := screenshotr.New(device.GoIOSDeviceEntry)
+	if err != nil {
+		return nil, fmt.Errorf("TakeScreenshotIOS: Failed connecting to screenshot service with go-ios - %s", err)
+	}
+	defer conn.Close()
+
+	screenshot, err := conn.TakeScreenshot()
+	if err != nil {
+		return nil, fmt.Errorf("TakeScreenshotIOS: Failed taking screenshot with go-ios - %s", err)
+	}
+	return screenshot, nil
+}
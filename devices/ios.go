@@ -109,23 +109,55 @@ func updateWebDriverAgent(device *models.Device) error {
 		return err
 	}
 
+	// The scale is only needed for pixel coordinates so the device stays live without it
+	// An unknown scale stays 0 so pixel coordinate requests fail instead of being converted wrong
+	err = updateScreenScale(device)
+	if err != nil {
+		logger.ProviderLogger.LogWarn("ios_device_setup", fmt.Sprintf("updateWebDriverAgent: Could not get screen scale from WebDriverAgent for device %v, pixel coordinates won't be available - %v", device.UDID, err))
+	}
+
+	return nil
+}
+
+// Get the ratio between screen pixels and points from WebDriverAgent
+func updateScreenScale(device *models.Device) error {
+	response, err := netClient.Get("http://localhost:" + device.WDAPort + "/wda/screen")
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	var responseJson struct {
+		Value struct {
+			Scale float64 `json:"scale"`
+		} `json:"value"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&responseJson)
+	if err != nil {
+		return fmt.Errorf("updateScreenScale: Could not decode WebDriverAgent screen response - %s", err)
+	}
+	if responseJson.Value.Scale <= 0 {
+		return fmt.Errorf("updateScreenScale: WebDriverAgent returned invalid screen scale %v", responseJson.Value.Scale)
+	}
+
+	device.ScreenScale = responseJson.Value.Scale
 	return nil
 }
 
 func updateWebDriverAgentStreamSettings(device *models.Device) error {
-	// Set 30 frames per second, without any scaling, half the original screenshot quality
-	// TODO should make this configurable in some way, although can be easily updated the same way
-	requestString := `{"settings": {"mjpegServerFramerate": 30, "mjpegServerScreenshotQuality": 75, "mjpegScalingFactor": 100}}`
+	requestString := fmt.Sprintf(`{"settings": {"mjpegServerFramerate": %v, "mjpegServerScreenshotQuality": %v, "mjpegScalingFactor": %v}}`,
+		device.StreamSettings.TargetFPS, device.StreamSettings.JpegQuality, device.StreamSettings.ScalingFactor)
 
 	// Post the mjpeg server settings
-	response, err := http.Post("http://localhost:"+device.WDAPort+"/session/"+device.WDASessionID+"/appium/settings", "application/json", strings.NewReader(requestString))
+	response, err := netClient.Post("http://localhost:"+device.WDAPort+"/session/"+device.WDASessionID+"/appium/settings", "application/json", strings.NewReader(requestString))
 	if err != nil {
 		return err
 	}
+	defer response.Body.Close()
 
-	// TODO - potentially read the body to supply in the error
 	if response.StatusCode != 200 {
-		return fmt.Errorf("updateWebDriverAgentStreamSettings: Could not successfully update WDA stream settings, status code=%v", response.StatusCode)
+		body, _ := io.ReadAll(response.Body)
+		return fmt.Errorf("updateWebDriverAgentStreamSettings: Could not successfully update WDA stream settings, status code=%v - %s", response.StatusCode, string(body))
 	}
 
 	return nil
@@ -4,12 +4,13 @@ go 1.21
 
 require (
 	github.com/gobwas/ws v1.3.0
-	github.com/pelletier/go-toml v1.9.5
 	github.com/sirupsen/logrus v1.9.3
 	github.com/swaggo/swag v1.8.1
 	go.mongodb.org/mongo-driver v1.12.1
 )
 
+require github.com/frankban/quicktest v1.14.6 // indirect
+
 require (
 	github.com/Masterminds/semver v1.5.0 // indirect
 	github.com/chenzhuoyu/iasm v0.9.0 // indirect
@@ -21,14 +22,14 @@ require (
 	github.com/google/go-cmp v0.5.9 // indirect
 	github.com/google/uuid v1.1.2 // indirect
 	github.com/klauspost/compress v1.13.6 // indirect
-	github.com/kr/pretty v0.3.1 // indirect
 	github.com/montanaflynn/stats v0.0.0-20171201202039-1bf9dbcd8cbe // indirect
+	github.com/pierrec/lz4 v2.6.1+incompatible // indirect
 	github.com/xdg-go/pbkdf2 v1.0.0 // indirect
 	github.com/xdg-go/scram v1.1.2 // indirect
 	github.com/xdg-go/stringprep v1.0.4 // indirect
 	github.com/youmark/pkcs8 v0.0.0-20181117223130-1be2e3e5546d // indirect
 	golang.org/x/sync v0.4.0 // indirect
-	howett.net/plist v0.0.0-20200419221736-3b63eb3a43b5 // indirect
+	howett.net/plist v0.0.0-20200419221736-3b63eb3a43b5
 )
 
 require (
@@ -56,7 +57,6 @@ require (
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/modern-go/reflect2 v1.0.2 // indirect
 	github.com/pelletier/go-toml/v2 v2.1.0 // indirect
-	github.com/stretchr/testify v1.8.4 // indirect
 	github.com/twitchyliquid64/golang-asm v0.15.1 // indirect
 	github.com/ugorji/go/codec v1.2.11 // indirect
 	golang.org/x/arch v0.5.0 // indirect
@@ -0,0 +1,325 @@
+package grid
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/shamanec/GADS-devices-provider/config"
+)
+
+// Exception the Grid distributor handles by retrying the session request on another node
+const retrySessionRequestException = "org.openqa.selenium.RetrySessionRequestException"
+
+// Serve a Grid request sent to the node, path is relative to the node external URI
+func (n *Node) ServeHTTP(w http.ResponseWriter, r *http.Request, path string) {
+	if config.Config.EnvConfig.SeleniumGridSecret != "" && strings.HasPrefix(path, "/se/grid/") &&
+		r.Header.Get("X-REGISTRATION-SECRET") != config.Config.EnvConfig.SeleniumGridSecret {
+		writeW3CError(w, http.StatusUnauthorized, "unknown error", "Registration secret does not match")
+		return
+	}
+
+	switch {
+	case path == "/status" && r.Method == http.MethodGet:
+		n.handleStatus(w)
+	case path == "/readyz" && r.Method == http.MethodGet:
+		n.handleReady(w)
+	case path == "/se/grid/node/status" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, n.status())
+	case path == "/se/grid/node/drain" && r.Method == http.MethodPost:
+		n.handleDrain(w)
+	case path == "/se/grid/node/session" && r.Method == http.MethodPost:
+		n.handleNewSession(w, r)
+	case strings.HasPrefix(path, "/se/grid/node/owner/") && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"value": n.ownsSession(strings.TrimPrefix(path, "/se/grid/node/owner/"))})
+	case strings.HasPrefix(path, "/se/grid/node/connection/"):
+		// Websocket connections like CDP or BiDi are not supported by Appium relays
+		writeJSON(w, http.StatusOK, map[string]interface{}{"value": false})
+	case strings.HasPrefix(path, "/se/grid/node/session/") && r.Method == http.MethodGet:
+		n.handleGetSession(w, strings.TrimPrefix(path, "/se/grid/node/session/"))
+	case strings.HasPrefix(path, "/se/grid/node/session/") && r.Method == http.MethodDelete:
+		n.handleStopSession(w, strings.TrimPrefix(path, "/se/grid/node/session/"))
+	case strings.HasPrefix(path, "/session/"):
+		n.handleSessionCommand(w, r, path)
+	default:
+		writeW3CError(w, http.StatusNotFound, "unknown command", fmt.Sprintf("Unsupported Grid node command `%s %s`", r.Method, path))
+	}
+}
+
+func (n *Node) handleStatus(w http.ResponseWriter) {
+	status := n.status()
+	ready := status["availability"] == "UP"
+	message := "Ready"
+	if !ready {
+		message = fmt.Sprintf("Node is %s", status["availability"])
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"value": map[string]interface{}{
+			"ready":   ready,
+			"message": message,
+			"node":    status,
+		},
+	})
+}
+
+func (n *Node) handleReady(w http.ResponseWriter) {
+	if n.status()["availability"] != "UP" {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"value": map[string]interface{}{"ready": false}})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"value": map[string]interface{}{"ready": true}})
+}
+
+// Stop accepting new sessions, the running session is allowed to finish
+func (n *Node) handleDrain(w http.ResponseWriter) {
+	n.mu.Lock()
+	n.draining = true
+	n.mu.Unlock()
+
+	n.device.Logger.LogInfo("grid_node", fmt.Sprintf("Selenium Grid node `%s` is draining", n.ID))
+	go n.sendStatus()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"value": nil})
+}
+
+// Create an Appium session for a Grid `CreateSessionRequest`
+func (n *Node) handleNewSession(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		DesiredCapabilities map[string]interface{} `json:"desiredCapabilities"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		writeW3CError(w, http.StatusBadRequest, "invalid argument", fmt.Sprintf("Could not parse session request - %s", err))
+		return
+	}
+
+	n.mu.Lock()
+	if n.draining || n.session != nil || n.reserved {
+		n.mu.Unlock()
+		writeSessionException(w, retrySessionRequestException, "Node has no free slots")
+		return
+	}
+	n.reserved = true
+	n.mu.Unlock()
+
+	session, response, err := n.createAppiumSession(request.DesiredCapabilities)
+
+	n.mu.Lock()
+	n.reserved = false
+	if err == nil {
+		n.session = session
+		n.lastStarted = session.Start
+	}
+	n.mu.Unlock()
+
+	if err != nil {
+		n.device.Logger.LogError("grid_node", fmt.Sprintf("Could not create Selenium Grid session - %s", err))
+		writeSessionException(w, "org.openqa.selenium.SessionNotCreatedException", err.Error())
+		return
+	}
+
+	n.device.Logger.LogInfo("grid_node", fmt.Sprintf("Created Selenium Grid session `%s`", session.ID))
+	go n.sendStatus()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"value": map[string]interface{}{
+			"sessionResponse": map[string]interface{}{
+				"session":                   n.sessionJSON(session),
+				"downstreamEncodedResponse": base64.StdEncoding.EncodeToString(response),
+			},
+		},
+	})
+}
+
+// Create the session through the provider Appium proxy so capability policies and session tracking apply
+func (n *Node) createAppiumSession(capabilities map[string]interface{}) (*nodeSession, []byte, error) {
+	payload, err := json.Marshal(map[string]interface{}{
+		"capabilities": map[string]interface{}{
+			"alwaysMatch": capabilities,
+			"firstMatch":  []interface{}{map[string]interface{}{}},
+		},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := netClient.Post(n.providerAppiumURL("/session"), "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not send session request to Appium - %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not read Appium session response - %s", err)
+	}
+
+	var sessionResponse struct {
+		Value struct {
+			SessionID    string                 `json:"sessionId"`
+			Capabilities map[string]interface{} `json:"capabilities"`
+			Message      string                 `json:"message"`
+		} `json:"value"`
+	}
+	err = json.Unmarshal(body, &sessionResponse)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not parse Appium session response - %s", err)
+	}
+	if resp.StatusCode != http.StatusOK || sessionResponse.Value.SessionID == "" {
+		return nil, nil, fmt.Errorf("Appium returned status %v - %s", resp.StatusCode, sessionResponse.Value.Message)
+	}
+
+	now := time.Now()
+	return &nodeSession{
+		ID:           sessionResponse.Value.SessionID,
+		Capabilities: sessionResponse.Value.Capabilities,
+		Start:        now,
+		LastCommand:  now,
+	}, body, nil
+}
+
+func (n *Node) handleGetSession(w http.ResponseWriter, sessionID string) {
+	n.mu.Lock()
+	session := n.session
+	n.mu.Unlock()
+
+	if session == nil || session.ID != sessionID {
+		writeW3CError(w, http.StatusNotFound, "invalid session id", fmt.Sprintf("Session `%s` is not running on this node", sessionID))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"value": n.sessionJSON(session)})
+}
+
+func (n *Node) handleStopSession(w http.ResponseWriter, sessionID string) {
+	if !n.ownsSession(sessionID) {
+		writeW3CError(w, http.StatusNotFound, "invalid session id", fmt.Sprintf("Session `%s` is not running on this node", sessionID))
+		return
+	}
+
+	err := n.deleteAppiumSession(sessionID)
+	if err != nil {
+		n.device.Logger.LogWarn("grid_node", fmt.Sprintf("Could not delete Appium session `%s` - %s", sessionID, err))
+	}
+	n.endSession(sessionID)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"value": nil})
+}
+
+// Relay a WebDriver command of a running session to the device Appium server
+func (n *Node) handleSessionCommand(w http.ResponseWriter, r *http.Request, path string) {
+	sessionID := strings.SplitN(strings.TrimPrefix(path, "/session/"), "/", 2)[0]
+	if !n.touchSession(sessionID) {
+		writeW3CError(w, http.StatusNotFound, "invalid session id", fmt.Sprintf("Session `%s` is not running on this node", sessionID))
+		return
+	}
+
+	// Quitting goes through the provider so the device is released for other clients
+	if r.Method == http.MethodDelete && path == "/session/"+sessionID {
+		err := n.deleteAppiumSession(sessionID)
+		n.endSession(sessionID)
+		if err != nil {
+			writeW3CError(w, http.StatusInternalServerError, "unknown error", err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"value": nil})
+		return
+	}
+
+	target, _ := url.Parse("http://localhost:" + n.device.AppiumPort)
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			req.URL.Path = path
+			req.Host = target.Host
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+func (n *Node) deleteAppiumSession(sessionID string) error {
+	req, err := http.NewRequest(http.MethodDelete, n.providerAppiumURL("/session/"+sessionID), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := netClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("Appium returned status %v - %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// Free the node slot and report it to the distributor
+func (n *Node) endSession(sessionID string) {
+	n.mu.Lock()
+	if n.session != nil && n.session.ID == sessionID {
+		n.session = nil
+	}
+	n.mu.Unlock()
+
+	n.device.Logger.LogInfo("grid_node", fmt.Sprintf("Ended Selenium Grid session `%s`", sessionID))
+	go n.sendStatus()
+}
+
+func (n *Node) ownsSession(sessionID string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.session != nil && n.session.ID == sessionID
+}
+
+// Record a command for the session idle timeout, false if the session is not running on the node
+func (n *Node) touchSession(sessionID string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.session == nil || n.session.ID != sessionID {
+		return false
+	}
+	n.session.LastCommand = time.Now()
+	return true
+}
+
+func (n *Node) providerAppiumURL(path string) string {
+	return fmt.Sprintf("http://localhost:%v/device/%s/appium%s", config.Config.EnvConfig.Port, n.device.UDID, path)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeW3CError(w http.ResponseWriter, status int, errorCode, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"value": map[string]interface{}{
+			"error":      errorCode,
+			"message":    message,
+			"stacktrace": "",
+		},
+	})
+}
+
+// Failed session creation in the format the Grid `RemoteNode` expects
+func writeSessionException(w http.ResponseWriter, exception, message string) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"value": map[string]interface{}{
+			"exception": map[string]interface{}{
+				"error":   exception,
+				"message": message,
+			},
+		},
+	})
+}
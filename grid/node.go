@@ -0,0 +1,343 @@
+package grid
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shamanec/GADS-devices-provider/config"
+	"github.com/shamanec/GADS-devices-provider/models"
+)
+
+// Selenium Grid version the node protocol is implemented against
+const gridVersion = "4.13.0 (GADS relay node)"
+
+// How often the node status is sent to the Grid distributor
+const heartbeatPeriod = 30 * time.Second
+
+// Sessions without commands for this long are considered stale by the Grid
+const sessionTimeout = 300 * time.Second
+
+// Maximum time spent draining and removing a node when its device is reset
+const deregisterTimeout = 10 * time.Second
+
+// Time a new session has to show up as the device Appium session before the slot is freed for not matching it
+const sessionSyncGrace = 10 * time.Second
+
+// Time Appium is given to start before the node registers
+var registerDelay = 5 * time.Second
+
+var netClient = &http.Client{
+	Timeout: time.Second * 30,
+}
+
+// Relay nodes by device UDID
+var nodes = make(map[string]*Node)
+var nodesMu sync.Mutex
+
+// Selenium Grid 4 relay node for a single device
+// Sessions are relayed to the device Appium server through the provider
+type Node struct {
+	ID          string
+	SlotID      string
+	device      *models.Device
+	externalURI string
+	stereotype  models.GridStereotype
+	mu          sync.Mutex
+	session     *nodeSession
+	reserved    bool
+	lastStarted time.Time
+	draining    bool
+	cancel      context.CancelFunc
+	stopped     chan struct{}
+}
+
+type nodeSession struct {
+	ID           string
+	Capabilities map[string]interface{}
+	Start        time.Time
+	LastCommand  time.Time
+}
+
+// Start a relay node for the device and register it with the Selenium Grid
+func StartNode(device *models.Device) {
+	StopNode(device)
+
+	ctx, cancel := context.WithCancel(device.Context)
+	node := &Node{
+		ID:          newUUID(),
+		SlotID:      newUUID(),
+		device:      device,
+		externalURI: fmt.Sprintf("http://%s:%v/grid/node/%s", config.Config.EnvConfig.HostAddress, config.Config.EnvConfig.Port, device.UDID),
+		stereotype:  nodeStereotype(device),
+		cancel:      cancel,
+		stopped:     make(chan struct{}),
+	}
+
+	nodesMu.Lock()
+	nodes[device.UDID] = node
+	nodesMu.Unlock()
+
+	go node.heartbeat(ctx)
+}
+
+// Drain the relay node of the device and remove it from the Selenium Grid
+// Must be called before the device context is cancelled so the Grid stops routing sessions to it
+func StopNode(device *models.Device) {
+	nodesMu.Lock()
+	node, ok := nodes[device.UDID]
+	delete(nodes, device.UDID)
+	nodesMu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	node.mu.Lock()
+	node.draining = true
+	node.mu.Unlock()
+	// Wait for the heartbeat to stop so it can't report the node as up after it is drained
+	node.cancel()
+	<-node.stopped
+
+	// Don't hold up the device reset for long if the Grid is unreachable
+	ctx, cancel := context.WithTimeout(context.Background(), deregisterTimeout)
+	defer cancel()
+
+	err := distributorRequest(ctx, http.MethodPost, fmt.Sprintf("/se/grid/distributor/node/%s/drain", node.ID), nil)
+	if err != nil {
+		device.Logger.LogWarn("grid_node", fmt.Sprintf("Could not drain Selenium Grid node `%s` - %s", node.ID, err))
+	}
+
+	err = distributorRequest(ctx, http.MethodDelete, fmt.Sprintf("/se/grid/distributor/node/%s", node.ID), nil)
+	if err != nil {
+		device.Logger.LogWarn("grid_node", fmt.Sprintf("Could not remove Selenium Grid node `%s` - %s", node.ID, err))
+		return
+	}
+
+	device.Logger.LogInfo("grid_node", fmt.Sprintf("Removed Selenium Grid node `%s`", node.ID))
+}
+
+// Get the relay node of a device
+func GetNode(udid string) (*Node, bool) {
+	nodesMu.Lock()
+	defer nodesMu.Unlock()
+
+	node, ok := nodes[udid]
+	return node, ok
+}
+
+// Register the node and keep sending its status to the distributor until the context is cancelled
+// Re-sending the status re-registers the node if the Grid was restarted
+func (n *Node) heartbeat(ctx context.Context) {
+	defer close(n.stopped)
+
+	// Give Appium some time to start before accepting sessions
+	select {
+	case <-time.After(registerDelay):
+	case <-ctx.Done():
+		return
+	}
+
+	registered := false
+	ticker := time.NewTicker(heartbeatPeriod)
+	defer ticker.Stop()
+
+	for {
+		n.expireSession()
+		err := n.sendStatusContext(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			n.device.Logger.LogError("grid_node", fmt.Sprintf("Could not send node status to Selenium Grid at `%s` - %s", config.Config.EnvConfig.SeleniumGrid, err))
+			registered = false
+		} else if !registered {
+			n.device.Logger.LogInfo("grid_node", fmt.Sprintf("Registered Selenium Grid node `%s` with `%s`", n.ID, config.Config.EnvConfig.SeleniumGrid))
+			registered = true
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Free the slot if its session is idle for longer than the session timeout or is no longer the device Appium session
+// Appium can end sessions on its own on newCommandTimeout or a crash, and clients can disappear without deleting them
+func (n *Node) expireSession() {
+	n.mu.Lock()
+	session := n.session
+	if session == nil {
+		n.mu.Unlock()
+		return
+	}
+
+	reason := ""
+	if time.Since(session.LastCommand) > sessionTimeout {
+		reason = fmt.Sprintf("it was idle for more than %v", sessionTimeout)
+	} else if time.Since(session.Start) > sessionSyncGrace && n.device.AppiumSessionID != session.ID {
+		reason = "it is no longer the device Appium session"
+	}
+	if reason == "" {
+		n.mu.Unlock()
+		return
+	}
+	n.session = nil
+	n.mu.Unlock()
+
+	n.device.Logger.LogInfo("grid_node", fmt.Sprintf("Freeing Selenium Grid session `%s` because %s", session.ID, reason))
+
+	// The session might still be running in Appium if only the client disappeared
+	if n.device.AppiumSessionID == session.ID {
+		err := n.deleteAppiumSession(session.ID)
+		if err != nil {
+			n.device.Logger.LogWarn("grid_node", fmt.Sprintf("Could not delete expired Appium session `%s` - %s", session.ID, err))
+		}
+	}
+}
+
+// Send the current node status to the distributor, this also registers the node if it is unknown
+func (n *Node) sendStatus() error {
+	return n.sendStatusContext(context.Background())
+}
+
+func (n *Node) sendStatusContext(ctx context.Context) error {
+	statusJSON, err := json.Marshal(n.status())
+	if err != nil {
+		return err
+	}
+	return distributorRequest(ctx, http.MethodPost, "/se/grid/distributor/node", statusJSON)
+}
+
+// Node status in the Grid `NodeStatus` JSON format
+func (n *Node) status() map[string]interface{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	availability := "UP"
+	if n.draining {
+		availability = "DRAINING"
+	} else if n.device.ProviderState != "live" {
+		availability = "DOWN"
+	}
+
+	var session interface{}
+	if n.session != nil {
+		session = n.sessionJSON(n.session)
+	}
+
+	return map[string]interface{}{
+		"nodeId":      n.ID,
+		"externalUri": n.externalURI,
+		"maxSessions": 1,
+		"slots": []map[string]interface{}{
+			{
+				"id": map[string]interface{}{
+					"hostId": n.ID,
+					"id":     n.SlotID,
+				},
+				"lastStarted": gridTime(n.lastStarted),
+				"session":     session,
+				"stereotype":  n.stereotype,
+			},
+		},
+		"availability":    availability,
+		"heartbeatPeriod": heartbeatPeriod.Milliseconds(),
+		"sessionTimeout":  sessionTimeout.Milliseconds(),
+		"version":         gridVersion,
+		"osInfo": map[string]interface{}{
+			"arch":    runtime.GOARCH,
+			"name":    config.Config.EnvConfig.OS,
+			"version": "",
+		},
+	}
+}
+
+// Session in the Grid `Session` JSON format
+func (n *Node) sessionJSON(session *nodeSession) map[string]interface{} {
+	return map[string]interface{}{
+		"sessionId":    session.ID,
+		"stereotype":   n.stereotype,
+		"capabilities": session.Capabilities,
+		"start":        gridTime(session.Start),
+		"uri":          n.externalURI,
+	}
+}
+
+// Capabilities advertised by the node slot
+func nodeStereotype(device *models.Device) models.GridStereotype {
+	automationName := "UiAutomator2"
+	if device.OS == "ios" {
+		automationName = "XCUITest"
+	}
+
+	labels := device.Labels
+	if labels == nil {
+		labels = []string{}
+	}
+
+	return models.GridStereotype{
+		PlatformName:         device.OS,
+		DeviceName:           device.Name,
+		PlatformVersion:      device.OSVersion,
+		AutomationName:       automationName,
+		UDID:                 device.UDID,
+		Model:                device.Model,
+		ScreenSize:           fmt.Sprintf("%sx%s", device.ScreenWidth, device.ScreenHeight),
+		PlatformMajorVersion: strings.Split(device.OSVersion, ".")[0],
+		Labels:               labels,
+	}
+}
+
+// Send a request to the Selenium Grid distributor with the registration secret, if configured
+func distributorRequest(ctx context.Context, method, path string, body []byte) error {
+	url := strings.TrimSuffix(config.Config.EnvConfig.SeleniumGrid, "/") + path
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if config.Config.EnvConfig.SeleniumGridSecret != "" {
+		req.Header.Set("X-REGISTRATION-SECRET", config.Config.EnvConfig.SeleniumGridSecret)
+	}
+
+	resp, err := netClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("`%s %s` returned status %v - %s", method, path, resp.StatusCode, string(respBody))
+	}
+	return nil
+}
+
+// Time in the ISO-8601 format the Grid uses for Instant values
+func gridTime(t time.Time) string {
+	if t.IsZero() {
+		t = time.Unix(0, 0)
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// Random version 4 UUID, the Grid requires node and slot IDs to be UUIDs
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,276 @@
+package grid
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shamanec/GADS-devices-provider/config"
+	"github.com/shamanec/GADS-devices-provider/models"
+)
+
+type testLogger struct{}
+
+func (testLogger) LogDebug(eventName string, message string) {}
+func (testLogger) LogInfo(eventName string, message string)  {}
+func (testLogger) LogError(eventName string, message string) {}
+func (testLogger) LogWarn(eventName string, message string)  {}
+func (testLogger) LogFatal(eventName string, message string) {}
+func (testLogger) LogPanic(eventName string, message string) {}
+
+type recordedRequest struct {
+	method string
+	path   string
+	body   []byte
+}
+
+// Start a server that records the requests it receives and answers them with respond
+func newRecordingServer(t *testing.T, respond func(w http.ResponseWriter, r *http.Request)) (*httptest.Server, chan recordedRequest) {
+	requests := make(chan recordedRequest, 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- recordedRequest{method: r.Method, path: r.URL.Path, body: body}
+		if respond != nil {
+			respond(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+// Wait for a request with the method and path, skipping any other requests
+func waitForRequest(t *testing.T, requests chan recordedRequest, method, path string) recordedRequest {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case request := <-requests:
+			if request.method == method && request.path == path {
+				return request
+			}
+		case <-timeout:
+			t.Fatalf("Did not receive `%s %s`", method, path)
+		}
+	}
+}
+
+// Set up a mock Grid distributor and a mock provider Appium proxy for a test device
+func setupTestGrid(t *testing.T) (*models.Device, chan recordedRequest, chan recordedRequest) {
+	distributor, distributorRequests := newRecordingServer(t, nil)
+
+	sessionCount := 0
+	provider, providerRequests := newRecordingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/appium/session") {
+			sessionCount++
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"value": map[string]interface{}{
+					"sessionId":    "session-" + strconv.Itoa(sessionCount),
+					"capabilities": map[string]interface{}{"platformName": "android"},
+				},
+			})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"value": nil})
+	})
+
+	providerURL, _ := url.Parse(provider.URL)
+	port, _ := strconv.Atoi(providerURL.Port())
+
+	previousConfig := config.Config.EnvConfig
+	previousDelay := registerDelay
+	config.Config.EnvConfig = models.ProviderDB{
+		SeleniumGrid: distributor.URL,
+		HostAddress:  "localhost",
+		Port:         port,
+	}
+	registerDelay = 0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		config.Config.EnvConfig = previousConfig
+		registerDelay = previousDelay
+	})
+
+	device := &models.Device{
+		UDID:          "test-udid",
+		OS:            "android",
+		Name:          "Pixel",
+		OSVersion:     "14",
+		ProviderState: "live",
+		Context:       ctx,
+		Logger:        testLogger{},
+	}
+	return device, distributorRequests, providerRequests
+}
+
+// Send a request to the node and decode its JSON response
+func serveNode(t *testing.T, node *Node, method, path, body string) map[string]interface{} {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	node.ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)), path)
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Could not parse node response `%s` - %s", recorder.Body.String(), err)
+	}
+	return response
+}
+
+func sessionExceptionError(response map[string]interface{}) string {
+	value, _ := response["value"].(map[string]interface{})
+	exception, _ := value["exception"].(map[string]interface{})
+	errorName, _ := exception["error"].(string)
+	return errorName
+}
+
+func TestNodeRegistersAndDrainsOnStop(t *testing.T) {
+	device, distributorRequests, _ := setupTestGrid(t)
+
+	StartNode(device)
+	node, ok := GetNode(device.UDID)
+	if !ok {
+		t.Fatal("Node was not added for the device")
+	}
+
+	request := waitForRequest(t, distributorRequests, http.MethodPost, "/se/grid/distributor/node")
+	var status map[string]interface{}
+	if err := json.Unmarshal(request.body, &status); err != nil {
+		t.Fatalf("Could not parse node status - %s", err)
+	}
+	if status["nodeId"] != node.ID {
+		t.Errorf("Registered node ID is `%v`, expected `%s`", status["nodeId"], node.ID)
+	}
+	if status["availability"] != "UP" {
+		t.Errorf("Registered node availability is `%v`, expected `UP`", status["availability"])
+	}
+
+	StopNode(device)
+	waitForRequest(t, distributorRequests, http.MethodPost, "/se/grid/distributor/node/"+node.ID+"/drain")
+	waitForRequest(t, distributorRequests, http.MethodDelete, "/se/grid/distributor/node/"+node.ID)
+
+	if _, ok := GetNode(device.UDID); ok {
+		t.Error("Node was not removed after stopping")
+	}
+}
+
+func TestNodeCreatesAndDeletesSession(t *testing.T) {
+	device, distributorRequests, providerRequests := setupTestGrid(t)
+	node := &Node{ID: newUUID(), SlotID: newUUID(), device: device, stereotype: nodeStereotype(device)}
+
+	response := serveNode(t, node, http.MethodPost, "/se/grid/node/session", `{"desiredCapabilities":{"platformName":"android"}}`)
+	waitForRequest(t, providerRequests, http.MethodPost, "/device/test-udid/appium/session")
+	value, _ := response["value"].(map[string]interface{})
+	sessionResponse, _ := value["sessionResponse"].(map[string]interface{})
+	session, _ := sessionResponse["session"].(map[string]interface{})
+	if session["sessionId"] != "session-1" {
+		t.Fatalf("Created session is `%v`, expected `session-1`", session["sessionId"])
+	}
+	if !node.ownsSession("session-1") {
+		t.Fatal("Node does not own the created session")
+	}
+	// The busy slot is reported to the distributor right away
+	request := waitForRequest(t, distributorRequests, http.MethodPost, "/se/grid/distributor/node")
+	if !strings.Contains(string(request.body), `"sessionId":"session-1"`) {
+		t.Errorf("Node status after creating the session is `%s`, expected the session in the slot", string(request.body))
+	}
+
+	// The single slot is taken so the distributor has to retry elsewhere
+	response = serveNode(t, node, http.MethodPost, "/se/grid/node/session", `{"desiredCapabilities":{}}`)
+	if sessionExceptionError(response) != retrySessionRequestException {
+		t.Errorf("Second session request returned `%v`, expected a retry exception", response)
+	}
+
+	serveNode(t, node, http.MethodDelete, "/session/session-1", "")
+	waitForRequest(t, providerRequests, http.MethodDelete, "/device/test-udid/appium/session/session-1")
+	if node.ownsSession("session-1") {
+		t.Error("Session slot was not freed after deleting the session")
+	}
+	request = waitForRequest(t, distributorRequests, http.MethodPost, "/se/grid/distributor/node")
+	if !strings.Contains(string(request.body), `"session":null`) {
+		t.Errorf("Node status after deleting the session is `%s`, expected a free slot", string(request.body))
+	}
+}
+
+func TestDrainingNodeRejectsSessions(t *testing.T) {
+	device, distributorRequests, _ := setupTestGrid(t)
+	node := &Node{ID: newUUID(), SlotID: newUUID(), device: device, stereotype: nodeStereotype(device)}
+
+	serveNode(t, node, http.MethodPost, "/se/grid/node/drain", "")
+	request := waitForRequest(t, distributorRequests, http.MethodPost, "/se/grid/distributor/node")
+	if !strings.Contains(string(request.body), `"availability":"DRAINING"`) {
+		t.Errorf("Node status after draining is `%s`, expected DRAINING availability", string(request.body))
+	}
+
+	response := serveNode(t, node, http.MethodPost, "/se/grid/node/session", `{"desiredCapabilities":{}}`)
+	if sessionExceptionError(response) != retrySessionRequestException {
+		t.Errorf("Session request on draining node returned `%v`, expected a retry exception", response)
+	}
+}
+
+func TestNodeExpiresIdleSession(t *testing.T) {
+	device, _, providerRequests := setupTestGrid(t)
+	node := &Node{ID: newUUID(), SlotID: newUUID(), device: device, stereotype: nodeStereotype(device)}
+
+	device.AppiumSessionID = "idle"
+	node.session = &nodeSession{
+		ID:          "idle",
+		Start:       time.Now().Add(-2 * sessionTimeout),
+		LastCommand: time.Now().Add(-sessionTimeout - time.Second),
+	}
+
+	node.expireSession()
+	if node.session != nil {
+		t.Fatal("Idle session was not expired")
+	}
+	// The session is still the Appium session so it is deleted as well
+	waitForRequest(t, providerRequests, http.MethodDelete, "/device/test-udid/appium/session/idle")
+}
+
+func TestNodeExpiresSessionEndedByAppium(t *testing.T) {
+	device, _, _ := setupTestGrid(t)
+	node := &Node{ID: newUUID(), SlotID: newUUID(), device: device, stereotype: nodeStereotype(device)}
+
+	// Fresh sessions get a grace period to show up as the device Appium session
+	node.session = &nodeSession{ID: "ended", Start: time.Now(), LastCommand: time.Now()}
+	node.expireSession()
+	if node.session == nil {
+		t.Fatal("New session was expired during the grace period")
+	}
+
+	node.session.Start = time.Now().Add(-2 * sessionSyncGrace)
+	device.AppiumSessionID = "other"
+	node.expireSession()
+	if node.session != nil {
+		t.Fatal("Session that is no longer the device Appium session was not expired")
+	}
+}
+
+func TestSessionCommandsKeepSessionAlive(t *testing.T) {
+	device, _, _ := setupTestGrid(t)
+	node := &Node{ID: newUUID(), SlotID: newUUID(), device: device, stereotype: nodeStereotype(device)}
+
+	device.AppiumSessionID = "active"
+	node.session = &nodeSession{
+		ID:          "active",
+		Start:       time.Now().Add(-2 * sessionTimeout),
+		LastCommand: time.Now().Add(-sessionTimeout - time.Second),
+	}
+
+	if !node.touchSession("active") {
+		t.Fatal("Node does not own the active session")
+	}
+	node.expireSession()
+	if node.session == nil {
+		t.Fatal("Session with a recent command was expired")
+	}
+}
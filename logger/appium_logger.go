@@ -8,6 +8,7 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/shamanec/GADS-devices-provider/db"
@@ -18,6 +19,8 @@ import (
 type AppiumLogger struct {
 	localFile       *os.File
 	mongoCollection *mongo.Collection
+	subscribers     map[chan models.AppiumLog]bool
+	subscribersMu   sync.Mutex
 }
 
 func NewAppiumLogger(logFilePath, udid string) (*AppiumLogger, error) {
@@ -31,6 +34,7 @@ func NewAppiumLogger(logFilePath, udid string) (*AppiumLogger, error) {
 	return &AppiumLogger{
 		localFile:       file,
 		mongoCollection: collection,
+		subscribers:     make(map[chan models.AppiumLog]bool),
 	}, nil
 }
 
@@ -103,6 +107,45 @@ func (logger *AppiumLogger) Log(device *models.Device, logLine string) {
 	if err != nil {
 		fmt.Printf("Failed writing Appium log to Mongo - %s\n", err)
 	}
+
+	// Send to live tail subscribers
+	logger.broadcast(logData)
+}
+
+// Subscribe to receive Appium log lines as they are logged
+func (logger *AppiumLogger) Subscribe() chan models.AppiumLog {
+	subscriber := make(chan models.AppiumLog, 100)
+
+	logger.subscribersMu.Lock()
+	logger.subscribers[subscriber] = true
+	logger.subscribersMu.Unlock()
+
+	return subscriber
+}
+
+// Stop sending Appium log lines to a subscriber and close its channel
+func (logger *AppiumLogger) Unsubscribe(subscriber chan models.AppiumLog) {
+	logger.subscribersMu.Lock()
+	defer logger.subscribersMu.Unlock()
+
+	if _, ok := logger.subscribers[subscriber]; ok {
+		delete(logger.subscribers, subscriber)
+		close(subscriber)
+	}
+}
+
+// Send a log line to all subscribers
+// Slow subscribers will miss lines instead of blocking Appium log processing
+func (logger *AppiumLogger) broadcast(logData models.AppiumLog) {
+	logger.subscribersMu.Lock()
+	defer logger.subscribersMu.Unlock()
+
+	for subscriber := range logger.subscribers {
+		select {
+		case subscriber <- logData:
+		default:
+		}
+	}
 }
 
 func appiumLogToFile(logger *AppiumLogger, logData models.AppiumLog) error {
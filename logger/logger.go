@@ -77,7 +77,8 @@ func (l CustomLogger) LogPanic(eventName string, message string) {
 func CreateCustomLogger(logFilePath, collection string) (*CustomLogger, error) {
 	// Create a new logger instance
 	logger := log.New()
-	ctx, _ := context.WithCancel(db.MongoCtx())
+	// The hook uses the Mongo client context directly, a derived context whose cancel is never called would only leak
+	ctx := db.MongoCtx()
 
 	// Configure the logger
 	logger.SetFormatter(&log.JSONFormatter{})
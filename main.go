@@ -7,7 +7,6 @@ import (
 	"github.com/shamanec/GADS-devices-provider/util"
 	"log"
 	"os"
-	"path/filepath"
 	"runtime"
 	"sort"
 	"strings"
@@ -106,11 +105,6 @@ func main() {
 	// Try to remove potentially hanging ports forwarded by adb
 	util.RemoveAdbForwardedPorts()
 
-	// Finalize grid configuration if Selenium Grid usage enabled
-	if config.Config.EnvConfig.UseSeleniumGrid {
-		configureSeleniumSettings()
-	}
-
 	// Start a goroutine that will start updating devices on provider start
 	go devices.Listener()
 
@@ -171,28 +165,6 @@ func parseFlags() (string, string, string, string) {
 	return *logLevel, *nickname, *mongoDb, *providerFolder
 }
 
-// Check for and set up selenium jar file for creating Appium grid nodes in config
-func configureSeleniumSettings() {
-	seleniumJarFile := ""
-	err := filepath.Walk(fmt.Sprintf("%s/conf", config.Config.EnvConfig.ProviderFolder), func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() && strings.Contains(info.Name(), "selenium") && filepath.Ext(path) == ".jar" {
-			seleniumJarFile = info.Name()
-			return nil
-		}
-		return nil
-	})
-	if err != nil {
-		return
-	}
-	if seleniumJarFile == "" {
-		log.Fatalf("You have enabled Selenium Grid connection but no selenium jar file was found in the `conf` folder in `%s`", config.Config.EnvConfig.ProviderFolder)
-	}
-	config.Config.EnvConfig.SeleniumJarFile = seleniumJarFile
-}
-
 // Check for and set up WebDriverAgent.ipa/app binary in config
 func configureWebDriverBinary(providerFolder string) error {
 	// Check for WDA ipa, then WDA app availability
@@ -0,0 +1,24 @@
+package models
+
+// Metadata of an app file in the provider `apps` folder, stored in a `<file>.json` next to it
+// Identifier is the Android package or the iOS bundle ID
+// VersionCode is the Android versionCode or the iOS CFBundleVersion, VersionName is the Android versionName or the iOS CFBundleShortVersionString
+// MinOSVersion is the Android minSdkVersion or the iOS MinimumOSVersion
+type AppMetadata struct {
+	FileName      string   `json:"file_name"`
+	Platform      string   `json:"platform"`
+	Identifier    string   `json:"identifier"`
+	Name          string   `json:"name"`
+	VersionName   string   `json:"version_name"`
+	VersionCode   string   `json:"version_code"`
+	MinOSVersion  string   `json:"min_os_version"`
+	ABIs          []string `json:"abis,omitempty"`
+	Size          int64    `json:"size"`
+	SHA256        string   `json:"sha256"`
+	UploadedAt    int64    `json:"uploaded_at"`
+	MetadataError string   `json:"metadata_error,omitempty"`
+}
+
+type AppsQuery struct {
+	Platform string `form:"platform"`
+}
@@ -1,6 +1,24 @@
 package models
 
+import (
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// How the coordinates in a request are interpreted before they are sent to the device
+// `device` (default) - Appium coordinates, pixels on Android and points on iOS
+// `normalized` - 0..1 fractions of the screen in its current orientation
+// `stream` - pixels of a stream frame with size StreamWidth x StreamHeight
+// `pixels` - physical screen pixels in the current orientation
+type CoordinateSpaceData struct {
+	CoordinateSpace string  `json:"coordinate_space,omitempty" form:"coordinate_space"`
+	StreamWidth     float64 `json:"stream_width,omitempty" form:"stream_width"`
+	StreamHeight    float64 `json:"stream_height,omitempty" form:"stream_height"`
+}
+
 type ActionData struct {
+	CoordinateSpaceData
 	X          float64 `json:"x,omitempty"`
 	Y          float64 `json:"y,omitempty"`
 	EndX       float64 `json:"endX,omitempty"`
@@ -32,6 +50,60 @@ type DevicePointerActions struct {
 	Actions []DevicePointerAction `json:"actions"`
 }
 
+// Action of a gesture pointer, X and Y are pointers so moves to a 0 coordinate are not omitted
+type GestureAction struct {
+	Type     string   `json:"type"`
+	Duration int      `json:"duration"`
+	X        *float64 `json:"x,omitempty"`
+	Y        *float64 `json:"y,omitempty"`
+	Button   int      `json:"button"`
+	Origin   string   `json:"origin,omitempty"`
+}
+
+type GesturePointerAction struct {
+	Type       string                 `json:"type"`
+	ID         string                 `json:"id"`
+	Parameters DeviceActionParameters `json:"parameters"`
+	Actions    []GestureAction        `json:"actions"`
+}
+
+type GesturePointerActions struct {
+	Actions []GesturePointerAction `json:"actions"`
+}
+
+// Point on the path of a gesture pointer, Duration is the time in ms to move to it from the previous point
+type GesturePoint struct {
+	X        float64 `json:"x"`
+	Y        float64 `json:"y"`
+	Duration int     `json:"duration"`
+}
+
+// Paths of the pointers in an n-finger gesture, each pointer touches down on its first point and lifts after its last
+type GestureData struct {
+	CoordinateSpaceData
+	Pointers [][]GesturePoint `json:"pointers"`
+}
+
+// Two finger pinch or zoom around a center point, Angle is the angle of the line between the fingers in degrees
+type PinchGestureData struct {
+	CoordinateSpaceData
+	X        float64 `json:"x"`
+	Y        float64 `json:"y"`
+	Distance float64 `json:"distance"`
+	Angle    float64 `json:"angle"`
+	Duration int     `json:"duration"`
+}
+
+// Two finger rotation around a center point, positive Rotation degrees rotate clockwise
+type RotateGestureData struct {
+	CoordinateSpaceData
+	X        float64 `json:"x"`
+	Y        float64 `json:"y"`
+	Radius   float64 `json:"radius"`
+	Rotation float64 `json:"rotation"`
+	Duration int     `json:"duration"`
+}
+
 type ActiveElementData struct {
 	Value struct {
 		Element string `json:"ELEMENT"`
@@ -42,10 +114,166 @@ type AppiumTypeText struct {
 	Text string `json:"text"`
 }
 
+// Text to type on the device, Keys are special keys pressed after the text
+// Strategy is one of `element_value`, `key_actions`, `wda_keys`, `adb` or empty to choose automatically
+type TextInputData struct {
+	Text     string   `json:"text"`
+	Keys     []string `json:"keys"`
+	Strategy string   `json:"strategy"`
+}
+
+// Strategy used to type text and the errors of strategies that were tried before it
+type TextInputResponse struct {
+	Strategy         string            `json:"strategy"`
+	FailedStrategies map[string]string `json:"failed_strategies,omitempty"`
+}
+
+type KeyAction struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type KeyActionSequence struct {
+	Type    string      `json:"type"`
+	ID      string      `json:"id"`
+	Actions []KeyAction `json:"actions"`
+}
+
+type KeyActions struct {
+	Actions []KeyActionSequence `json:"actions"`
+}
+
 type AndroidKeycodePayload struct {
 	Keycode int `json:"keycode"`
 }
 
+type DeviceOrientation struct {
+	Orientation string `json:"orientation"`
+}
+
+// Clipboard text, Content is the base64 encoded text and takes precedence over Text when setting
+type DeviceClipboard struct {
+	Text    string `json:"text"`
+	Content string `json:"content"`
+}
+
+type DeviceGeolocation struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Altitude  float64 `json:"altitude"`
+}
+
+// App the lifecycle action applies to, bundle ID on iOS or package name on Android
+// URL is only used when opening deep links and universal links
+type AppLifecycleData struct {
+	App string `json:"app"`
+	URL string `json:"url"`
+}
+
+type AppStateResponse struct {
+	App   string `json:"app"`
+	State string `json:"state"`
+}
+
+// App states reported consistently across platforms
+const (
+	AppStateNotInstalled        = "not_installed"
+	AppStateNotRunning          = "not_running"
+	AppStateBackgroundSuspended = "background_suspended"
+	AppStateBackground          = "background"
+	AppStateForeground          = "foreground"
+)
+
+// App states in the order of the Appium `queryAppState` values
+var AppiumAppStates = []string{
+	AppStateNotInstalled,
+	AppStateNotRunning,
+	AppStateBackgroundSuspended,
+	AppStateBackground,
+	AppStateForeground,
+}
+
+// Input message sent over the remote-control websocket
+// Type is one of `tap`, `touch_and_hold`, `swipe`, `key`, `text` or `gesture`, only the fields for the type are used
+type ControlMessage struct {
+	CoordinateSpaceData
+	ID       string           `json:"id"`
+	Type     string           `json:"type"`
+	X        float64          `json:"x"`
+	Y        float64          `json:"y"`
+	EndX     float64          `json:"endX"`
+	EndY     float64          `json:"endY"`
+	Key      string           `json:"key"`
+	Text     string           `json:"text"`
+	Pointers [][]GesturePoint `json:"pointers"`
+	// Client timestamp in ms, echoed back so the client can measure the round trip
+	SentAt int64 `json:"sent_at"`
+}
+
+// Acknowledgement for a remote-control message
+// Status is `ok`, `error` or `dropped` when a newer move replaced the message before it was performed
+type ControlAck struct {
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	Status     string `json:"status"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+	SentAt     int64  `json:"sent_at,omitempty"`
+	QueueMs    int64  `json:"queue_ms"`
+	ExecMs     int64  `json:"exec_ms"`
+	LatencyMs  int64  `json:"latency_ms"`
+}
+
+// Options for the binary screenshot, Crop is `x,y,width,height` in screenshot pixels and is applied before scaling
+type ScreenshotQuery struct {
+	Format  string  `form:"format"`
+	Quality int     `form:"quality"`
+	Scale   float64 `form:"scale"`
+	Crop    string  `form:"crop"`
+}
+
+type UIBounds struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// Element of the UI hierarchy normalized across UiAutomator2 and XCUITest
+// ID is the Android resource-id, AccessibilityID is the content-desc on Android and the name on iOS
+type UIElement struct {
+	Class           string       `json:"class"`
+	Text            string       `json:"text,omitempty"`
+	ID              string       `json:"id,omitempty"`
+	AccessibilityID string       `json:"accessibility_id,omitempty"`
+	Bounds          UIBounds     `json:"bounds"`
+	Visible         bool         `json:"visible"`
+	Enabled         bool         `json:"enabled"`
+	XPath           string       `json:"xpath"`
+	Children        []*UIElement `json:"children,omitempty"`
+}
+
+type UILocator struct {
+	Strategy string `json:"strategy"`
+	Value    string `json:"value"`
+	Unique   bool   `json:"unique"`
+}
+
+type ElementAtQuery struct {
+	CoordinateSpaceData
+	X float64 `form:"x"`
+	Y float64 `form:"y"`
+}
+
+type ElementAtResponse struct {
+	Element  *UIElement  `json:"element"`
+	Locators []UILocator `json:"locators"`
+}
+
+type DeviceKeyData struct {
+	Key string `json:"key"`
+}
+
 type AppiumLog struct {
 	SystemTS  int64  `json:"ts" bson:"ts"`
 	Message   string `json:"msg" bson:"msg"`
@@ -54,6 +282,28 @@ type AppiumLog struct {
 	SessionID string `json:"session_id" bson:"session_id"`
 }
 
+// Appium log as stored in the device `appium_logs` collection, with its document ID used as pagination cursor
+type AppiumLogEntry struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id"`
+	AppiumLog `bson:",inline"`
+}
+
+// Filters for querying and live tailing Appium logs
+type AppiumLogsQuery struct {
+	SessionID string `form:"session_id"`
+	LogType   string `form:"log_type"`
+	From      int64  `form:"from"`
+	To        int64  `form:"to"`
+	Text      string `form:"text"`
+	Cursor    string `form:"cursor"`
+	Limit     int64  `form:"limit"`
+}
+
+type AppiumLogsResponse struct {
+	Logs       []AppiumLogEntry `json:"logs"`
+	NextCursor string           `json:"next_cursor"`
+}
+
 type AppiumServerCapabilities struct {
 	UDID                  string `json:"appium:udid"`
 	WdaMjpegPort          string `json:"appium:mjpegServerPort,omitempty"`
@@ -70,22 +320,22 @@ type AppiumServerCapabilities struct {
 	WdaConnectionTimeout  string `json:"appium:wdaConnectionTimeout,omitempty"`
 }
 
-type AppiumTomlNode struct {
-	DetectDrivers bool `toml:"detect-drivers"`
-}
-
-type AppiumTomlServer struct {
-	Port int `toml:"port"`
-}
-
-type AppiumTomlRelay struct {
-	URL            string   `toml:"url"`
-	StatusEndpoint string   `toml:"status-endpoint"`
-	Configs        []string `toml:"configs"`
-}
-
-type AppiumTomlConfig struct {
-	Server AppiumTomlServer `toml:"server"`
-	Node   AppiumTomlNode   `toml:"node"`
-	Relay  AppiumTomlRelay  `toml:"relay"`
+// Check if an Appium log line passes the non-paginating query filters, used for live tailing
+func (q AppiumLogsQuery) Matches(log AppiumLog) bool {
+	if q.SessionID != "" && log.SessionID != q.SessionID {
+		return false
+	}
+	if q.LogType != "" && log.Type != q.LogType {
+		return false
+	}
+	if q.From != 0 && log.SystemTS < q.From {
+		return false
+	}
+	if q.To != 0 && log.SystemTS > q.To {
+		return false
+	}
+	if q.Text != "" && !strings.Contains(strings.ToLower(log.Message), strings.ToLower(q.Text)) {
+		return false
+	}
+	return true
 }
@@ -5,24 +5,40 @@ type ConfigJsonData struct {
 }
 
 type ProviderDB struct {
-	OS                   string `json:"os" bson:"os"`
-	Nickname             string `json:"nickname" bson:"nickname"`
-	HostAddress          string `json:"host_address" bson:"host_address"`
-	Port                 int    `json:"port" bson:"port"`
-	UseSeleniumGrid      bool   `json:"use_selenium_grid" bson:"use_selenium_grid"`
-	SeleniumGrid         string `json:"selenium_grid" bson:"selenium_grid"`
-	ProvideAndroid       bool   `json:"provide_android" bson:"provide_android"`
-	ProvideIOS           bool   `json:"provide_ios" bson:"provide_ios"`
-	WdaBundleID          string `json:"wda_bundle_id" bson:"wda_bundle_id"`
-	SupervisionPassword  string `json:"supervision_password" bson:"supervision_password"`
-	WdaRepoPath          string `json:"wda_repo_path" bson:"wda_repo_path"`
-	ProviderFolder       string `json:"-" bson:"-"`
-	LastUpdatedTimestamp int64  `json:"last_updated" bson:"last_updated"`
-	ProvidedDevices      int    `json:"provided_devices_count" bson:"provided_devices_count"`
-	WebDriverBinary      string `json:"-" bson:"-"`
-	SeleniumJarFile      string `json:"-" bson:"-"`
-	UseGadsIosStream     bool   `json:"use_gads_ios_stream" bson:"use_gads_ios_stream"`
-	UseCustomWDA         bool   `json:"use_custom_wda" bson:"use_custom_wda"`
+	OS                    string                 `json:"os" bson:"os"`
+	Nickname              string                 `json:"nickname" bson:"nickname"`
+	HostAddress           string                 `json:"host_address" bson:"host_address"`
+	Port                  int                    `json:"port" bson:"port"`
+	UseSeleniumGrid       bool                   `json:"use_selenium_grid" bson:"use_selenium_grid"`
+	SeleniumGrid          string                 `json:"selenium_grid" bson:"selenium_grid"`
+	SeleniumGridSecret    string                 `json:"selenium_grid_registration_secret" bson:"selenium_grid_registration_secret"`
+	ProvideAndroid        bool                   `json:"provide_android" bson:"provide_android"`
+	ProvideIOS            bool                   `json:"provide_ios" bson:"provide_ios"`
+	WdaBundleID           string                 `json:"wda_bundle_id" bson:"wda_bundle_id"`
+	SupervisionPassword   string                 `json:"supervision_password" bson:"supervision_password"`
+	WdaRepoPath           string                 `json:"wda_repo_path" bson:"wda_repo_path"`
+	ProviderFolder        string                 `json:"-" bson:"-"`
+	LastUpdatedTimestamp  int64                  `json:"last_updated" bson:"last_updated"`
+	ProvidedDevices       int                    `json:"provided_devices_count" bson:"provided_devices_count"`
+	WebDriverBinary       string                 `json:"-" bson:"-"`
+	UseGadsIosStream      bool                   `json:"use_gads_ios_stream" bson:"use_gads_ios_stream"`
+	UseCustomWDA          bool                   `json:"use_custom_wda" bson:"use_custom_wda"`
+	RecordAppiumSessions  bool                   `json:"record_appium_sessions" bson:"record_appium_sessions"`
+	BlockedCapabilities   []string               `json:"blocked_capabilities" bson:"blocked_capabilities"`
+	MandatoryCapabilities map[string]interface{} `json:"mandatory_capabilities" bson:"mandatory_capabilities"`
+	MinNewCommandTimeout  int                    `json:"min_new_command_timeout" bson:"min_new_command_timeout"`
+	MaxNewCommandTimeout  int                    `json:"max_new_command_timeout" bson:"max_new_command_timeout"`
+	SessionQueueTimeout   int                    `json:"session_queue_timeout" bson:"session_queue_timeout"`
+	StreamSettings        StreamSettings         `json:"stream_settings" bson:"stream_settings"`
+	GadsStreamApkPath     string                 `json:"gads_stream_apk_path" bson:"gads_stream_apk_path"`
+	GadsStreamURL         string                 `json:"gads_stream_url" bson:"gads_stream_url"`
+}
+
+// MJPEG stream settings, zero values are not set and fall back to the next level - device, provider, built-in defaults
+type StreamSettings struct {
+	TargetFPS     int `json:"target_fps" bson:"target_fps"`
+	JpegQuality   int `json:"jpeg_quality" bson:"jpeg_quality"`
+	ScalingFactor int `json:"scaling_factor" bson:"scaling_factor"`
 }
 
 type ProviderData struct {
@@ -2,6 +2,7 @@ package models
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/danielpaulus/go-ios/ios"
 )
@@ -17,6 +18,8 @@ type CustomLogger interface {
 
 type AppiumLogger interface {
 	Log(device *Device, logLine string)
+	Subscribe() chan AppiumLog
+	Unsubscribe(subscriber chan AppiumLog)
 }
 
 type Device struct {
@@ -30,6 +33,7 @@ type Device struct {
 	Provider             string             `json:"provider" bson:"provider"`
 	ScreenWidth          string             `json:"screen_width" bson:"screen_width"`
 	ScreenHeight         string             `json:"screen_height" bson:"screen_height"`
+	ScreenScale          float64            `json:"screen_scale" bson:"screen_scale"`
 	HardwareModel        string             `json:"hardware_model,omitempty" bson:"hardware_model,omitempty"`
 	InstalledApps        []string           `json:"installed_apps" bson:"-"`
 	IOSProductType       string             `json:"ios_product_type,omitempty" bson:"ios_product_type,omitempty"`
@@ -49,6 +53,19 @@ type Device struct {
 	WDAStreamPort        string             `json:"wda_stream_port" bson:"-"`
 	WDAPort              string             `json:"wda_port" bson:"-"`
 	AppiumLogger         AppiumLogger       `json:"-" bson:"-"`
+	Labels               []string           `json:"labels" bson:"-"`
+	StreamSettings       StreamSettings     `json:"stream_settings" bson:"-"`
+	StreamType           string             `json:"stream_type" bson:"-"`
+}
+
+// Version of an Android package as reported by its manifest or `dumpsys package`
+type AndroidPackageVersion struct {
+	VersionCode int64  `json:"version_code"`
+	VersionName string `json:"version_name"`
+}
+
+func (v AndroidPackageVersion) String() string {
+	return fmt.Sprintf("%s (%v)", v.VersionName, v.VersionCode)
 }
 
 type ByUDID []Device
@@ -0,0 +1,14 @@
+package models
+
+// Capabilities a Selenium Grid node slot advertises for a device
+type GridStereotype struct {
+	PlatformName         string   `json:"platformName"`
+	DeviceName           string   `json:"appium:deviceName"`
+	PlatformVersion      string   `json:"appium:platformVersion"`
+	AutomationName       string   `json:"appium:automationName"`
+	UDID                 string   `json:"appium:udid"`
+	Model                string   `json:"gads:model"`
+	ScreenSize           string   `json:"gads:screenSize"`
+	PlatformMajorVersion string   `json:"gads:platformMajorVersion"`
+	Labels               []string `json:"gads:labels"`
+}
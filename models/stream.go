@@ -0,0 +1,77 @@
+package models
+
+// Per-viewer stream options, zero values keep the device stream as it is
+type StreamViewerQuery struct {
+	MaxWidth int `form:"maxWidth"`
+	Quality  int `form:"quality"`
+	FPS      int `form:"fps"`
+}
+
+// Statistics of an upstream device stream, rates and frame sizes are over the last `stats_window_ms`
+type StreamStats struct {
+	Source           string              `json:"source"`
+	UptimeMs         int64               `json:"uptime_ms"`
+	StatsWindowMs    int64               `json:"stats_window_ms"`
+	UpstreamFPS      float64             `json:"upstream_fps"`
+	BytesPerSecond   float64             `json:"bytes_per_second"`
+	AvgFrameSize     int                 `json:"avg_frame_size"`
+	MinFrameSize     int                 `json:"min_frame_size"`
+	MaxFrameSize     int                 `json:"max_frame_size"`
+	TotalFrames      uint64              `json:"total_frames"`
+	TotalBytes       uint64              `json:"total_bytes"`
+	SinceLastFrameMs int64               `json:"since_last_frame_ms"`
+	Viewers          []StreamViewerStats `json:"viewers"`
+}
+
+// Statistics of a single stream viewer
+// Dropped frames were discarded because the viewer was too slow, skipped frames were discarded to keep its fps limit
+type StreamViewerStats struct {
+	ID              string `json:"id"`
+	Type            string `json:"type"`
+	RemoteAddr      string `json:"remote_addr"`
+	MaxWidth        int    `json:"max_width"`
+	Quality         int    `json:"quality"`
+	FPS             int    `json:"fps"`
+	ConnectedMs     int64  `json:"connected_ms"`
+	SentFrames      uint64 `json:"sent_frames"`
+	DroppedFrames   uint64 `json:"dropped_frames"`
+	SkippedFrames   uint64 `json:"skipped_frames"`
+	SinceLastSentMs int64  `json:"since_last_sent_ms"`
+}
+
+// Upstream stream statuses
+const (
+	StreamStatusIdle         = "idle"
+	StreamStatusConnecting   = "connecting"
+	StreamStatusLive         = "live"
+	StreamStatusReconnecting = "reconnecting"
+	StreamStatusDown         = "down"
+)
+
+// Status message sent to websocket stream viewers when the upstream stream is lost or restored
+type StreamStatus struct {
+	Type      string `json:"type"`
+	Status    string `json:"status"`
+	Attempt   int    `json:"attempt,omitempty"`
+	RetryInMs int64  `json:"retry_in_ms,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Upstream stream state and reconnect history of a device
+type StreamHealth struct {
+	Status          string `json:"status"`
+	Reconnects      int    `json:"reconnects"`
+	LastError       string `json:"last_error,omitempty"`
+	LastReconnectAt int64  `json:"last_reconnect_at,omitempty"`
+}
+
+type DeviceHealthResponse struct {
+	Healthy bool         `json:"healthy"`
+	Stream  StreamHealth `json:"stream"`
+}
+
+// Source of the Android device stream
+const (
+	StreamTypeGadsStream = "gads_stream"
+	StreamTypeScreencap  = "screencap"
+)
@@ -0,0 +1,184 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image/jpeg"
+	"os"
+	"time"
+)
+
+// Size of the RIFF/AVI header up to and including the `movi` list fourcc
+const aviHeaderSize = 224
+
+// Offset of the `movi` fourcc in the file, idx1 chunk offsets are relative to it
+const aviMoviOffset = 220
+
+type aviIndexEntry struct {
+	offset uint32
+	size   uint32
+}
+
+// Minimal MJPEG AVI writer
+// The header is written with placeholder values on the first frame and rewritten with the real values on Close
+type aviWriter struct {
+	file        *os.File
+	width       uint32
+	height      uint32
+	position    uint32
+	maxFrame    uint32
+	index       []aviIndexEntry
+	firstFrame  time.Time
+	lastFrame   time.Time
+	headerReady bool
+}
+
+func newAviWriter(filePath string) (*aviWriter, error) {
+	file, err := os.Create(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("newAviWriter: Could not create file `%s` - %s", filePath, err)
+	}
+
+	return &aviWriter{file: file}, nil
+}
+
+// Append a JPEG frame to the `movi` list
+func (w *aviWriter) WriteFrame(frame []byte, ts time.Time) error {
+	if !w.headerReady {
+		imgConfig, err := jpeg.DecodeConfig(bytes.NewReader(frame))
+		if err != nil {
+			return fmt.Errorf("WriteFrame: Could not decode first frame dimensions - %s", err)
+		}
+		w.width = uint32(imgConfig.Width)
+		w.height = uint32(imgConfig.Height)
+
+		_, err = w.file.Write(w.header(0, 0))
+		if err != nil {
+			return fmt.Errorf("WriteFrame: Could not write AVI header - %s", err)
+		}
+		w.position = aviHeaderSize
+		w.firstFrame = ts
+		w.headerReady = true
+	}
+
+	size := uint32(len(frame))
+	chunk := make([]byte, 8, 8+len(frame)+1)
+	copy(chunk[0:4], "00dc")
+	binary.LittleEndian.PutUint32(chunk[4:8], size)
+	chunk = append(chunk, frame...)
+	// Chunks are word aligned
+	if size%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+
+	_, err := w.file.Write(chunk)
+	if err != nil {
+		return fmt.Errorf("WriteFrame: Could not write frame chunk - %s", err)
+	}
+
+	w.index = append(w.index, aviIndexEntry{offset: w.position - aviMoviOffset, size: size})
+	w.position += uint32(len(chunk))
+	if size > w.maxFrame {
+		w.maxFrame = size
+	}
+	w.lastFrame = ts
+
+	return nil
+}
+
+// Write the index and rewrite the header with the final frame count and the measured frame rate
+func (w *aviWriter) Close() error {
+	defer w.file.Close()
+
+	if !w.headerReady {
+		return nil
+	}
+
+	idx := new(bytes.Buffer)
+	idx.WriteString("idx1")
+	binary.Write(idx, binary.LittleEndian, uint32(len(w.index)*16))
+	for _, entry := range w.index {
+		idx.WriteString("00dc")
+		// AVIIF_KEYFRAME - every MJPEG frame is a keyframe
+		binary.Write(idx, binary.LittleEndian, uint32(0x10))
+		binary.Write(idx, binary.LittleEndian, entry.offset)
+		binary.Write(idx, binary.LittleEndian, entry.size)
+	}
+
+	moviEnd := w.position
+	_, err := w.file.Write(idx.Bytes())
+	if err != nil {
+		return fmt.Errorf("Close: Could not write AVI index - %s", err)
+	}
+
+	// Use the average frame duration of the recording since the streams have no fixed frame rate
+	usPerFrame := uint32(1000000 / 30)
+	if len(w.index) > 1 {
+		usPerFrame = uint32(w.lastFrame.Sub(w.firstFrame).Microseconds() / int64(len(w.index)-1))
+	}
+	if usPerFrame == 0 {
+		usPerFrame = 1
+	}
+
+	header := w.header(uint32(len(w.index)), usPerFrame)
+	binary.LittleEndian.PutUint32(header[4:8], moviEnd+uint32(idx.Len())-8)
+	binary.LittleEndian.PutUint32(header[216:220], moviEnd-aviMoviOffset)
+
+	_, err = w.file.WriteAt(header, 0)
+	if err != nil {
+		return fmt.Errorf("Close: Could not rewrite AVI header - %s", err)
+	}
+
+	return nil
+}
+
+// Build the RIFF/AVI header with a single MJPEG video stream
+func (w *aviWriter) header(totalFrames, usPerFrame uint32) []byte {
+	buf := new(bytes.Buffer)
+	le := func(values ...interface{}) {
+		for _, value := range values {
+			binary.Write(buf, binary.LittleEndian, value)
+		}
+	}
+
+	buf.WriteString("RIFF")
+	le(uint32(0)) // Patched on Close
+	buf.WriteString("AVI ")
+
+	buf.WriteString("LIST")
+	le(uint32(192))
+	buf.WriteString("hdrl")
+
+	// Main AVI header
+	buf.WriteString("avih")
+	le(uint32(56))
+	le(usPerFrame, uint32(0), uint32(0), uint32(0x10), totalFrames, uint32(0), uint32(1), w.maxFrame, w.width, w.height)
+	le(uint32(0), uint32(0), uint32(0), uint32(0))
+
+	buf.WriteString("LIST")
+	le(uint32(116))
+	buf.WriteString("strl")
+
+	// Stream header
+	buf.WriteString("strh")
+	le(uint32(56))
+	buf.WriteString("vidsMJPG")
+	le(uint32(0), uint16(0), uint16(0), uint32(0))
+	// Rate/scale gives the frames per second, use microseconds to keep the precision
+	le(usPerFrame, uint32(1000000), uint32(0), totalFrames, w.maxFrame, uint32(0xFFFFFFFF), uint32(0))
+	le(uint16(0), uint16(0), uint16(w.width), uint16(w.height))
+
+	// Stream format - BITMAPINFOHEADER
+	buf.WriteString("strf")
+	le(uint32(40))
+	le(uint32(40), w.width, w.height, uint16(1), uint16(24))
+	buf.WriteString("MJPG")
+	le(w.width*w.height*3, uint32(0), uint32(0), uint32(0), uint32(0))
+
+	buf.WriteString("LIST")
+	le(uint32(0)) // Patched on Close
+	buf.WriteString("movi")
+
+	return buf.Bytes()
+}
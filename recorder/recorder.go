@@ -0,0 +1,207 @@
+package recorder
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shamanec/GADS-devices-provider/config"
+	"github.com/shamanec/GADS-devices-provider/models"
+	"github.com/shamanec/GADS-devices-provider/stream"
+)
+
+// Currently running session recordings by device UDID
+var activeRecordings = make(map[string]*sessionRecording)
+var mu sync.Mutex
+
+type sessionRecording struct {
+	sessionID string
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+type SessionVideo struct {
+	SessionID string `json:"session_id"`
+	Size      int64  `json:"size"`
+	Modified  int64  `json:"modified"`
+	Recording bool   `json:"recording"`
+}
+
+// Folder where the session recordings of a device are stored
+func SessionsFolder(udid string) string {
+	return fmt.Sprintf("%s/logs/device_%s/sessions", config.Config.EnvConfig.ProviderFolder, udid)
+}
+
+// Path to the video file of an Appium session
+func SessionVideoPath(udid, sessionID string) string {
+	return fmt.Sprintf("%s/%s.avi", SessionsFolder(udid), sessionID)
+}
+
+// Start recording the device stream for an Appium session
+// Any recording already running for the device is stopped first
+func StartSessionRecording(device *models.Device, sessionID string) error {
+	StopSessionRecording(device)
+
+	err := os.MkdirAll(SessionsFolder(device.UDID), os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("StartSessionRecording: Could not create sessions folder for device `%s` - %s", device.UDID, err)
+	}
+
+	writer, err := newAviWriter(SessionVideoPath(device.UDID, sessionID))
+	if err != nil {
+		return err
+	}
+
+	timestampsFile, err := os.Create(fmt.Sprintf("%s/%s.timestamps.csv", SessionsFolder(device.UDID), sessionID))
+	if err != nil {
+		writer.Close()
+		return fmt.Errorf("StartSessionRecording: Could not create frame timestamps file for session `%s` - %s", sessionID, err)
+	}
+
+	ctx, cancel := context.WithCancel(device.Context)
+	recording := &sessionRecording{
+		sessionID: sessionID,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+
+	mu.Lock()
+	activeRecordings[device.UDID] = recording
+	mu.Unlock()
+
+	go func() {
+		defer close(recording.done)
+		defer cancel()
+		defer timestampsFile.Close()
+		defer func() {
+			err := writer.Close()
+			if err != nil {
+				device.Logger.LogError("session_recording", fmt.Sprintf("Failed finalizing recording for session `%s` - %s", sessionID, err))
+			}
+		}()
+
+		timestamps := bufio.NewWriter(timestampsFile)
+		defer timestamps.Flush()
+		fmt.Fprintln(timestamps, "frame,timestamp_ms")
+
+		frameIndex := 0
+		err := readFrames(ctx, device, func(frame []byte) error {
+			now := time.Now()
+			err := writer.WriteFrame(frame, now)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(timestamps, "%d,%d\n", frameIndex, now.UnixMilli())
+			frameIndex++
+			return nil
+		})
+		if err != nil && ctx.Err() == nil {
+			device.Logger.LogError("session_recording", fmt.Sprintf("Recording for session `%s` stopped unexpectedly - %s", sessionID, err))
+		}
+
+		mu.Lock()
+		if activeRecordings[device.UDID] == recording {
+			delete(activeRecordings, device.UDID)
+		}
+		mu.Unlock()
+	}()
+
+	device.Logger.LogInfo("session_recording", fmt.Sprintf("Started recording Appium session `%s`", sessionID))
+	return nil
+}
+
+// Stop the running session recording for a device, if any, and wait for the video to be finalized
+func StopSessionRecording(device *models.Device) {
+	mu.Lock()
+	recording, ok := activeRecordings[device.UDID]
+	delete(activeRecordings, device.UDID)
+	mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	recording.cancel()
+	<-recording.done
+	device.Logger.LogInfo("session_recording", fmt.Sprintf("Stopped recording Appium session `%s`", recording.sessionID))
+}
+
+// Get all recorded session videos for a device, newest first
+func GetSessionVideos(udid string) ([]SessionVideo, error) {
+	videos := []SessionVideo{}
+
+	files, err := os.ReadDir(SessionsFolder(udid))
+	if os.IsNotExist(err) {
+		return videos, nil
+	}
+	if err != nil {
+		return videos, fmt.Errorf("GetSessionVideos: Could not read sessions folder for device `%s` - %s", udid, err)
+	}
+
+	mu.Lock()
+	recordingSessionID := ""
+	if recording, ok := activeRecordings[udid]; ok {
+		recordingSessionID = recording.sessionID
+	}
+	mu.Unlock()
+
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".avi" {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		sessionID := strings.TrimSuffix(file.Name(), ".avi")
+		videos = append(videos, SessionVideo{
+			SessionID: sessionID,
+			Size:      info.Size(),
+			Modified:  info.ModTime().UnixMilli(),
+			Recording: sessionID == recordingSessionID,
+		})
+	}
+
+	sort.Slice(videos, func(i, j int) bool {
+		return videos[i].Modified > videos[j].Modified
+	})
+
+	return videos, nil
+}
+
+// Check if a session is currently being recorded on a device
+func IsRecording(udid, sessionID string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	recording, ok := activeRecordings[udid]
+	return ok && recording.sessionID == sessionID
+}
+
+// Read JPEG frames from the device stream until the context is cancelled or the stream fails
+// The recording subscribes to the same upstream stream as the viewers instead of opening its own
+func readFrames(ctx context.Context, device *models.Device, handleFrame func([]byte) error) error {
+	subscriber, unsubscribe := stream.Subscribe(device, stream.DeviceSource(device), "recording", "", models.StreamViewerQuery{})
+	defer unsubscribe()
+
+	for {
+		select {
+		case frame, ok := <-subscriber.Frames:
+			if !ok {
+				return fmt.Errorf("readFrames: Device stream closed")
+			}
+			if err := handleFrame(frame.Data); err != nil {
+				return err
+			}
+			subscriber.MarkSent()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
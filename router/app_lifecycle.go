@@ -0,0 +1,247 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shamanec/GADS-devices-provider/devices"
+	"github.com/shamanec/GADS-devices-provider/models"
+)
+
+// Android package names are passed to `adb shell` so anything else is rejected
+var androidPackageRegex = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*(\.[A-Za-z0-9_]+)+$`)
+
+// Start an app fresh, stopping it first if it is already running
+func DeviceLaunchApp(c *gin.Context) {
+	deviceAppAction(c, "launch", func(device *models.Device, app string) error {
+		switch {
+		case device.AppiumSessionID != "":
+			err := appiumMobileCommand(device, "terminateApp", appArguments(device, app), nil)
+			if err != nil {
+				return err
+			}
+			return appiumMobileCommand(device, "activateApp", appArguments(device, app), nil)
+		case device.OS == "android":
+			return devices.LaunchAppAndroid(device, app)
+		default:
+			return devices.LaunchAppIOS(device, app)
+		}
+	})
+}
+
+// Bring an app to the foreground, starting it if it is not running
+func DeviceActivateApp(c *gin.Context) {
+	deviceAppAction(c, "activate", func(device *models.Device, app string) error {
+		switch {
+		case device.AppiumSessionID != "":
+			return appiumMobileCommand(device, "activateApp", appArguments(device, app), nil)
+		case device.OS == "android":
+			return devices.ActivateAppAndroid(device, app)
+		default:
+			// go-ios launching activates the app if it is already running
+			return devices.LaunchAppIOS(device, app)
+		}
+	})
+}
+
+// Stop a running app
+func DeviceTerminateApp(c *gin.Context) {
+	deviceAppAction(c, "terminate", func(device *models.Device, app string) error {
+		switch {
+		case device.AppiumSessionID != "":
+			return appiumMobileCommand(device, "terminateApp", appArguments(device, app), nil)
+		case device.OS == "android":
+			return devices.TerminateAppAndroid(device, app)
+		default:
+			return devices.TerminateAppIOS(device, app)
+		}
+	})
+}
+
+// Get the state of an app, the `app` query parameter is the bundle ID or package name
+func DeviceAppState(c *gin.Context) {
+	udid := c.Param("udid")
+	device := devices.DeviceMap[udid]
+
+	app := c.Query("app")
+	if app == "" {
+		c.String(http.StatusBadRequest, "Missing `app` query parameter")
+		return
+	}
+	if err := validateAppID(device, app); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var state string
+	var err error
+	switch {
+	case device.AppiumSessionID != "":
+		var appiumState int
+		err = appiumMobileCommand(device, "queryAppState", appArguments(device, app), &appiumState)
+		if err == nil {
+			if appiumState < 0 || appiumState >= len(models.AppiumAppStates) {
+				err = fmt.Errorf("Unknown Appium app state %v", appiumState)
+			} else {
+				state = models.AppiumAppStates[appiumState]
+			}
+		}
+	case device.OS == "android":
+		state, err = devices.GetAppStateAndroid(device, app)
+	default:
+		// WebDriverAgent tells apart foreground and background apps, go-ios is the fallback
+		state, err = wdaAppState(device, app)
+		if err != nil {
+			device.Logger.LogWarn("app_lifecycle", fmt.Sprintf("Could not get state of app `%s` from WebDriverAgent, falling back to go-ios - %s", app, err))
+			state, err = devices.GetAppStateIOS(device, app)
+		}
+	}
+	if err != nil {
+		device.Logger.LogError("app_lifecycle", fmt.Sprintf("Failed to get state of app `%s` - %s", app, err))
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, models.AppStateResponse{App: app, State: state})
+}
+
+// Open a deep link or universal link, optionally in a specific app
+func DeviceOpenURL(c *gin.Context) {
+	udid := c.Param("udid")
+	device := devices.DeviceMap[udid]
+
+	var requestBody models.AppLifecycleData
+	if err := json.NewDecoder(c.Request.Body).Decode(&requestBody); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	if requestBody.URL == "" {
+		c.String(http.StatusBadRequest, "Missing `url`")
+		return
+	}
+	if requestBody.App != "" {
+		if err := validateAppID(device, requestBody.App); err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	device.Logger.LogInfo("app_lifecycle", fmt.Sprintf("Opening url `%s`", requestBody.URL))
+
+	var err error
+	switch {
+	case device.AppiumSessionID != "":
+		arguments := map[string]interface{}{"url": requestBody.URL}
+		if requestBody.App != "" {
+			if device.OS == "android" {
+				arguments["package"] = requestBody.App
+			} else {
+				arguments["bundleId"] = requestBody.App
+			}
+		}
+		err = appiumMobileCommand(device, "deepLink", arguments, nil)
+	case device.OS == "android":
+		err = devices.OpenURLAndroid(device, requestBody.URL, requestBody.App)
+	default:
+		// go-ios can't open urls, WebDriverAgent is running even without an Appium session
+		err = wdaOpenURL(device, requestBody.URL)
+	}
+	if err != nil {
+		device.Logger.LogError("app_lifecycle", fmt.Sprintf("Failed to open url `%s` - %s", requestBody.URL, err))
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Opened url `%s`", requestBody.URL)})
+}
+
+// Decode the app from the request and perform a lifecycle action on it
+func deviceAppAction(c *gin.Context, action string, perform func(device *models.Device, app string) error) {
+	udid := c.Param("udid")
+	device := devices.DeviceMap[udid]
+
+	var requestBody models.AppLifecycleData
+	if err := json.NewDecoder(c.Request.Body).Decode(&requestBody); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	if requestBody.App == "" {
+		c.String(http.StatusBadRequest, "Missing `app` bundle ID or package name")
+		return
+	}
+	if err := validateAppID(device, requestBody.App); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	device.Logger.LogInfo("app_lifecycle", fmt.Sprintf("Performing %s on app `%s`", action, requestBody.App))
+
+	err := perform(device, requestBody.App)
+	if err != nil {
+		device.Logger.LogError("app_lifecycle", fmt.Sprintf("Failed to %s app `%s` - %s", action, requestBody.App, err))
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Performed %s on app `%s`", action, requestBody.App)})
+}
+
+// Arguments identifying an app for Appium mobile commands, UiAutomator2 uses `appId` and XCUITest `bundleId`
+func appArguments(device *models.Device, app string) map[string]interface{} {
+	if device.OS == "android" {
+		return map[string]interface{}{"appId": app}
+	}
+	return map[string]interface{}{"bundleId": app}
+}
+
+// Execute an Appium `mobile:` command and decode its result into value
+func appiumMobileCommand(device *models.Device, command string, arguments map[string]interface{}, value interface{}) error {
+	payload := map[string]interface{}{
+		"script": "mobile: " + command,
+		"args":   []interface{}{arguments},
+	}
+	return appiumValueRequest(device, http.MethodPost, "execute/sync", payload, value)
+}
+
+// Check that an Android package name is valid before it is used in adb commands
+func validateAppID(device *models.Device, app string) error {
+	if device.OS == "android" && !androidPackageRegex.MatchString(app) {
+		return fmt.Errorf("Invalid package name `%s`", app)
+	}
+	return nil
+}
+
+// Get the state of an app from WebDriverAgent, its states match the Appium `queryAppState` values
+func wdaAppState(device *models.Device, bundleID string) (string, error) {
+	payloadJSON, err := json.Marshal(map[string]string{"bundleId": bundleID})
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := wdaRequest(device, http.MethodPost, fmt.Sprintf("session/%s/wda/apps/state", device.WDASessionID), bytes.NewReader(payloadJSON))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("WebDriverAgent returned status %v - %s", resp.StatusCode, string(body))
+	}
+
+	var stateResponse struct {
+		Value int `json:"value"`
+	}
+	if err := json.Unmarshal(body, &stateResponse); err != nil {
+		return "", err
+	}
+	if stateResponse.Value < 0 || stateResponse.Value >= len(models.AppiumAppStates) {
+		return "", fmt.Errorf("Unknown WebDriverAgent app state %v", stateResponse.Value)
+	}
+	return models.AppiumAppStates[stateResponse.Value], nil
+}
@@ -239,28 +239,6 @@ func getActiveElementID(resp *http.Response) (string, error) {
 	return activeElementData.Value.Element, nil
 }
 
-func appiumTypeText(device *models.Device, text string) (*http.Response, error) {
-	activeElementResp, err := appiumGetActiveElement(device)
-	if err != nil {
-		return activeElementResp, err
-	}
-
-	activeElementID, err := getActiveElementID(activeElementResp)
-	if err != nil {
-		return nil, err
-	}
-
-	typeTextPayload := models.AppiumTypeText{
-		Text: text,
-	}
-
-	typeJSON, err := json.MarshalIndent(typeTextPayload, "", "  ")
-	if err != nil {
-		return nil, err
-	}
-	return appiumRequest(device, http.MethodPost, fmt.Sprintf("element/%s/value", activeElementID), bytes.NewBuffer(typeJSON))
-}
-
 func appiumClearText(device *models.Device) (*http.Response, error) {
 	activeElementResp, err := appiumGetActiveElement(device)
 	if err != nil {
@@ -294,3 +272,65 @@ func appiumHome(device *models.Device) (*http.Response, error) {
 		return nil, fmt.Errorf("Unsupported device OS: %s", device.OS)
 	}
 }
+
+// Send a request to the Appium session and decode the `value` of the response
+// Non-200 responses are returned as errors with the Appium error message
+func appiumValueRequest(device *models.Device, method, endpoint string, payload interface{}, value interface{}) error {
+	var requestBody io.Reader
+	if payload != nil {
+		payloadJSON, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		requestBody = bytes.NewReader(payloadJSON)
+	}
+
+	resp, err := appiumRequest(device, method, endpoint, requestBody)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var errorResponse W3CErrorResponse
+		if json.Unmarshal(body, &errorResponse) == nil && errorResponse.Value.Message != "" {
+			return fmt.Errorf("Appium returned status %v - %s", resp.StatusCode, errorResponse.Value.Message)
+		}
+		return fmt.Errorf("Appium returned status %v - %s", resp.StatusCode, string(body))
+	}
+
+	if value == nil {
+		return nil
+	}
+	response := struct {
+		Value interface{} `json:"value"`
+	}{
+		Value: value,
+	}
+	return json.Unmarshal(body, &response)
+}
+
+// Open a url through the WebDriverAgent session
+func wdaOpenURL(device *models.Device, url string) error {
+	payloadJSON, err := json.Marshal(map[string]string{"url": url})
+	if err != nil {
+		return err
+	}
+
+	resp, err := wdaRequest(device, http.MethodPost, fmt.Sprintf("session/%s/url", device.WDASessionID), bytes.NewReader(payloadJSON))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("WebDriverAgent returned status %v - %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
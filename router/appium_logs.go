@@ -0,0 +1,107 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/shamanec/GADS-devices-provider/db"
+	"github.com/shamanec/GADS-devices-provider/devices"
+	"github.com/shamanec/GADS-devices-provider/logger"
+	"github.com/shamanec/GADS-devices-provider/models"
+)
+
+// Get Appium logs for a device filtered by session ID, log type, time range and text with cursor pagination
+func DeviceAppiumLogs(c *gin.Context) {
+	udid := c.Param("udid")
+
+	if _, ok := devices.DeviceMap[udid]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Did not find device with udid `%s`", udid)})
+		return
+	}
+
+	var query models.AppiumLogsQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid query parameters - %s", err)})
+		return
+	}
+
+	logs, err := db.GetAppiumLogs(udid, query)
+	if err != nil {
+		logger.ProviderLogger.LogError("appium_logs", fmt.Sprintf("Failed getting Appium logs for device `%s` - %s", udid, err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, logs)
+}
+
+// Live tail the Appium logs of a device over websocket
+// The same filters as for DeviceAppiumLogs apply, pagination parameters are ignored
+func DeviceAppiumLogsWS(c *gin.Context) {
+	udid := c.Param("udid")
+
+	device, ok := devices.DeviceMap[udid]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Did not find device with udid `%s`", udid)})
+		return
+	}
+
+	var query models.AppiumLogsQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid query parameters - %s", err)})
+		return
+	}
+
+	conn, _, _, err := ws.UpgradeHTTP(c.Request, c.Writer)
+	if err != nil {
+		logger.ProviderLogger.LogError("appium_logs", fmt.Sprintf("Failed upgrading http to ws for device `%s` Appium logs - %s", udid, err))
+		return
+	}
+	defer conn.Close()
+
+	subscriber := device.AppiumLogger.Subscribe()
+	defer device.AppiumLogger.Unsubscribe(subscriber)
+
+	// Watch the connection for close frames or errors so we can release the subscription immediately
+	clientGone := make(chan struct{})
+	go func() {
+		defer close(clientGone)
+		for {
+			msg, err := wsutil.ReadClientMessage(conn, nil)
+			if err != nil {
+				return
+			}
+			if len(msg) != 0 && msg[0].OpCode == ws.OpClose {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case logData, ok := <-subscriber:
+			if !ok {
+				return
+			}
+			if !query.Matches(logData) {
+				continue
+			}
+
+			jsonData, err := json.Marshal(logData)
+			if err != nil {
+				continue
+			}
+
+			err = wsutil.WriteServerText(conn, jsonData)
+			if err != nil {
+				return
+			}
+		case <-clientGone:
+			return
+		}
+	}
+}
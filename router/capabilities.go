@@ -0,0 +1,189 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/shamanec/GADS-devices-provider/config"
+	"github.com/shamanec/GADS-devices-provider/devices"
+	"github.com/shamanec/GADS-devices-provider/models"
+)
+
+// Capabilities that would break the provider set up for the device if a session used them
+// These are always blocked in addition to the ones in the provider configuration
+var defaultBlockedCapabilities = []string{
+	"appium:useNewWDA",
+	"appium:remoteAdbHost",
+	"appium:adbPort",
+}
+
+// Appium's own default when `newCommandTimeout` is not provided
+const appiumDefaultNewCommandTimeout = 60
+
+// Strip the `appium:` vendor prefix so capabilities can be compared regardless of how the client sent them
+func capabilityName(capability string) string {
+	return strings.TrimPrefix(capability, "appium:")
+}
+
+// Remove a capability from a capabilities map, with or without vendor prefix
+func deleteCapability(capabilities map[string]interface{}, capability string) {
+	name := capabilityName(capability)
+	delete(capabilities, name)
+	delete(capabilities, "appium:"+name)
+}
+
+// Find a capability in a capabilities map, with or without vendor prefix
+func findCapability(capabilities map[string]interface{}, capability string) (string, interface{}, bool) {
+	name := capabilityName(capability)
+	if value, ok := capabilities["appium:"+name]; ok {
+		return "appium:" + name, value, true
+	}
+	if value, ok := capabilities[name]; ok {
+		return name, value, true
+	}
+	return "", nil, false
+}
+
+// Get the Appium 2 `appium:options` capabilities nested in a capabilities map, nil if there are none
+func appiumOptions(capabilities map[string]interface{}) map[string]interface{} {
+	options, _ := capabilities["appium:options"].(map[string]interface{})
+	return options
+}
+
+// Apply the provider capability policy to a new session request body
+// Blocked capabilities are rejected, provider managed and mandatory capabilities are merged on top of the requested ones
+// and `newCommandTimeout` is kept in the configured bounds
+func enforceCapabilityPolicy(device *models.Device, body []byte) ([]byte, error) {
+	var payload map[string]interface{}
+	err := json.Unmarshal(body, &payload)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse new session request body - %s", err)
+	}
+
+	capabilities, _ := payload["capabilities"].(map[string]interface{})
+	if capabilities == nil {
+		capabilities = map[string]interface{}{}
+		payload["capabilities"] = capabilities
+	}
+	alwaysMatch, _ := capabilities["alwaysMatch"].(map[string]interface{})
+	if alwaysMatch == nil {
+		alwaysMatch = map[string]interface{}{}
+		capabilities["alwaysMatch"] = alwaysMatch
+	}
+	var firstMatch []map[string]interface{}
+	if firstMatchList, ok := capabilities["firstMatch"].([]interface{}); ok {
+		for _, entry := range firstMatchList {
+			if entryMap, ok := entry.(map[string]interface{}); ok {
+				firstMatch = append(firstMatch, entryMap)
+			}
+		}
+	}
+	desiredCapabilities, _ := payload["desiredCapabilities"].(map[string]interface{})
+
+	allCapabilitySets := append([]map[string]interface{}{alwaysMatch}, firstMatch...)
+	if desiredCapabilities != nil {
+		allCapabilitySets = append(allCapabilitySets, desiredCapabilities)
+	}
+	// Appium 2 also reads capabilities nested in `appium:options` so they go through the same policy
+	var optionsSets []map[string]interface{}
+	for _, capabilitySet := range allCapabilitySets {
+		if options := appiumOptions(capabilitySet); options != nil {
+			optionsSets = append(optionsSets, options)
+		}
+	}
+	allCapabilitySets = append(allCapabilitySets, optionsSets...)
+
+	// Reject the session if any blocked capability is requested
+	blocked := append([]string{}, defaultBlockedCapabilities...)
+	blocked = append(blocked, config.Config.EnvConfig.BlockedCapabilities...)
+	for _, capabilitySet := range allCapabilitySets {
+		for _, blockedCapability := range blocked {
+			if key, _, ok := findCapability(capabilitySet, blockedCapability); ok {
+				return nil, fmt.Errorf("Capability `%s` is not allowed on this provider", key)
+			}
+		}
+	}
+
+	enforced := devices.ManagedAppiumCapabilities(device)
+	for capability, value := range config.Config.EnvConfig.MandatoryCapabilities {
+		if _, ok := enforced[capability]; !ok {
+			enforced[capability] = value
+		}
+	}
+
+	// W3C does not allow the same capability in alwaysMatch and firstMatch
+	// so remove the enforced ones from firstMatch and set them only in alwaysMatch
+	// Nested options would override the enforced values so they are removed there as well
+	overridingSets := append(append([]map[string]interface{}{}, firstMatch...), optionsSets...)
+	for _, capabilitySet := range overridingSets {
+		for capability := range enforced {
+			deleteCapability(capabilitySet, capability)
+		}
+	}
+	for capability, value := range enforced {
+		deleteCapability(alwaysMatch, capability)
+		alwaysMatch[capability] = value
+		if desiredCapabilities != nil {
+			deleteCapability(desiredCapabilities, capability)
+			desiredCapabilities[capability] = value
+		}
+	}
+
+	applyNewCommandTimeoutBounds(alwaysMatch, firstMatch, desiredCapabilities, optionsSets)
+
+	return json.Marshal(payload)
+}
+
+// Keep `newCommandTimeout` between the configured min and max
+// If the session doesn't provide it, the Appium default is bounded and injected
+func applyNewCommandTimeoutBounds(alwaysMatch map[string]interface{}, firstMatch []map[string]interface{}, desiredCapabilities map[string]interface{}, optionsSets []map[string]interface{}) {
+	minTimeout := config.Config.EnvConfig.MinNewCommandTimeout
+	maxTimeout := config.Config.EnvConfig.MaxNewCommandTimeout
+	if minTimeout == 0 && maxTimeout == 0 {
+		return
+	}
+
+	bound := func(timeout int) int {
+		if minTimeout != 0 && timeout < minTimeout {
+			return minTimeout
+		}
+		if maxTimeout != 0 && timeout > maxTimeout {
+			return maxTimeout
+		}
+		return timeout
+	}
+
+	found := false
+	capabilitySets := append([]map[string]interface{}{alwaysMatch}, firstMatch...)
+	if desiredCapabilities != nil {
+		capabilitySets = append(capabilitySets, desiredCapabilities)
+	}
+	capabilitySets = append(capabilitySets, optionsSets...)
+	for _, capabilitySet := range capabilitySets {
+		key, value, ok := findCapability(capabilitySet, "appium:newCommandTimeout")
+		if !ok {
+			continue
+		}
+		found = true
+
+		timeout := appiumDefaultNewCommandTimeout
+		switch typedValue := value.(type) {
+		case float64:
+			timeout = int(typedValue)
+		case string:
+			if parsed, err := strconv.Atoi(typedValue); err == nil {
+				timeout = parsed
+			}
+		}
+		capabilitySet[key] = bound(timeout)
+	}
+
+	if !found {
+		alwaysMatch["appium:newCommandTimeout"] = bound(appiumDefaultNewCommandTimeout)
+		if desiredCapabilities != nil {
+			desiredCapabilities["appium:newCommandTimeout"] = bound(appiumDefaultNewCommandTimeout)
+		}
+	}
+}
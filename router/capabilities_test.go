@@ -0,0 +1,107 @@
+package router
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/shamanec/GADS-devices-provider/config"
+	"github.com/shamanec/GADS-devices-provider/models"
+)
+
+// Set the provider capability policy for the test
+func setupCapabilityPolicy(t *testing.T, envConfig models.ProviderDB) {
+	previousConfig := config.Config.EnvConfig
+	config.Config.EnvConfig = envConfig
+	t.Cleanup(func() {
+		config.Config.EnvConfig = previousConfig
+	})
+}
+
+// Enforce the policy on a session request for an Android test device and decode the result
+func enforceTestPolicy(t *testing.T, body string) (map[string]interface{}, error) {
+	t.Helper()
+	device := &models.Device{UDID: "test-udid", OS: "android", Name: "Pixel"}
+
+	enforced, err := enforceCapabilityPolicy(device, []byte(body))
+	if err != nil {
+		return nil, err
+	}
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(enforced, &payload); err != nil {
+		t.Fatalf("Could not parse enforced session request `%s` - %s", string(enforced), err)
+	}
+	return payload, nil
+}
+
+func TestCapabilityPolicyRejectsBlockedCapabilities(t *testing.T) {
+	setupCapabilityPolicy(t, models.ProviderDB{BlockedCapabilities: []string{"appium:app"}})
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"alwaysMatch", `{"capabilities":{"alwaysMatch":{"appium:app":"/tmp/app.apk"}}}`},
+		{"firstMatch without prefix", `{"capabilities":{"firstMatch":[{"app":"/tmp/app.apk"}]}}`},
+		{"desiredCapabilities", `{"desiredCapabilities":{"appium:adbPort":5038}}`},
+		{"nested in alwaysMatch options", `{"capabilities":{"alwaysMatch":{"appium:options":{"app":"/tmp/app.apk"}}}}`},
+		{"nested in firstMatch options", `{"capabilities":{"firstMatch":[{"appium:options":{"appium:remoteAdbHost":"10.0.0.1"}}]}}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := enforceTestPolicy(t, test.body)
+			if err == nil || !strings.Contains(err.Error(), "is not allowed") {
+				t.Errorf("Blocked capability was not rejected, error is `%v`", err)
+			}
+		})
+	}
+}
+
+func TestCapabilityPolicyEnforcesManagedCapabilities(t *testing.T) {
+	setupCapabilityPolicy(t, models.ProviderDB{})
+
+	payload, err := enforceTestPolicy(t, `{"capabilities":{
+		"alwaysMatch":{"appium:udid":"other","appium:options":{"udid":"other","automationName":"Espresso","deviceName":"Pixel"}},
+		"firstMatch":[{"appium:options":{"appium:udid":"other"}}]
+	}}`)
+	if err != nil {
+		t.Fatalf("Could not enforce the capability policy - %s", err)
+	}
+
+	capabilities := payload["capabilities"].(map[string]interface{})
+	alwaysMatch := capabilities["alwaysMatch"].(map[string]interface{})
+	if alwaysMatch["appium:udid"] != "test-udid" || alwaysMatch["appium:automationName"] != "UiAutomator2" {
+		t.Errorf("Managed capabilities were not enforced in alwaysMatch - %v", alwaysMatch)
+	}
+
+	options := alwaysMatch["appium:options"].(map[string]interface{})
+	if _, ok := options["udid"]; ok {
+		t.Errorf("Managed `udid` was left in the nested options - %v", options)
+	}
+	if _, ok := options["automationName"]; ok {
+		t.Errorf("Managed `automationName` was left in the nested options - %v", options)
+	}
+	if options["deviceName"] != "Pixel" {
+		t.Errorf("Unmanaged nested option was removed - %v", options)
+	}
+
+	firstMatchOptions := capabilities["firstMatch"].([]interface{})[0].(map[string]interface{})["appium:options"].(map[string]interface{})
+	if _, ok := firstMatchOptions["appium:udid"]; ok {
+		t.Errorf("Managed `appium:udid` was left in the nested firstMatch options - %v", firstMatchOptions)
+	}
+}
+
+func TestCapabilityPolicyBoundsNestedNewCommandTimeout(t *testing.T) {
+	setupCapabilityPolicy(t, models.ProviderDB{MaxNewCommandTimeout: 300})
+
+	payload, err := enforceTestPolicy(t, `{"capabilities":{"alwaysMatch":{"appium:options":{"newCommandTimeout":3600}}}}`)
+	if err != nil {
+		t.Fatalf("Could not enforce the capability policy - %s", err)
+	}
+
+	options := payload["capabilities"].(map[string]interface{})["alwaysMatch"].(map[string]interface{})["appium:options"].(map[string]interface{})
+	if options["newCommandTimeout"] != float64(300) {
+		t.Errorf("Nested `newCommandTimeout` is %v, expected it bounded to 300", options["newCommandTimeout"])
+	}
+}
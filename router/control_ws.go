@@ -0,0 +1,292 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/shamanec/GADS-devices-provider/devices"
+	"github.com/shamanec/GADS-devices-provider/logger"
+	"github.com/shamanec/GADS-devices-provider/models"
+)
+
+// Maximum number of control messages waiting to be performed on a device
+const maxPendingControlMessages = 50
+
+// Acknowledgements are written from the device controller so a client that stops reading can't block other clients
+const controlAckWriteTimeout = 5 * time.Second
+
+// Message types that are moves, a pending move is replaced by a newer one of the same type from the same client
+var coalescedControlTypes = map[string]bool{
+	"swipe":   true,
+	"gesture": true,
+}
+
+// Input controllers by device UDID
+var controllers = make(map[string]*deviceController)
+var controllersMu sync.Mutex
+
+// Performs the control messages of all clients of a device one at a time
+// Serializing the requests keeps a single keep-alive connection to Appium/WebDriverAgent per device
+type deviceController struct {
+	device  *models.Device
+	mu      sync.Mutex
+	pending []*controlCommand
+	signal  chan struct{}
+}
+
+type controlCommand struct {
+	client     *controlClient
+	message    models.ControlMessage
+	receivedAt time.Time
+}
+
+type controlClient struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+}
+
+// Send a stream of input messages to the device and receive an acknowledgement for each one
+func DeviceControlWS(c *gin.Context) {
+	udid := c.Param("udid")
+
+	device, ok := devices.DeviceMap[udid]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Did not find device with udid `%s`", udid)})
+		return
+	}
+
+	conn, _, _, err := ws.UpgradeHTTP(c.Request, c.Writer)
+	if err != nil {
+		logger.ProviderLogger.LogError("control_ws", fmt.Sprintf("Failed upgrading http to ws for device `%s` control - %s", udid, err))
+		return
+	}
+	defer conn.Close()
+
+	client := &controlClient{conn: conn}
+	controller := getDeviceController(device)
+	defer controller.removeClient(client)
+
+	for {
+		data, op, err := wsutil.ReadClientData(conn)
+		if err != nil {
+			return
+		}
+		if op != ws.OpText {
+			continue
+		}
+		receivedAt := time.Now()
+
+		var message models.ControlMessage
+		if err := json.Unmarshal(data, &message); err != nil {
+			client.ack(models.ControlAck{Status: "error", Error: fmt.Sprintf("Invalid control message - %s", err)})
+			continue
+		}
+		message.Key = strings.ToLower(message.Key)
+		if err := validateControlMessage(device, message); err != nil {
+			client.ack(models.ControlAck{ID: message.ID, Type: message.Type, Status: "error", Error: err.Error(), SentAt: message.SentAt})
+			continue
+		}
+
+		controller.enqueue(&controlCommand{
+			client:     client,
+			message:    message,
+			receivedAt: receivedAt,
+		})
+	}
+}
+
+// Get the controller of a device, creating it if the device has none or its previous one stopped on a device reset
+func getDeviceController(device *models.Device) *deviceController {
+	controllersMu.Lock()
+	defer controllersMu.Unlock()
+
+	controller, ok := controllers[device.UDID]
+	if ok && controller.device == device && device.Context.Err() == nil {
+		return controller
+	}
+
+	controller = &deviceController{
+		device: device,
+		signal: make(chan struct{}, 1),
+	}
+	controllers[device.UDID] = controller
+	go controller.run(device.Context.Done())
+	return controller
+}
+
+// Queue a message, stale moves and messages over the queue limit are acknowledged as dropped
+func (dc *deviceController) enqueue(command *controlCommand) {
+	var dropped []*controlCommand
+
+	dc.mu.Lock()
+	if coalescedControlTypes[command.message.Type] {
+		kept := dc.pending[:0]
+		for _, pending := range dc.pending {
+			if pending.client == command.client && pending.message.Type == command.message.Type {
+				dropped = append(dropped, pending)
+				continue
+			}
+			kept = append(kept, pending)
+		}
+		dc.pending = kept
+	}
+	if len(dc.pending) >= maxPendingControlMessages {
+		dropped = append(dropped, command)
+	} else {
+		dc.pending = append(dc.pending, command)
+	}
+	dc.mu.Unlock()
+
+	for _, command := range dropped {
+		command.client.ack(command.newAck("dropped", time.Now()))
+	}
+
+	select {
+	case dc.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Remove the pending messages of a disconnected client
+func (dc *deviceController) removeClient(client *controlClient) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	kept := dc.pending[:0]
+	for _, pending := range dc.pending {
+		if pending.client != client {
+			kept = append(kept, pending)
+		}
+	}
+	dc.pending = kept
+}
+
+// Perform queued messages until the device context is cancelled
+func (dc *deviceController) run(done <-chan struct{}) {
+	for {
+		dc.mu.Lock()
+		var command *controlCommand
+		if len(dc.pending) > 0 {
+			command = dc.pending[0]
+			dc.pending = dc.pending[1:]
+		}
+		dc.mu.Unlock()
+
+		if command == nil {
+			select {
+			case <-dc.signal:
+				continue
+			case <-done:
+				return
+			}
+		}
+
+		startedAt := time.Now()
+		statusCode, err := performControlMessage(dc.device, command.message)
+
+		ack := command.newAck("ok", startedAt)
+		ack.StatusCode = statusCode
+		if err != nil {
+			ack.Status = "error"
+			ack.Error = err.Error()
+		}
+		command.client.ack(ack)
+	}
+}
+
+// Build an acknowledgement with the time the message spent queued and executing
+func (command *controlCommand) newAck(status string, startedAt time.Time) models.ControlAck {
+	finishedAt := time.Now()
+	return models.ControlAck{
+		ID:        command.message.ID,
+		Type:      command.message.Type,
+		Status:    status,
+		SentAt:    command.message.SentAt,
+		QueueMs:   startedAt.Sub(command.receivedAt).Milliseconds(),
+		ExecMs:    finishedAt.Sub(startedAt).Milliseconds(),
+		LatencyMs: finishedAt.Sub(command.receivedAt).Milliseconds(),
+	}
+}
+
+func (client *controlClient) ack(ack models.ControlAck) {
+	ackJSON, err := json.Marshal(ack)
+	if err != nil {
+		return
+	}
+
+	client.writeMu.Lock()
+	defer client.writeMu.Unlock()
+	client.conn.SetWriteDeadline(time.Now().Add(controlAckWriteTimeout))
+	// Write errors mean the client is gone or too slow, closing the connection ends its read loop which handles the cleanup
+	if err := wsutil.WriteServerText(client.conn, ackJSON); err != nil {
+		client.conn.Close()
+	}
+}
+
+// Check a message before it is queued so invalid input is rejected immediately
+func validateControlMessage(device *models.Device, message models.ControlMessage) error {
+	switch message.Type {
+	case "tap", "touch_and_hold", "swipe", "text":
+		return nil
+	case "key":
+		for _, key := range supportedKeys(device.OS) {
+			if key == message.Key {
+				return nil
+			}
+		}
+		return fmt.Errorf("Key `%s` is not supported on %s devices", message.Key, device.OS)
+	case "gesture":
+		return validateGesturePointers(message.Pointers)
+	default:
+		return fmt.Errorf("Unsupported control message type `%s`", message.Type)
+	}
+}
+
+// Perform a control message on the device and return the Appium/WebDriverAgent response status
+func performControlMessage(device *models.Device, message models.ControlMessage) (int, error) {
+	converter, err := newCoordinateConverter(device, message.CoordinateSpaceData)
+	if err != nil {
+		return 0, err
+	}
+	message.X, message.Y = converter.point(message.X, message.Y)
+	message.EndX, message.EndY = converter.point(message.EndX, message.EndY)
+	message.Pointers = converter.paths(message.Pointers)
+
+	var resp *http.Response
+	switch message.Type {
+	case "tap":
+		resp, err = appiumTap(device, message.X, message.Y)
+	case "touch_and_hold":
+		resp, err = appiumTouchAndHold(device, message.X, message.Y)
+	case "swipe":
+		resp, err = appiumSwipe(device, message.X, message.Y, message.EndX, message.EndY)
+	case "key":
+		resp, err = appiumKey(device, message.Key)
+	case "text":
+		if _, err := typeText(device, models.TextInputData{Text: message.Text}); err != nil {
+			return textInputStatus(err), err
+		}
+		return http.StatusOK, nil
+	case "gesture":
+		resp, err = appiumGesture(device, message.Pointers)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("%s", string(body))
+	}
+	return resp.StatusCode, nil
+}
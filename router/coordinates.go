@@ -0,0 +1,130 @@
+package router
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/shamanec/GADS-devices-provider/models"
+)
+
+// How long a fetched orientation is trusted before converting normalized coordinates fetches it again
+const orientationCacheTTL = 2 * time.Second
+
+type cachedOrientation struct {
+	orientation string
+	fetchedAt   time.Time
+}
+
+var orientationCache = make(map[string]cachedOrientation)
+var orientationCacheMu sync.Mutex
+
+func cacheOrientation(device *models.Device, orientation string) {
+	orientationCacheMu.Lock()
+	defer orientationCacheMu.Unlock()
+
+	orientationCache[device.UDID] = cachedOrientation{
+		orientation: orientation,
+		fetchedAt:   time.Now(),
+	}
+}
+
+// Get the device orientation, fetching it only if the cached one is too old
+func currentOrientation(device *models.Device) (string, error) {
+	orientationCacheMu.Lock()
+	cached, ok := orientationCache[device.UDID]
+	orientationCacheMu.Unlock()
+
+	if ok && time.Since(cached.fetchedAt) < orientationCacheTTL {
+		return cached.orientation, nil
+	}
+	return getDeviceOrientation(device)
+}
+
+// Converts coordinates from a client coordinate space to the device coordinate space Appium uses
+type coordinateConverter struct {
+	scaleX float64
+	scaleY float64
+}
+
+func newCoordinateConverter(device *models.Device, space models.CoordinateSpaceData) (coordinateConverter, error) {
+	switch space.CoordinateSpace {
+	case "", "device":
+		return coordinateConverter{scaleX: 1, scaleY: 1}, nil
+	case "pixels":
+		// Only iOS uses points, the scale is the same in both orientations
+		if device.ScreenScale <= 0 {
+			return coordinateConverter{}, fmt.Errorf("Screen scale of the device is not known")
+		}
+		return coordinateConverter{scaleX: 1 / device.ScreenScale, scaleY: 1 / device.ScreenScale}, nil
+	case "normalized":
+		orientation, err := currentOrientation(device)
+		if err != nil {
+			return coordinateConverter{}, fmt.Errorf("Could not get device orientation - %s", err)
+		}
+		width, height, err := deviceScreenSize(device, orientation == "LANDSCAPE")
+		if err != nil {
+			return coordinateConverter{}, err
+		}
+		return coordinateConverter{scaleX: width, scaleY: height}, nil
+	case "stream":
+		if space.StreamWidth <= 0 || space.StreamHeight <= 0 {
+			return coordinateConverter{}, fmt.Errorf("`stream_width` and `stream_height` are required for the `stream` coordinate space")
+		}
+		// The stream frame shows the screen as it is displayed so its shape gives the orientation
+		width, height, err := deviceScreenSize(device, space.StreamWidth > space.StreamHeight)
+		if err != nil {
+			return coordinateConverter{}, err
+		}
+		return coordinateConverter{scaleX: width / space.StreamWidth, scaleY: height / space.StreamHeight}, nil
+	default:
+		return coordinateConverter{}, fmt.Errorf("Unknown coordinate space `%s`, use `device`, `normalized`, `stream` or `pixels`", space.CoordinateSpace)
+	}
+}
+
+// Device screen size in the Appium coordinate space for the given orientation
+// The stored screen size is for portrait orientation
+func deviceScreenSize(device *models.Device, landscape bool) (float64, float64, error) {
+	width, err := strconv.ParseFloat(device.ScreenWidth, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Screen width of the device is not known")
+	}
+	height, err := strconv.ParseFloat(device.ScreenHeight, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Screen height of the device is not known")
+	}
+
+	if landscape {
+		return height, width, nil
+	}
+	return width, height, nil
+}
+
+func (cc coordinateConverter) point(x, y float64) (float64, float64) {
+	return x * cc.scaleX, y * cc.scaleY
+}
+
+// Convert a length like a pinch distance or rotation radius
+func (cc coordinateConverter) distance(d float64) float64 {
+	return d * (cc.scaleX + cc.scaleY) / 2
+}
+
+// Convert every point of the gesture pointer paths
+func (cc coordinateConverter) paths(pointers [][]models.GesturePoint) [][]models.GesturePoint {
+	converted := make([][]models.GesturePoint, len(pointers))
+	for i, path := range pointers {
+		for _, point := range path {
+			point.X, point.Y = cc.point(point.X, point.Y)
+			converted[i] = append(converted[i], point)
+		}
+	}
+	return converted
+}
+
+// Convert the coordinates of a single pointer action request
+func (cc coordinateConverter) actionData(data models.ActionData) models.ActionData {
+	data.X, data.Y = cc.point(data.X, data.Y)
+	data.EndX, data.EndY = cc.point(data.EndX, data.EndY)
+	return data
+}
@@ -0,0 +1,218 @@
+package router
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shamanec/GADS-devices-provider/devices"
+	"github.com/shamanec/GADS-devices-provider/models"
+)
+
+// Android devices without an active Appium session are controlled with adb instead
+func useAdbFallback(device *models.Device) bool {
+	return device.OS == "android" && device.AppiumSessionID == ""
+}
+
+// Respond with an error for a failed control action, missing Appium sessions are reported as unavailable
+func controlError(c *gin.Context, device *models.Device, action string, err error) {
+	device.Logger.LogError("appium_interact", fmt.Sprintf("Failed to %s - %s", action, err))
+	if device.AppiumSessionID == "" {
+		c.String(http.StatusServiceUnavailable, fmt.Sprintf("Failed to %s, there is no active Appium session - %s", action, err))
+		return
+	}
+	c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to %s - %s", action, err))
+}
+
+// Get the current screen orientation
+func DeviceOrientation(c *gin.Context) {
+	udid := c.Param("udid")
+	device := devices.DeviceMap[udid]
+
+	orientation, err := getDeviceOrientation(device)
+	if err != nil {
+		controlError(c, device, "get orientation", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, models.DeviceOrientation{Orientation: orientation})
+}
+
+// Get the current screen orientation through Appium or adb and cache it for coordinate conversion
+func getDeviceOrientation(device *models.Device) (string, error) {
+	var orientation string
+	var err error
+	if useAdbFallback(device) {
+		orientation, err = devices.GetOrientationAndroid(device)
+	} else {
+		err = appiumValueRequest(device, http.MethodGet, "orientation", nil, &orientation)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	orientation = strings.ToUpper(orientation)
+	cacheOrientation(device, orientation)
+	return orientation, nil
+}
+
+// Rotate the device to portrait or landscape
+func DeviceSetOrientation(c *gin.Context) {
+	udid := c.Param("udid")
+	device := devices.DeviceMap[udid]
+
+	var requestBody models.DeviceOrientation
+	if err := json.NewDecoder(c.Request.Body).Decode(&requestBody); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	orientation := strings.ToUpper(requestBody.Orientation)
+	if orientation != "PORTRAIT" && orientation != "LANDSCAPE" {
+		c.String(http.StatusBadRequest, "`orientation` must be `PORTRAIT` or `LANDSCAPE`")
+		return
+	}
+
+	device.Logger.LogInfo("appium_interact", fmt.Sprintf("Setting orientation to `%s`", orientation))
+
+	var err error
+	if useAdbFallback(device) {
+		err = devices.SetOrientationAndroid(device, orientation)
+	} else {
+		err = appiumValueRequest(device, http.MethodPost, "orientation", models.DeviceOrientation{Orientation: orientation}, nil)
+	}
+	if err != nil {
+		controlError(c, device, "set orientation", err)
+		return
+	}
+	cacheOrientation(device, orientation)
+
+	c.JSON(http.StatusOK, models.DeviceOrientation{Orientation: orientation})
+}
+
+// Get the clipboard text, both as plain text and base64 encoded
+func DeviceClipboard(c *gin.Context) {
+	udid := c.Param("udid")
+	device := devices.DeviceMap[udid]
+
+	var content string
+	var err error
+	if useAdbFallback(device) {
+		content, err = devices.GetClipboardAndroid(device)
+	} else {
+		payload := map[string]string{"contentType": "plaintext"}
+		err = appiumValueRequest(device, http.MethodPost, "appium/device/get_clipboard", payload, &content)
+	}
+	if errors.Is(err, devices.ErrClipboardUnavailable) {
+		c.String(http.StatusServiceUnavailable, "Reading the clipboard requires an active Appium session on Android 10 and newer")
+		return
+	}
+	if err != nil {
+		controlError(c, device, "get clipboard", err)
+		return
+	}
+
+	text, err := base64.StdEncoding.DecodeString(content)
+	if err != nil {
+		controlError(c, device, "get clipboard", fmt.Errorf("Clipboard content is not valid base64 - %s", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, models.DeviceClipboard{Text: string(text), Content: content})
+}
+
+// Set the clipboard from plain text or base64 encoded content
+func DeviceSetClipboard(c *gin.Context) {
+	udid := c.Param("udid")
+	device := devices.DeviceMap[udid]
+
+	var requestBody models.DeviceClipboard
+	if err := json.NewDecoder(c.Request.Body).Decode(&requestBody); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	content := requestBody.Content
+	if content == "" {
+		content = base64.StdEncoding.EncodeToString([]byte(requestBody.Text))
+	} else if _, err := base64.StdEncoding.DecodeString(content); err != nil {
+		c.String(http.StatusBadRequest, fmt.Sprintf("`content` is not valid base64 - %s", err))
+		return
+	}
+
+	// adb has no way to set the clipboard, it is only possible through the UiAutomator2 server
+	if useAdbFallback(device) {
+		c.String(http.StatusServiceUnavailable, "Setting the clipboard requires an active Appium session")
+		return
+	}
+
+	device.Logger.LogInfo("appium_interact", "Setting clipboard")
+
+	payload := map[string]string{
+		"content":     content,
+		"contentType": "plaintext",
+	}
+	err := appiumValueRequest(device, http.MethodPost, "appium/device/set_clipboard", payload, nil)
+	if err != nil {
+		controlError(c, device, "set clipboard", err)
+		return
+	}
+
+	text, _ := base64.StdEncoding.DecodeString(content)
+	c.JSON(http.StatusOK, models.DeviceClipboard{Text: string(text), Content: content})
+}
+
+// Get the current device location
+func DeviceGeolocation(c *gin.Context) {
+	udid := c.Param("udid")
+	device := devices.DeviceMap[udid]
+
+	var location models.DeviceGeolocation
+	var err error
+	if useAdbFallback(device) {
+		location, err = devices.GetGeolocationAndroid(device)
+	} else {
+		err = appiumValueRequest(device, http.MethodGet, "location", nil, &location)
+	}
+	if err != nil {
+		controlError(c, device, "get geolocation", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, location)
+}
+
+// Simulate the device location
+func DeviceSetGeolocation(c *gin.Context) {
+	udid := c.Param("udid")
+	device := devices.DeviceMap[udid]
+
+	var requestBody models.DeviceGeolocation
+	if err := json.NewDecoder(c.Request.Body).Decode(&requestBody); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	if math.Abs(requestBody.Latitude) > 90 || math.Abs(requestBody.Longitude) > 180 {
+		c.String(http.StatusBadRequest, "`latitude` must be between -90 and 90 and `longitude` between -180 and 180")
+		return
+	}
+
+	device.Logger.LogInfo("appium_interact", fmt.Sprintf("Setting geolocation to latitude %v, longitude %v, altitude %v", requestBody.Latitude, requestBody.Longitude, requestBody.Altitude))
+
+	var err error
+	if useAdbFallback(device) {
+		err = devices.SetGeolocationAndroid(device, requestBody)
+	} else {
+		err = appiumValueRequest(device, http.MethodPost, "location", map[string]interface{}{"location": requestBody}, nil)
+	}
+	if err != nil {
+		controlError(c, device, "set geolocation", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, requestBody)
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/shamanec/GADS-devices-provider/devices"
 	"github.com/shamanec/GADS-devices-provider/models"
+	"github.com/shamanec/GADS-devices-provider/stream"
 )
 
 // Copy the headers from the original endpoint to the proxied endpoint
@@ -21,6 +22,7 @@ func copyHeaders(destination, source http.Header) {
 }
 
 // Check the device health by checking Appium and WDA(for iOS)
+// The response also contains the device stream state and its upstream reconnects
 func DeviceHealth(c *gin.Context) {
 	udid := c.Param("udid")
 	dev := devices.DeviceMap[udid]
@@ -31,14 +33,19 @@ func DeviceHealth(c *gin.Context) {
 		return
 	}
 
+	response := models.DeviceHealthResponse{
+		Healthy: bool,
+		Stream:  stream.Health(dev),
+	}
+
 	if bool {
 		dev.Logger.LogInfo("device", "Device is healthy")
-		c.Writer.WriteHeader(200)
+		c.JSON(http.StatusOK, response)
 		return
 	}
 
 	dev.Logger.LogError("device", "Device is not healthy")
-	c.Writer.WriteHeader(500)
+	c.JSON(http.StatusInternalServerError, response)
 }
 
 // Call the respective Appium/WDA endpoint to go to Homescreen
@@ -177,39 +184,6 @@ func DeviceAppiumSource(c *gin.Context) {
 //=======================================
 // ACTIONS
 
-func DeviceTypeText(c *gin.Context) {
-	udid := c.Param("udid")
-	device := devices.DeviceMap[udid]
-
-	var requestBody models.ActionData
-	if err := json.NewDecoder(c.Request.Body).Decode(&requestBody); err != nil {
-		device.Logger.LogError("appium_interact", fmt.Sprintf("Failed to type text to active element - %s", err))
-		c.String(http.StatusInternalServerError, err.Error())
-		return
-	}
-
-	device.Logger.LogInfo("appium_interact", fmt.Sprintf("Typing `%s` to active element", requestBody.TextToType))
-
-	typeResp, err := appiumTypeText(device, requestBody.TextToType)
-	if err != nil {
-		device.Logger.LogError("appium_interact", fmt.Sprintf("Failed to type `%s` to active element - %s", requestBody.TextToType, err))
-		c.String(http.StatusInternalServerError, err.Error())
-		return
-	}
-
-	body, err := io.ReadAll(typeResp.Body)
-	if err != nil {
-		device.Logger.LogError("appium_interact", fmt.Sprintf("Failed to type `%s` to active element - %s", requestBody.TextToType, err))
-		c.String(http.StatusInternalServerError, err.Error())
-		return
-	}
-	defer typeResp.Body.Close()
-
-	c.Writer.WriteHeader(typeResp.StatusCode)
-	copyHeaders(c.Writer.Header(), typeResp.Header)
-	fmt.Fprintf(c.Writer, string(body))
-}
-
 func DeviceClearText(c *gin.Context) {
 	udid := c.Param("udid")
 	device := devices.DeviceMap[udid]
@@ -245,6 +219,13 @@ func DeviceTap(c *gin.Context) {
 		return
 	}
 
+	converter, err := newCoordinateConverter(device, requestBody.CoordinateSpaceData)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	requestBody = converter.actionData(requestBody)
+
 	device.Logger.LogInfo("appium_interact", fmt.Sprintf("Tapping at coordinates X:%v Y:%v", fmt.Sprintf("%.2f", requestBody.X), fmt.Sprintf("%.2f", requestBody.Y)))
 
 	tapResp, err := appiumTap(device, requestBody.X, requestBody.Y)
@@ -278,6 +259,13 @@ func DeviceTouchAndHold(c *gin.Context) {
 		return
 	}
 
+	converter, err := newCoordinateConverter(device, requestBody.CoordinateSpaceData)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	requestBody = converter.actionData(requestBody)
+
 	device.Logger.LogInfo("appium_interact", fmt.Sprintf("Touch and hold at coordinates X:%v Y:%v", fmt.Sprintf("%.2f", requestBody.X), fmt.Sprintf("%.2f", requestBody.Y)))
 
 	touchAndHoldResp, err := appiumTouchAndHold(device, requestBody.X, requestBody.Y)
@@ -312,6 +300,13 @@ func DeviceSwipe(c *gin.Context) {
 		return
 	}
 
+	converter, err := newCoordinateConverter(device, requestBody.CoordinateSpaceData)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	requestBody = converter.actionData(requestBody)
+
 	device.Logger.LogInfo("appium_interact", fmt.Sprintf("Swiping from X:%v Y:%v to X:%v Y:%v", fmt.Sprintf("%.3f", requestBody.X), fmt.Sprintf("%.3f", requestBody.Y), fmt.Sprintf("%.3f", requestBody.EndX), fmt.Sprintf("%.3f", requestBody.EndY)))
 
 	swipeResp, err := appiumSwipe(device, requestBody.X, requestBody.Y, requestBody.EndX, requestBody.EndY)
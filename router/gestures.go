@@ -0,0 +1,290 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shamanec/GADS-devices-provider/config"
+	"github.com/shamanec/GADS-devices-provider/devices"
+	"github.com/shamanec/GADS-devices-provider/models"
+)
+
+// Gesture duration in ms used when the request doesn't provide one
+const defaultGestureDuration = 500
+
+// Distance in pixels between the fingers at the closed end of a pinch or zoom
+const closedPinchDistance = 20
+
+// Maximum number of fingers in a single gesture
+const maxGesturePointers = 10
+
+// Maximum rotation in degrees each step of a rotate gesture covers, so fingers follow the arc closely
+const rotationStepDegrees = 15
+
+// Pinch two fingers together around a point
+func DevicePinch(c *gin.Context) {
+	devicePinchGesture(c, "pinch")
+}
+
+// Spread two fingers apart around a point
+func DeviceZoom(c *gin.Context) {
+	devicePinchGesture(c, "zoom")
+}
+
+func devicePinchGesture(c *gin.Context, gesture string) {
+	udid := c.Param("udid")
+	device := devices.DeviceMap[udid]
+
+	var requestBody models.PinchGestureData
+	if err := json.NewDecoder(c.Request.Body).Decode(&requestBody); err != nil {
+		device.Logger.LogError("appium_interact", fmt.Sprintf("Failed to decode request body when performing %s - %s", gesture, err))
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	if requestBody.Distance <= closedPinchDistance {
+		c.String(http.StatusBadRequest, fmt.Sprintf("`distance` must be greater than %v", closedPinchDistance))
+		return
+	}
+
+	converter, err := newCoordinateConverter(device, requestBody.CoordinateSpaceData)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	requestBody.X, requestBody.Y = converter.point(requestBody.X, requestBody.Y)
+	requestBody.Distance = converter.distance(requestBody.Distance)
+
+	device.Logger.LogInfo("appium_interact", fmt.Sprintf("Performing %s at X:%.3f Y:%.3f with distance %.3f", gesture, requestBody.X, requestBody.Y, requestBody.Distance))
+
+	startDistance, endDistance := requestBody.Distance, float64(closedPinchDistance)
+	if gesture == "zoom" {
+		startDistance, endDistance = endDistance, startDistance
+	}
+	pointers := pinchPointers(requestBody.X, requestBody.Y, startDistance, endDistance, requestBody.Angle, gestureDuration(requestBody.Duration))
+
+	performGesture(c, device, gesture, pointers)
+}
+
+// Rotate two fingers around a point
+func DeviceRotateGesture(c *gin.Context) {
+	udid := c.Param("udid")
+	device := devices.DeviceMap[udid]
+
+	var requestBody models.RotateGestureData
+	if err := json.NewDecoder(c.Request.Body).Decode(&requestBody); err != nil {
+		device.Logger.LogError("appium_interact", fmt.Sprintf("Failed to decode request body when performing rotate gesture - %s", err))
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	if requestBody.Radius <= 0 {
+		c.String(http.StatusBadRequest, "`radius` must be greater than 0")
+		return
+	}
+	if requestBody.Rotation == 0 {
+		c.String(http.StatusBadRequest, "`rotation` must not be 0")
+		return
+	}
+
+	converter, err := newCoordinateConverter(device, requestBody.CoordinateSpaceData)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	requestBody.X, requestBody.Y = converter.point(requestBody.X, requestBody.Y)
+	requestBody.Radius = converter.distance(requestBody.Radius)
+
+	device.Logger.LogInfo("appium_interact", fmt.Sprintf("Rotating %.1f degrees around X:%.3f Y:%.3f", requestBody.Rotation, requestBody.X, requestBody.Y))
+
+	pointers := rotatePointers(requestBody.X, requestBody.Y, requestBody.Radius, requestBody.Rotation, gestureDuration(requestBody.Duration))
+
+	performGesture(c, device, "rotate gesture", pointers)
+}
+
+// Perform a gesture with a custom path for each finger
+func DeviceGesture(c *gin.Context) {
+	udid := c.Param("udid")
+	device := devices.DeviceMap[udid]
+
+	var requestBody models.GestureData
+	if err := json.NewDecoder(c.Request.Body).Decode(&requestBody); err != nil {
+		device.Logger.LogError("appium_interact", fmt.Sprintf("Failed to decode request body when performing gesture - %s", err))
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateGesturePointers(requestBody.Pointers); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	converter, err := newCoordinateConverter(device, requestBody.CoordinateSpaceData)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	device.Logger.LogInfo("appium_interact", fmt.Sprintf("Performing %v finger gesture", len(requestBody.Pointers)))
+
+	performGesture(c, device, "gesture", converter.paths(requestBody.Pointers))
+}
+
+// Send the gesture to the device and relay the response
+func performGesture(c *gin.Context, device *models.Device, gesture string, pointers [][]models.GesturePoint) {
+	gestureResp, err := appiumGesture(device, pointers)
+	if err != nil {
+		device.Logger.LogError("appium_interact", fmt.Sprintf("Failed to perform %s - %s", gesture, err))
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer gestureResp.Body.Close()
+
+	body, err := io.ReadAll(gestureResp.Body)
+	if err != nil {
+		device.Logger.LogError("appium_interact", fmt.Sprintf("Failed to perform %s - %s", gesture, err))
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	copyHeaders(c.Writer.Header(), gestureResp.Header)
+	c.Writer.WriteHeader(gestureResp.StatusCode)
+	fmt.Fprint(c.Writer, string(body))
+}
+
+// Check the pointer paths of a gesture before any actions are built from them
+func validateGesturePointers(pointers [][]models.GesturePoint) error {
+	if len(pointers) == 0 || len(pointers) > maxGesturePointers {
+		return fmt.Errorf("`pointers` must contain between 1 and %v pointer paths", maxGesturePointers)
+	}
+	for i, path := range pointers {
+		if len(path) == 0 {
+			return fmt.Errorf("Path of pointer %v has no points", i)
+		}
+		for _, point := range path {
+			if point.Duration < 0 {
+				return fmt.Errorf("Path of pointer %v has a negative duration", i)
+			}
+		}
+	}
+	return nil
+}
+
+// Perform a multi-pointer W3C actions gesture
+// With custom WebDriverAgent the actions are sent directly to WebDriverAgent instead of going through Appium
+func appiumGesture(device *models.Device, pointers [][]models.GesturePoint) (*http.Response, error) {
+	actionJSON, err := json.MarshalIndent(gestureActions(pointers), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Config.EnvConfig.UseCustomWDA && device.OS == "ios" {
+		return wdaRequest(device, http.MethodPost, fmt.Sprintf("session/%s/actions", device.WDASessionID), bytes.NewReader(actionJSON))
+	}
+	return appiumRequest(device, http.MethodPost, "actions", bytes.NewReader(actionJSON))
+}
+
+// Build a W3C touch pointer input source for each finger path
+func gestureActions(pointers [][]models.GesturePoint) models.GesturePointerActions {
+	var actions models.GesturePointerActions
+	for i, path := range pointers {
+		pointerActions := []models.GestureAction{
+			gestureMove(path[0].X, path[0].Y, 0),
+			{
+				Type:   "pointerDown",
+				Button: 0,
+			},
+		}
+		for _, point := range path[1:] {
+			pointerActions = append(pointerActions, gestureMove(point.X, point.Y, point.Duration))
+		}
+		// A single point path is a touch and hold for the point duration
+		if len(path) == 1 && path[0].Duration > 0 {
+			pointerActions = append(pointerActions, models.GestureAction{
+				Type:     "pause",
+				Duration: path[0].Duration,
+			})
+		}
+		pointerActions = append(pointerActions, models.GestureAction{
+			Type:     "pointerUp",
+			Duration: 0,
+		})
+
+		actions.Actions = append(actions.Actions, models.GesturePointerAction{
+			Type: "pointer",
+			ID:   fmt.Sprintf("finger%v", i+1),
+			Parameters: models.DeviceActionParameters{
+				PointerType: "touch",
+			},
+			Actions: pointerActions,
+		})
+	}
+	return actions
+}
+
+// Pointer move to a viewport point, the coordinates are always sent even when 0
+func gestureMove(x, y float64, duration int) models.GestureAction {
+	x, y = gestureCoordinate(x), gestureCoordinate(y)
+	return models.GestureAction{
+		Type:     "pointerMove",
+		Duration: duration,
+		Origin:   "viewport",
+		X:        &x,
+		Y:        &y,
+	}
+}
+
+// Paths for two fingers moving on opposite sides of the center from startDistance to endDistance apart
+func pinchPointers(x, y, startDistance, endDistance, angle float64, duration int) [][]models.GesturePoint {
+	radians := angle * math.Pi / 180
+	dx, dy := math.Cos(radians)/2, math.Sin(radians)/2
+
+	return [][]models.GesturePoint{
+		{
+			{X: x - dx*startDistance, Y: y - dy*startDistance},
+			{X: x - dx*endDistance, Y: y - dy*endDistance, Duration: duration},
+		},
+		{
+			{X: x + dx*startDistance, Y: y + dy*startDistance},
+			{X: x + dx*endDistance, Y: y + dy*endDistance, Duration: duration},
+		},
+	}
+}
+
+// Paths for two fingers moving along a circle around the center in steps
+func rotatePointers(x, y, radius, rotation float64, duration int) [][]models.GesturePoint {
+	steps := int(math.Ceil(math.Abs(rotation) / rotationStepDegrees))
+	stepDuration := duration / steps
+
+	pointers := make([][]models.GesturePoint, 2)
+	for finger := 0; finger < 2; finger++ {
+		// Fingers start on opposite sides of the circle
+		startAngle := float64(finger) * 180
+		for step := 0; step <= steps; step++ {
+			radians := (startAngle + rotation*float64(step)/float64(steps)) * math.Pi / 180
+			point := models.GesturePoint{
+				X: x + radius*math.Cos(radians),
+				Y: y + radius*math.Sin(radians),
+			}
+			if step > 0 {
+				point.Duration = stepDuration
+			}
+			pointers[finger] = append(pointers[finger], point)
+		}
+	}
+	return pointers
+}
+
+func gestureDuration(duration int) int {
+	if duration <= 0 {
+		return defaultGestureDuration
+	}
+	return duration
+}
+
+// W3C actions expect whole pixel coordinates inside the viewport
+func gestureCoordinate(coordinate float64) float64 {
+	return math.Max(0, math.Round(coordinate))
+}
@@ -0,0 +1,22 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shamanec/GADS-devices-provider/grid"
+)
+
+// Serve Selenium Grid requests for the relay node of a device
+func GridNode(c *gin.Context) {
+	udid := c.Param("udid")
+
+	node, ok := grid.GetNode(udid)
+	if !ok {
+		w3cErrorResponse(c, http.StatusNotFound, w3cUnknownError, fmt.Sprintf("No Selenium Grid node is running for device `%s`", udid))
+		return
+	}
+
+	node.ServeHTTP(c.Writer, c.Request, c.Param("nodePath"))
+}
@@ -11,6 +11,8 @@ func HandleRequests() *gin.Engine {
 	// Start sending live provider data
 	// to connected clients
 	go sendProviderLiveData()
+	// Start serving queued new session requests
+	go processSessionQueue()
 
 	r := gin.Default()
 	rConfig := cors.DefaultConfig()
@@ -22,6 +24,18 @@ func HandleRequests() *gin.Engine {
 	r.GET("/info-ws", GetProviderDataWS)
 	r.GET("/devices", DevicesInfo)
 	r.POST("/uploadFile", UploadFile)
+	r.GET("/apps", GetApps)
+
+	// Selenium Grid 4 relay nodes, one per device
+	r.Any("/grid/node/:udid/*nodePath", GridNode)
+
+	// W3C WebDriver hub that routes sessions to matching devices
+	hubGroup := r.Group("/wd/hub")
+	hubGroup.GET("/status", HubStatus)
+	hubGroup.GET("/queue", HubSessionQueue)
+	hubGroup.POST("/session", HubCreateSession)
+	hubGroup.DELETE("/session/:sessionID", HubDeleteSession)
+	hubGroup.Any("/session/:sessionID/*proxyPath", HubProxy)
 
 	pprofGroup := r.Group("/debug/pprof")
 	{
@@ -42,17 +56,41 @@ func HandleRequests() *gin.Engine {
 	deviceGroup := r.Group("/device")
 	deviceGroup.GET("/:udid/info", DeviceInfo)
 	deviceGroup.GET("/:udid/health", DeviceHealth)
+	deviceGroup.GET("/:udid/appium-logs", DeviceAppiumLogs)
+	deviceGroup.GET("/:udid/appium-logs-ws", DeviceAppiumLogsWS)
+	deviceGroup.GET("/:udid/session-queue", DeviceSessionQueue)
+	deviceGroup.GET("/:udid/session-videos", DeviceSessionVideos)
+	deviceGroup.GET("/:udid/session-videos/:sessionID", DownloadSessionVideo)
 	deviceGroup.POST("/:udid/tap", DeviceTap)
 	deviceGroup.POST("/:udid/touchAndHold", DeviceTouchAndHold)
 	deviceGroup.POST("/:udid/home", DeviceHome)
+	deviceGroup.POST("/:udid/key", DeviceKey)
+	deviceGroup.GET("/:udid/control-ws", DeviceControlWS)
+	deviceGroup.GET("/:udid/orientation", DeviceOrientation)
+	deviceGroup.POST("/:udid/orientation", DeviceSetOrientation)
+	deviceGroup.GET("/:udid/clipboard", DeviceClipboard)
+	deviceGroup.POST("/:udid/clipboard", DeviceSetClipboard)
+	deviceGroup.GET("/:udid/geolocation", DeviceGeolocation)
+	deviceGroup.POST("/:udid/geolocation", DeviceSetGeolocation)
 	deviceGroup.POST("/:udid/lock", DeviceLock)
 	deviceGroup.POST("/:udid/unlock", DeviceUnlock)
 	deviceGroup.POST("/:udid/screenshot", DeviceScreenshot)
+	deviceGroup.GET("/:udid/screenshot", DeviceScreenshotImage)
 	deviceGroup.POST("/:udid/swipe", DeviceSwipe)
+	deviceGroup.POST("/:udid/pinch", DevicePinch)
+	deviceGroup.POST("/:udid/zoom", DeviceZoom)
+	deviceGroup.POST("/:udid/rotate-gesture", DeviceRotateGesture)
+	deviceGroup.POST("/:udid/gesture", DeviceGesture)
 	deviceGroup.GET("/:udid/appiumSource", DeviceAppiumSource)
+	deviceGroup.GET("/:udid/ui-hierarchy", DeviceUIHierarchy)
+	deviceGroup.GET("/:udid/element-at", DeviceElementAt)
 	deviceGroup.POST("/:udid/typeText", DeviceTypeText)
 	deviceGroup.POST("/:udid/clearText", DeviceClearText)
 	deviceGroup.Any("/:udid/appium/*proxyPath", AppiumReverseProxy)
+	deviceGroup.GET("/:udid/stream-settings", DeviceStreamSettings)
+	deviceGroup.POST("/:udid/stream-settings", DeviceUpdateStreamSettings)
+	deviceGroup.GET("/:udid/stream-stats", DeviceStreamStats)
+	deviceGroup.GET("/:udid/stream-snapshot", DeviceStreamSnapshot)
 	deviceGroup.GET("/:udid/android-stream", AndroidStreamProxy)
 	deviceGroup.GET("/:udid/android-stream-mjpeg", AndroidStreamMJPEG)
 	if config.Config.EnvConfig.UseGadsIosStream {
@@ -63,6 +101,11 @@ func HandleRequests() *gin.Engine {
 		deviceGroup.GET("/:udid/ios-stream-mjpeg", IOSStreamMJPEGWda)
 	}
 	deviceGroup.POST("/:udid/uninstallApp", UninstallApp)
+	deviceGroup.POST("/:udid/app/launch", DeviceLaunchApp)
+	deviceGroup.POST("/:udid/app/activate", DeviceActivateApp)
+	deviceGroup.POST("/:udid/app/terminate", DeviceTerminateApp)
+	deviceGroup.GET("/:udid/app/state", DeviceAppState)
+	deviceGroup.POST("/:udid/app/open-url", DeviceOpenURL)
 	deviceGroup.POST("/:udid/installApp", InstallApp)
 	deviceGroup.POST("/:udid/reset", ResetDevice)
 	deviceGroup.POST("/:udid/uploadFile", UploadFile)
@@ -0,0 +1,234 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shamanec/GADS-devices-provider/devices"
+	"github.com/shamanec/GADS-devices-provider/logger"
+	"github.com/shamanec/GADS-devices-provider/models"
+)
+
+// Report if the provider hub can currently accept new sessions
+func HubStatus(c *gin.Context) {
+	freeDevices := 0
+	for _, device := range devices.DeviceMap {
+		if isDeviceFree(device) {
+			freeDevices++
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"value": gin.H{
+			"ready":   freeDevices > 0,
+			"message": fmt.Sprintf("%v of %v devices available", freeDevices, len(devices.DeviceMap)),
+		},
+	})
+}
+
+// Create a new session on a free device that matches the requested capabilities
+// If all matching devices are busy the request waits in the session queue
+func HubCreateSession(c *gin.Context) {
+	payload, ok := readNewSessionPayload(c)
+	if !ok {
+		return
+	}
+
+	capabilitySets := requestedCapabilitySets(payload)
+	if !anyDeviceMatches(capabilitySets) {
+		w3cErrorResponse(c, http.StatusInternalServerError, w3cSessionNotCreated, "No device matches the requested capabilities")
+		return
+	}
+
+	request := &queuedSessionRequest{
+		capabilitySets: capabilitySets,
+	}
+	device, err := waitForDevice(c.Request.Context(), request)
+	if err != nil {
+		w3cErrorResponse(c, http.StatusInternalServerError, w3cSessionNotCreated, fmt.Sprintf("All devices matching the requested capabilities are busy - %s", err))
+		return
+	}
+
+	createDeviceSession(c, device, payload)
+}
+
+// Proxy a session command to the Appium server of the device the session is running on
+func HubProxy(c *gin.Context) {
+	sessionID := c.Param("sessionID")
+
+	device := getSessionDevice(sessionID)
+	if device == nil {
+		w3cErrorResponse(c, http.StatusNotFound, w3cInvalidSessionID, fmt.Sprintf("Session `%s` does not exist on this provider", sessionID))
+		return
+	}
+
+	path := fmt.Sprintf("/session/%s%s", sessionID, c.Param("proxyPath"))
+	proxy := newAppiumProxy("http://localhost:"+device.AppiumPort, path)
+	proxy.ServeHTTP(c.Writer, c.Request)
+}
+
+// Delete a session on its device and free the device for new hub sessions
+func HubDeleteSession(c *gin.Context) {
+	sessionID := c.Param("sessionID")
+
+	device := getSessionDevice(sessionID)
+	if device == nil {
+		w3cErrorResponse(c, http.StatusNotFound, w3cInvalidSessionID, fmt.Sprintf("Session `%s` does not exist on this provider", sessionID))
+		return
+	}
+
+	proxy := newAppiumProxy("http://localhost:"+device.AppiumPort, "/session/"+sessionID)
+	proxy.ServeHTTP(c.Writer, c.Request)
+
+	releaseSession(sessionID)
+	logger.ProviderLogger.LogInfo("hub", fmt.Sprintf("Deleted hub session `%s` on device `%s`", sessionID, device.UDID))
+}
+
+// Get the W3C capability sets a new session request can be satisfied with
+// Each firstMatch entry is merged with alwaysMatch, legacy desiredCapabilities are used if there are no W3C capabilities
+func requestedCapabilitySets(payload map[string]interface{}) []map[string]interface{} {
+	capabilities, ok := payload["capabilities"].(map[string]interface{})
+	if !ok {
+		if desiredCapabilities, ok := payload["desiredCapabilities"].(map[string]interface{}); ok {
+			return []map[string]interface{}{desiredCapabilities}
+		}
+		return []map[string]interface{}{{}}
+	}
+
+	alwaysMatch, _ := capabilities["alwaysMatch"].(map[string]interface{})
+	firstMatch, _ := capabilities["firstMatch"].([]interface{})
+	if len(firstMatch) == 0 {
+		firstMatch = []interface{}{map[string]interface{}{}}
+	}
+
+	var capabilitySets []map[string]interface{}
+	for _, entry := range firstMatch {
+		entryMap, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		merged := make(map[string]interface{})
+		for key, value := range alwaysMatch {
+			merged[key] = value
+		}
+		for key, value := range entryMap {
+			merged[key] = value
+		}
+		capabilitySets = append(capabilitySets, merged)
+	}
+
+	return capabilitySets
+}
+
+// Remove the provider specific `gads:` capabilities before the request is sent to Appium
+func removeProviderCapabilities(payload map[string]interface{}) {
+	removeFrom := func(capabilities map[string]interface{}) {
+		for key := range capabilities {
+			if strings.HasPrefix(key, "gads:") {
+				delete(capabilities, key)
+			}
+		}
+	}
+
+	if capabilities, ok := payload["capabilities"].(map[string]interface{}); ok {
+		if alwaysMatch, ok := capabilities["alwaysMatch"].(map[string]interface{}); ok {
+			removeFrom(alwaysMatch)
+		}
+		if firstMatch, ok := capabilities["firstMatch"].([]interface{}); ok {
+			for _, entry := range firstMatch {
+				if entryMap, ok := entry.(map[string]interface{}); ok {
+					removeFrom(entryMap)
+				}
+			}
+		}
+	}
+	if desiredCapabilities, ok := payload["desiredCapabilities"].(map[string]interface{}); ok {
+		removeFrom(desiredCapabilities)
+	}
+}
+
+// Check if any provider device matches the capabilities, regardless if it is busy
+func anyDeviceMatches(capabilitySets []map[string]interface{}) bool {
+	for _, device := range devices.DeviceMap {
+		if matchesAnyCapabilitySet(device, capabilitySets) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if a device satisfies the requested capabilities
+func deviceMatchesCapabilities(device *models.Device, capabilities map[string]interface{}) bool {
+	if _, platformName, ok := findCapability(capabilities, "platformName"); ok {
+		if !strings.EqualFold(fmt.Sprint(platformName), device.OS) {
+			return false
+		}
+	}
+
+	if _, platformVersion, ok := findCapability(capabilities, "appium:platformVersion"); ok {
+		// Allow requesting only a major or major.minor version
+		requested := fmt.Sprint(platformVersion)
+		if device.OSVersion != requested && !strings.HasPrefix(device.OSVersion, requested+".") {
+			return false
+		}
+	}
+
+	if _, deviceName, ok := findCapability(capabilities, "appium:deviceName"); ok {
+		requested := fmt.Sprint(deviceName)
+		if !strings.EqualFold(requested, device.Name) && !strings.EqualFold(requested, device.Model) {
+			return false
+		}
+	}
+
+	if _, udid, ok := findCapability(capabilities, "appium:udid"); ok {
+		if fmt.Sprint(udid) != device.UDID {
+			return false
+		}
+	}
+
+	if model, ok := capabilities["gads:model"]; ok {
+		if !strings.EqualFold(fmt.Sprint(model), device.Model) {
+			return false
+		}
+	}
+
+	if labels, ok := capabilities["gads:labels"]; ok {
+		for _, label := range capabilityList(labels) {
+			if !containsFold(device.Labels, label) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// Get a capability value that can be provided as a JSON array or a comma separated string as a list
+func capabilityList(value interface{}) []string {
+	var list []string
+	switch typedValue := value.(type) {
+	case []interface{}:
+		for _, item := range typedValue {
+			list = append(list, fmt.Sprint(item))
+		}
+	case string:
+		for _, item := range strings.Split(typedValue, ",") {
+			if strings.TrimSpace(item) != "" {
+				list = append(list, strings.TrimSpace(item))
+			}
+		}
+	}
+	return list
+}
+
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
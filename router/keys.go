@@ -0,0 +1,146 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shamanec/GADS-devices-provider/devices"
+	"github.com/shamanec/GADS-devices-provider/models"
+)
+
+var errUnsupportedKey = errors.New("unsupported key")
+
+// Android keycodes for the cross-platform key names
+var androidKeycodes = map[string]int{
+	"home":           3,
+	"back":           4,
+	"volume_up":      24,
+	"volume_down":    25,
+	"power":          26,
+	"enter":          66,
+	"delete":         67,
+	"media_play":     126,
+	"media_pause":    127,
+	"media_toggle":   85,
+	"media_stop":     86,
+	"media_next":     87,
+	"media_previous": 88,
+	"mute":           164,
+	"app_switch":     187,
+}
+
+// XCUITest hardware buttons for the cross-platform key names
+var iosButtons = map[string]string{
+	"home":        "home",
+	"volume_up":   "volumeUp",
+	"volume_down": "volumeDown",
+}
+
+// XCUITest keyboard keys for the cross-platform key names, typed into the focused element
+var iosKeyboardKeys = map[string]string{
+	"enter":  "\r",
+	"delete": "\u007f",
+}
+
+// Press a hardware key or system button on the device
+func DeviceKey(c *gin.Context) {
+	udid := c.Param("udid")
+	device := devices.DeviceMap[udid]
+
+	var requestBody models.DeviceKeyData
+	if err := json.NewDecoder(c.Request.Body).Decode(&requestBody); err != nil {
+		device.Logger.LogError("appium_interact", fmt.Sprintf("Failed to decode request body when pressing key - %s", err))
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	key := strings.ToLower(requestBody.Key)
+
+	device.Logger.LogInfo("appium_interact", fmt.Sprintf("Pressing key `%s`", key))
+
+	keyResponse, err := appiumKey(device, key)
+	if errors.Is(err, errUnsupportedKey) {
+		c.String(http.StatusBadRequest, fmt.Sprintf("Key `%s` is not supported on %s devices, supported keys are: %s", requestBody.Key, device.OS, strings.Join(supportedKeys(device.OS), ", ")))
+		return
+	}
+	if err != nil {
+		device.Logger.LogError("appium_interact", fmt.Sprintf("Failed to press key `%s` - %s", key, err))
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer keyResponse.Body.Close()
+
+	// Read the response body
+	keyResponseBody, err := io.ReadAll(keyResponse.Body)
+	if err != nil {
+		device.Logger.LogError("appium_interact", fmt.Sprintf("Failed to press key `%s` - %s", key, err))
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	copyHeaders(c.Writer.Header(), keyResponse.Header)
+	c.Writer.WriteHeader(keyResponse.StatusCode)
+	fmt.Fprint(c.Writer, string(keyResponseBody))
+}
+
+// Press a key by its cross-platform name
+// Android keys go through Appium `press_keycode`, iOS keys are sent to WebDriverAgent as button presses or keyboard input
+func appiumKey(device *models.Device, key string) (*http.Response, error) {
+	switch device.OS {
+	case "android":
+		keycode, ok := androidKeycodes[key]
+		if !ok {
+			return nil, errUnsupportedKey
+		}
+
+		requestJSON, err := json.Marshal(models.AndroidKeycodePayload{Keycode: keycode})
+		if err != nil {
+			return nil, err
+		}
+		return appiumRequest(device, http.MethodPost, "appium/device/press_keycode", bytes.NewReader(requestJSON))
+	case "ios":
+		if button, ok := iosButtons[key]; ok {
+			requestJSON, err := json.Marshal(map[string]string{"name": button})
+			if err != nil {
+				return nil, err
+			}
+			return wdaRequest(device, http.MethodPost, fmt.Sprintf("session/%s/wda/pressButton", device.WDASessionID), bytes.NewReader(requestJSON))
+		}
+		if keyboardKey, ok := iosKeyboardKeys[key]; ok {
+			requestJSON, err := json.Marshal(map[string][]string{"value": {keyboardKey}})
+			if err != nil {
+				return nil, err
+			}
+			return wdaRequest(device, http.MethodPost, fmt.Sprintf("session/%s/wda/keys", device.WDASessionID), bytes.NewReader(requestJSON))
+		}
+		return nil, errUnsupportedKey
+	default:
+		return nil, fmt.Errorf("Unsupported device OS: %s", device.OS)
+	}
+}
+
+// Get the sorted key names supported for a device OS
+func supportedKeys(deviceOS string) []string {
+	var keys []string
+	switch deviceOS {
+	case "android":
+		for key := range androidKeycodes {
+			keys = append(keys, key)
+		}
+	case "ios":
+		for key := range iosButtons {
+			keys = append(keys, key)
+		}
+		for key := range iosKeyboardKeys {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -16,6 +16,7 @@ import (
 	"github.com/shamanec/GADS-devices-provider/config"
 	"github.com/shamanec/GADS-devices-provider/devices"
 	"github.com/shamanec/GADS-devices-provider/models"
+	"github.com/shamanec/GADS-devices-provider/recorder"
 	"github.com/shamanec/GADS-devices-provider/util"
 )
 
@@ -49,8 +50,22 @@ func AppiumReverseProxy(c *gin.Context) {
 	target := "http://localhost:" + device.AppiumPort
 	path := c.Param("proxyPath")
 
+	// New session requests wait for the device to be free and have the capability policy applied
+	if c.Request.Method == http.MethodPost && strings.TrimSuffix(path, "/") == "/session" {
+		deviceNewSession(c, device)
+		return
+	}
+
 	proxy := newAppiumProxy(target, path)
 	proxy.ServeHTTP(c.Writer, c.Request)
+
+	// Free the device for queued session requests when a session is deleted
+	if c.Request.Method == http.MethodDelete {
+		pathSegments := strings.Split(strings.Trim(path, "/"), "/")
+		if len(pathSegments) == 2 && pathSegments[0] == "session" {
+			releaseSession(pathSegments[1])
+		}
+	}
 }
 
 func newAppiumProxy(target string, path string) *httputil.ReverseProxy {
@@ -74,18 +89,9 @@ func UploadFile(c *gin.Context) {
 		return
 	}
 
-	allowedExtensions := []string{"ipa", "zip", "apk"}
 	// Check file extension
 	ext := strings.ToLower(filepath.Ext(file.Filename))
-	isAllowed := false
-	for _, allowedExt := range allowedExtensions {
-		if ext == "."+allowedExt {
-			isAllowed = true
-			break
-		}
-	}
-
-	if !isAllowed {
+	if !util.IsAppFile(file.Filename) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "File extension `" + ext + "` not allowed"})
 		return
 	}
@@ -103,7 +109,31 @@ func UploadFile(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "File uploaded successfully", "status": "success", "apps": util.GetAllAppFiles()})
+	metadata, err := util.SaveAppMetadata(file.Filename)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "File uploaded successfully", "status": "success", "app": metadata, "apps": util.GetAllAppFiles()})
+}
+
+// List the uploaded apps with their metadata, optionally only for one platform
+func GetApps(c *gin.Context) {
+	var query models.AppsQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid query parameters - %s", err)})
+		return
+	}
+
+	apps := []models.AppMetadata{}
+	for _, app := range util.GetAllApps() {
+		if query.Platform == "" || app.Platform == query.Platform {
+			apps = append(apps, app)
+		}
+	}
+
+	c.JSON(http.StatusOK, apps)
 }
 
 func GetProviderData(c *gin.Context) {
@@ -218,7 +248,7 @@ func ResetDevice(c *gin.Context) {
 
 	if device, ok := devices.DeviceMap[udid]; ok {
 		device.IsResetting = true
-		device.CtxCancel()
+		devices.CancelDeviceContext(device)
 		device.ProviderState = "init"
 		device.IsResetting = false
 
@@ -228,3 +258,51 @@ func ResetDevice(c *gin.Context) {
 
 	c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Device with udid `%s` does not exist", udid)})
 }
+
+// List the recorded Appium session videos for a device
+func DeviceSessionVideos(c *gin.Context) {
+	udid := c.Param("udid")
+
+	if _, ok := devices.DeviceMap[udid]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Did not find device with udid `%s`", udid)})
+		return
+	}
+
+	videos, err := recorder.GetSessionVideos(udid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, videos)
+}
+
+// Download the recorded video of an Appium session
+func DownloadSessionVideo(c *gin.Context) {
+	udid := c.Param("udid")
+	sessionID := c.Param("sessionID")
+
+	if _, ok := devices.DeviceMap[udid]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Did not find device with udid `%s`", udid)})
+		return
+	}
+
+	// Session IDs are used as file names so don't allow anything that could escape the sessions folder
+	if sessionID != filepath.Base(sessionID) || strings.HasPrefix(sessionID, ".") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid session ID `%s`", sessionID)})
+		return
+	}
+
+	if recorder.IsRecording(udid, sessionID) {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Session `%s` is still being recorded", sessionID)})
+		return
+	}
+
+	videoPath := recorder.SessionVideoPath(udid, sessionID)
+	if _, err := os.Stat(videoPath); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("No recording found for session `%s`", sessionID)})
+		return
+	}
+
+	c.FileAttachment(videoPath, fmt.Sprintf("%s_%s.avi", udid, sessionID))
+}
@@ -0,0 +1,157 @@
+package router
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shamanec/GADS-devices-provider/devices"
+	"github.com/shamanec/GADS-devices-provider/models"
+	"github.com/shamanec/GADS-devices-provider/util"
+)
+
+// JPEG quality used when the request doesn't provide one
+const defaultScreenshotQuality = 80
+
+// Get a screenshot as PNG or JPEG bytes, optionally cropped and scaled down
+// Falls back to adb or go-ios when there is no working Appium session
+func DeviceScreenshotImage(c *gin.Context) {
+	udid := c.Param("udid")
+	device := devices.DeviceMap[udid]
+
+	var query models.ScreenshotQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		c.String(http.StatusBadRequest, fmt.Sprintf("Invalid query parameters - %s", err))
+		return
+	}
+	format, quality, scale, crop, err := parseScreenshotQuery(query)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	screenshot, source, err := takeScreenshot(device)
+	if err != nil {
+		device.Logger.LogError("screenshot", fmt.Sprintf("Failed to get screenshot from device - %s", err))
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.Header("X-Screenshot-Source", source)
+
+	// Send the original PNG if there is nothing to change
+	if format == "png" && scale == 1 && crop.Empty() && bytes.HasPrefix(screenshot, []byte("\x89PNG")) {
+		c.Data(http.StatusOK, "image/png", screenshot)
+		return
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(screenshot))
+	if err != nil {
+		device.Logger.LogError("screenshot", fmt.Sprintf("Failed to decode %s screenshot - %s", source, err))
+		c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to decode screenshot - %s", err))
+		return
+	}
+
+	if !crop.Empty() {
+		img, err = util.CropImage(img, crop)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if scale < 1 {
+		bounds := img.Bounds()
+		width := int(math.Max(1, math.Round(float64(bounds.Dx())*scale)))
+		height := int(math.Max(1, math.Round(float64(bounds.Dy())*scale)))
+		img = util.ResizeImage(img, width, height)
+	}
+
+	encoded, err := util.EncodeImage(img, format, quality)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.Data(http.StatusOK, "image/"+format, encoded)
+}
+
+// Validate the screenshot options and fill in the defaults
+func parseScreenshotQuery(query models.ScreenshotQuery) (string, int, float64, image.Rectangle, error) {
+	format := strings.ToLower(query.Format)
+	switch format {
+	case "", "png":
+		format = "png"
+	case "jpeg", "jpg":
+		format = "jpeg"
+	default:
+		return "", 0, 0, image.Rectangle{}, fmt.Errorf("`format` must be `png` or `jpeg`")
+	}
+
+	quality := query.Quality
+	if quality == 0 {
+		quality = defaultScreenshotQuality
+	}
+	if quality < 1 || quality > 100 {
+		return "", 0, 0, image.Rectangle{}, fmt.Errorf("`quality` must be between 1 and 100")
+	}
+
+	scale := query.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	if scale < 0 || scale > 1 {
+		return "", 0, 0, image.Rectangle{}, fmt.Errorf("`scale` must be greater than 0 and at most 1")
+	}
+
+	var crop image.Rectangle
+	if query.Crop != "" {
+		parts := strings.Split(query.Crop, ",")
+		if len(parts) != 4 {
+			return "", 0, 0, image.Rectangle{}, fmt.Errorf("`crop` must be `x,y,width,height`")
+		}
+		var values [4]int
+		for i, part := range parts {
+			value, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil || value < 0 {
+				return "", 0, 0, image.Rectangle{}, fmt.Errorf("`crop` values must be non-negative integers")
+			}
+			values[i] = value
+		}
+		if values[2] == 0 || values[3] == 0 {
+			return "", 0, 0, image.Rectangle{}, fmt.Errorf("`crop` width and height must be greater than 0")
+		}
+		crop = image.Rect(values[0], values[1], values[0]+values[2], values[1]+values[3])
+	}
+
+	return format, quality, scale, crop, nil
+}
+
+// Take a screenshot through Appium, or with adb/go-ios if Appium has no session or fails
+// Returns the image bytes and the source they came from
+func takeScreenshot(device *models.Device) ([]byte, string, error) {
+	if device.AppiumSessionID != "" {
+		var encoded string
+		var screenshot []byte
+		err := appiumValueRequest(device, http.MethodGet, "screenshot", nil, &encoded)
+		if err == nil {
+			screenshot, err = base64.StdEncoding.DecodeString(encoded)
+		}
+		if err == nil {
+			return screenshot, "appium", nil
+		}
+		device.Logger.LogWarn("screenshot", fmt.Sprintf("Could not get screenshot through Appium, falling back - %s", err))
+	}
+
+	if device.OS == "android" {
+		screenshot, err := devices.TakeScreenshotAndroid(device)
+		return screenshot, "adb", err
+	}
+	screenshot, err := devices.TakeScreenshotIOS(device)
+	return screenshot, "go-ios", err
+}
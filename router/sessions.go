@@ -0,0 +1,447 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shamanec/GADS-devices-provider/config"
+	"github.com/shamanec/GADS-devices-provider/devices"
+	"github.com/shamanec/GADS-devices-provider/logger"
+	"github.com/shamanec/GADS-devices-provider/models"
+)
+
+// Time after creation during which a session is not checked against the device Appium session
+// Appium logs the created session slightly after responding so the device session ID might not be updated yet
+const sessionGracePeriod = 10 * time.Second
+
+type deviceSession struct {
+	device    *models.Device
+	sessionID string
+	createdAt time.Time
+}
+
+// Sessions created through the provider by device UDID
+// A session with empty ID is a reservation for a session that is still being created
+var deviceSessions = make(map[string]*deviceSession)
+
+// New session requests waiting for a device, in order of arrival
+var sessionQueue []*queuedSessionRequest
+
+// Guards both deviceSessions and sessionQueue
+var sessionsMu sync.Mutex
+
+// Signals the queue processor that a device might have become free
+var sessionQueueSignal = make(chan struct{}, 1)
+
+type queuedSessionRequest struct {
+	ID             string `json:"id"`
+	UDID           string `json:"udid,omitempty"`
+	QueuedAt       int64  `json:"queued_at"`
+	TimeoutAt      int64  `json:"timeout_at"`
+	Position       int    `json:"position"`
+	capabilitySets []map[string]interface{}
+	ready          chan *models.Device
+}
+
+// Create a new session on a specific device, waiting in the queue if the device is busy
+func deviceNewSession(c *gin.Context, device *models.Device) {
+	payload, ok := readNewSessionPayload(c)
+	if !ok {
+		return
+	}
+
+	request := &queuedSessionRequest{
+		UDID:           device.UDID,
+		capabilitySets: requestedCapabilitySets(payload),
+	}
+	reservedDevice, err := waitForDevice(c.Request.Context(), request)
+	if err != nil {
+		w3cErrorResponse(c, http.StatusInternalServerError, w3cSessionNotCreated, fmt.Sprintf("Device `%s` is busy - %s", device.UDID, err))
+		return
+	}
+
+	createDeviceSession(c, reservedDevice, payload)
+}
+
+// Read and parse the JSON body of a new session request, responding with a W3C error if it is invalid
+func readNewSessionPayload(c *gin.Context) (map[string]interface{}, bool) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		w3cErrorResponse(c, http.StatusBadRequest, w3cInvalidArgument, fmt.Sprintf("Could not read new session request body - %s", err))
+		return nil, false
+	}
+
+	var payload map[string]interface{}
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		w3cErrorResponse(c, http.StatusBadRequest, w3cInvalidArgument, fmt.Sprintf("Could not parse new session request body - %s", err))
+		return nil, false
+	}
+
+	return payload, true
+}
+
+// Forward a new session request to the reserved device Appium server and register the created session
+func createDeviceSession(c *gin.Context, device *models.Device, payload map[string]interface{}) {
+	logger.ProviderLogger.LogInfo("sessions", fmt.Sprintf("Creating session on device `%s`", device.UDID))
+
+	removeProviderCapabilities(payload)
+	body, err := json.Marshal(payload)
+	if err != nil {
+		releaseDevice(device.UDID)
+		w3cErrorResponse(c, http.StatusInternalServerError, w3cUnknownError, fmt.Sprintf("Could not marshal new session request - %s", err))
+		return
+	}
+
+	enforcedBody, err := enforceCapabilityPolicy(device, body)
+	if err != nil {
+		releaseDevice(device.UDID)
+		device.Logger.LogWarn("appium_proxy", fmt.Sprintf("Rejected new session request - %s", err))
+		w3cErrorResponse(c, http.StatusBadRequest, w3cInvalidArgument, err.Error())
+		return
+	}
+
+	sessionResp, err := appiumRequestNoSession(device, http.MethodPost, "session", bytes.NewReader(enforcedBody))
+	if err != nil {
+		releaseDevice(device.UDID)
+		w3cErrorResponse(c, http.StatusInternalServerError, w3cSessionNotCreated, fmt.Sprintf("Could not create session on device `%s` - %s", device.UDID, err))
+		return
+	}
+	defer sessionResp.Body.Close()
+
+	sessionRespBody, err := io.ReadAll(sessionResp.Body)
+	if err != nil {
+		releaseDevice(device.UDID)
+		w3cErrorResponse(c, http.StatusInternalServerError, w3cSessionNotCreated, fmt.Sprintf("Could not read session response from device `%s` - %s", device.UDID, err))
+		return
+	}
+
+	var sessionRespJson struct {
+		Value struct {
+			SessionID string `json:"sessionId"`
+		} `json:"value"`
+	}
+	json.Unmarshal(sessionRespBody, &sessionRespJson)
+
+	if sessionResp.StatusCode != http.StatusOK || sessionRespJson.Value.SessionID == "" {
+		releaseDevice(device.UDID)
+	} else {
+		sessionsMu.Lock()
+		deviceSessions[device.UDID] = &deviceSession{
+			device:    device,
+			sessionID: sessionRespJson.Value.SessionID,
+			createdAt: time.Now(),
+		}
+		sessionsMu.Unlock()
+		logger.ProviderLogger.LogInfo("sessions", fmt.Sprintf("Created session `%s` on device `%s`", sessionRespJson.Value.SessionID, device.UDID))
+	}
+
+	copyHeaders(c.Writer.Header(), sessionResp.Header)
+	c.Writer.WriteHeader(sessionResp.StatusCode)
+	c.Writer.Write(sessionRespBody)
+}
+
+// Wait in the queue until a device for the request is reserved
+// The wait is limited by the `gads:queueTimeout` capability(seconds) or the provider default
+// and is cancelled if the client disconnects
+func waitForDevice(ctx context.Context, request *queuedSessionRequest) (*models.Device, error) {
+	timeout := queueTimeout(request.capabilitySets)
+
+	request.ID = newQueueRequestID()
+	if requestID, ok := firstCapability(request.capabilitySets, "gads:requestId"); ok {
+		request.ID = fmt.Sprint(requestID)
+	}
+	request.QueuedAt = time.Now().UnixMilli()
+	request.TimeoutAt = time.Now().Add(timeout).UnixMilli()
+	request.ready = make(chan *models.Device, 1)
+
+	sessionsMu.Lock()
+	sessionQueue = append(sessionQueue, request)
+	processSessionQueueLocked()
+	sessionsMu.Unlock()
+
+	// The device might have been reserved right away
+	select {
+	case device := <-request.ready:
+		return device, nil
+	default:
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var waitErr error
+	select {
+	case device := <-request.ready:
+		return device, nil
+	case <-timer.C:
+		waitErr = fmt.Errorf("timed out after %v waiting for a free device", timeout)
+	case <-ctx.Done():
+		waitErr = fmt.Errorf("client disconnected while waiting for a free device")
+	}
+
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	if removeQueuedRequestLocked(request) {
+		return nil, waitErr
+	}
+
+	// The request was served while we were giving up
+	// Use the device if the client is still there, otherwise release it for the next request
+	device := <-request.ready
+	if ctx.Err() == nil {
+		return device, nil
+	}
+	delete(deviceSessions, device.UDID)
+	signalSessionQueue()
+	return nil, waitErr
+}
+
+func newQueueRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Get the queue timeout for a request from its capabilities or the provider configuration
+func queueTimeout(capabilitySets []map[string]interface{}) time.Duration {
+	seconds := config.Config.EnvConfig.SessionQueueTimeout
+	if value, ok := firstCapability(capabilitySets, "gads:queueTimeout"); ok {
+		switch typedValue := value.(type) {
+		case float64:
+			seconds = int(typedValue)
+		case string:
+			if parsed, err := strconv.Atoi(typedValue); err == nil {
+				seconds = parsed
+			}
+		}
+	}
+	if seconds < 0 {
+		seconds = 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func firstCapability(capabilitySets []map[string]interface{}, capability string) (interface{}, bool) {
+	for _, capabilities := range capabilitySets {
+		if value, ok := capabilities[capability]; ok {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// Periodically re-check the queue so stale sessions and newly live devices are picked up
+func processSessionQueue() {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-sessionQueueSignal:
+		}
+
+		sessionsMu.Lock()
+		processSessionQueueLocked()
+		sessionsMu.Unlock()
+	}
+}
+
+func signalSessionQueue() {
+	select {
+	case sessionQueueSignal <- struct{}{}:
+	default:
+	}
+}
+
+// Reserve free devices for queued requests in order of arrival
+// Expects sessionsMu to be held
+func processSessionQueueLocked() {
+	if len(sessionQueue) == 0 {
+		return
+	}
+
+	var deviceList []*models.Device
+	for _, device := range devices.DeviceMap {
+		deviceList = append(deviceList, device)
+	}
+	sort.Slice(deviceList, func(i, j int) bool {
+		return deviceList[i].UDID < deviceList[j].UDID
+	})
+
+	var waiting []*queuedSessionRequest
+	for _, request := range sessionQueue {
+		device := findFreeDeviceLocked(request, deviceList)
+		if device == nil {
+			waiting = append(waiting, request)
+			continue
+		}
+
+		deviceSessions[device.UDID] = &deviceSession{device: device, createdAt: time.Now()}
+		request.ready <- device
+	}
+	sessionQueue = waiting
+}
+
+// Find a free device the request can be served with
+// Expects sessionsMu to be held
+func findFreeDeviceLocked(request *queuedSessionRequest, deviceList []*models.Device) *models.Device {
+	for _, device := range deviceList {
+		if request.UDID != "" && device.UDID != request.UDID {
+			continue
+		}
+		if !isDeviceFreeLocked(device) {
+			continue
+		}
+		// Requests for a specific device don't need to match capabilities, the policy is applied when creating the session
+		if request.UDID != "" {
+			return device
+		}
+		for _, capabilities := range request.capabilitySets {
+			if deviceMatchesCapabilities(device, capabilities) {
+				return device
+			}
+		}
+	}
+	return nil
+}
+
+// Remove a request from the queue, returns false if it was already served
+// Expects sessionsMu to be held
+func removeQueuedRequestLocked(request *queuedSessionRequest) bool {
+	for i, queued := range sessionQueue {
+		if queued == request {
+			sessionQueue = append(sessionQueue[:i], sessionQueue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Check if a device is live and not used by a session created through the provider or directly on Appium
+func isDeviceFree(device *models.Device) bool {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	return isDeviceFreeLocked(device)
+}
+
+// Same as isDeviceFree but expects sessionsMu to be held
+// Sessions that no longer match the device Appium session were removed by Appium(timeout, override) and are released
+func isDeviceFreeLocked(device *models.Device) bool {
+	if device.ProviderState != "live" {
+		return false
+	}
+
+	session, ok := deviceSessions[device.UDID]
+	if !ok {
+		// Sessions created directly on the device Appium server are not tracked by the provider
+		return device.AppiumSessionID == ""
+	}
+
+	if session.sessionID != "" && time.Since(session.createdAt) > sessionGracePeriod && device.AppiumSessionID != session.sessionID {
+		logger.ProviderLogger.LogInfo("sessions", fmt.Sprintf("Session `%s` on device `%s` no longer exists in Appium, releasing device", session.sessionID, device.UDID))
+		delete(deviceSessions, device.UDID)
+		return device.AppiumSessionID == ""
+	}
+
+	return false
+}
+
+// Free a device after its session ended or could not be created
+func releaseDevice(udid string) {
+	sessionsMu.Lock()
+	delete(deviceSessions, udid)
+	sessionsMu.Unlock()
+
+	signalSessionQueue()
+}
+
+// Free the device a session was running on, if the session was created through the provider
+func releaseSession(sessionID string) {
+	sessionsMu.Lock()
+	for udid, session := range deviceSessions {
+		if session.sessionID == sessionID {
+			delete(deviceSessions, udid)
+		}
+	}
+	sessionsMu.Unlock()
+
+	signalSessionQueue()
+}
+
+// Get the device a session is running on
+func getSessionDevice(sessionID string) *models.Device {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	for _, session := range deviceSessions {
+		if session.sessionID == sessionID {
+			return session.device
+		}
+	}
+	return nil
+}
+
+// Get the queued new session requests with their positions
+// If udid is provided only requests that can be served by that device are returned
+func getSessionQueue(udid string) []queuedSessionRequest {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	device := devices.DeviceMap[udid]
+
+	queue := []queuedSessionRequest{}
+	for _, request := range sessionQueue {
+		if udid != "" {
+			if request.UDID != "" && request.UDID != udid {
+				continue
+			}
+			if request.UDID == "" && (device == nil || !matchesAnyCapabilitySet(device, request.capabilitySets)) {
+				continue
+			}
+		}
+		queued := *request
+		queued.Position = len(queue) + 1
+		queue = append(queue, queued)
+	}
+	return queue
+}
+
+func matchesAnyCapabilitySet(device *models.Device, capabilitySets []map[string]interface{}) bool {
+	for _, capabilities := range capabilitySets {
+		if deviceMatchesCapabilities(device, capabilities) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the new session requests waiting for a specific device
+func DeviceSessionQueue(c *gin.Context) {
+	udid := c.Param("udid")
+
+	if _, ok := devices.DeviceMap[udid]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Did not find device with udid `%s`", udid)})
+		return
+	}
+
+	c.JSON(http.StatusOK, getSessionQueue(udid))
+}
+
+// Get all new session requests waiting for a device on the provider
+func HubSessionQueue(c *gin.Context) {
+	c.JSON(http.StatusOK, getSessionQueue(""))
+}
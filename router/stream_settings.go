@@ -0,0 +1,54 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shamanec/GADS-devices-provider/devices"
+	"github.com/shamanec/GADS-devices-provider/models"
+)
+
+// Get the current stream settings of the device
+func DeviceStreamSettings(c *gin.Context) {
+	udid := c.Param("udid")
+	device := devices.DeviceMap[udid]
+
+	c.JSON(http.StatusOK, device.StreamSettings)
+}
+
+// Change the stream framerate, quality and scaling of the running device stream
+// Fields that are not provided keep their current value
+func DeviceUpdateStreamSettings(c *gin.Context) {
+	udid := c.Param("udid")
+	device := devices.DeviceMap[udid]
+
+	var requestBody models.StreamSettings
+	if err := json.NewDecoder(c.Request.Body).Decode(&requestBody); err != nil {
+		device.Logger.LogError("stream", fmt.Sprintf("Failed to decode request body when updating stream settings - %s", err))
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	settings := devices.MergeStreamSettings(device.StreamSettings, requestBody)
+	if err := devices.ValidateStreamSettings(settings); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err := devices.UpdateStreamSettings(device, settings)
+	if errors.Is(err, devices.ErrStreamSettingsUnsupported) {
+		c.String(http.StatusNotImplemented, "Stream settings can only be changed at runtime for the WebDriverAgent stream of iOS devices and the screencap stream of Android devices, GADS-stream does not support it")
+		return
+	}
+	if err != nil {
+		device.Logger.LogError("stream", fmt.Sprintf("Failed to update stream settings - %s", err))
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	device.Logger.LogInfo("stream", fmt.Sprintf("Updated stream settings to %v fps, %v quality, %v%% scaling", settings.TargetFPS, settings.JpegQuality, settings.ScalingFactor))
+	c.JSON(http.StatusOK, device.StreamSettings)
+}
@@ -0,0 +1,64 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shamanec/GADS-devices-provider/devices"
+	"github.com/shamanec/GADS-devices-provider/models"
+	"github.com/shamanec/GADS-devices-provider/stream"
+)
+
+// Maximum time to wait for a frame when a snapshot is requested and no stream is open
+const snapshotTimeout = 10 * time.Second
+
+// Get statistics for the open streams of the device and their viewers
+func DeviceStreamStats(c *gin.Context) {
+	udid := c.Param("udid")
+	device := devices.DeviceMap[udid]
+
+	c.JSON(http.StatusOK, stream.DeviceStats(device))
+}
+
+// Get the most recent frame of the device stream as JPEG
+// If no stream is open the upstream is opened just long enough to get a frame
+func DeviceStreamSnapshot(c *gin.Context) {
+	udid := c.Param("udid")
+	device := devices.DeviceMap[udid]
+
+	frame, frameAt, ok := stream.LatestFrame(device)
+	if !ok {
+		var err error
+		frame, err = waitForStreamFrame(c, device)
+		if err != nil {
+			device.Logger.LogError("stream", fmt.Sprintf("Failed getting stream snapshot - %s", err))
+			c.String(http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		frameAt = time.Now()
+	}
+
+	c.Header("X-Frame-Age-Ms", strconv.FormatInt(time.Since(frameAt).Milliseconds(), 10))
+	c.Data(http.StatusOK, "image/jpeg", frame)
+}
+
+// Subscribe to the device stream until the first frame arrives
+func waitForStreamFrame(c *gin.Context, device *models.Device) ([]byte, error) {
+	subscriber, unsubscribe := stream.Subscribe(device, stream.DeviceSource(device), "snapshot", c.ClientIP(), models.StreamViewerQuery{})
+	defer unsubscribe()
+
+	select {
+	case frame, ok := <-subscriber.Frames:
+		if !ok {
+			return nil, fmt.Errorf("Device stream closed before a frame was received")
+		}
+		return frame.Data, nil
+	case <-time.After(snapshotTimeout):
+		return nil, fmt.Errorf("No frame received from the device stream in %v", snapshotTimeout)
+	case <-c.Request.Context().Done():
+		return nil, c.Request.Context().Err()
+	}
+}
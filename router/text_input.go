@@ -0,0 +1,286 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shamanec/GADS-devices-provider/devices"
+	"github.com/shamanec/GADS-devices-provider/models"
+)
+
+// Text input strategies in the order they are tried when none is requested
+const (
+	textStrategyElementValue = "element_value"
+	textStrategyKeyActions   = "key_actions"
+	textStrategyWDAKeys      = "wda_keys"
+	textStrategyADB          = "adb"
+)
+
+var errUnknownTextStrategy = errors.New("unknown text input strategy")
+var errTextStrategyUnavailable = errors.New("text input strategy is not available")
+
+// Special key that can be pressed after the text with each of the strategies
+type textInputKey struct {
+	w3c            string
+	androidKeycode int
+	wda            string
+}
+
+var textInputKeys = map[string]textInputKey{
+	"enter":     {w3c: "\uE007", androidKeycode: 66, wda: "\r"},
+	"tab":       {w3c: "\uE004", androidKeycode: 61, wda: "\t"},
+	"backspace": {w3c: "\uE003", androidKeycode: 67, wda: "\u007f"},
+	"delete":    {w3c: "\uE003", androidKeycode: 67, wda: "\u007f"},
+}
+
+// Type text and special keys on the device, reports the strategy that was used
+func DeviceTypeText(c *gin.Context) {
+	udid := c.Param("udid")
+	device := devices.DeviceMap[udid]
+
+	var requestBody models.TextInputData
+	if err := json.NewDecoder(c.Request.Body).Decode(&requestBody); err != nil {
+		device.Logger.LogError("appium_interact", fmt.Sprintf("Failed to decode request body when typing text - %s", err))
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	if requestBody.Text == "" && len(requestBody.Keys) == 0 {
+		c.String(http.StatusBadRequest, "Provide `text` and/or `keys` to type")
+		return
+	}
+
+	device.Logger.LogInfo("appium_interact", fmt.Sprintf("Typing `%s` with keys %v", requestBody.Text, requestBody.Keys))
+
+	response, err := typeText(device, requestBody)
+	if err != nil {
+		device.Logger.LogError("appium_interact", fmt.Sprintf("Failed to type `%s` - %s", requestBody.Text, err))
+		c.String(textInputStatus(err), err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// Type the text with the requested strategy or try the available strategies in order until one succeeds
+// A strategy that failed after typing part of the text is not followed by the next one
+func typeText(device *models.Device, input models.TextInputData) (models.TextInputResponse, error) {
+	response := models.TextInputResponse{}
+
+	for i, key := range input.Keys {
+		input.Keys[i] = strings.ToLower(key)
+		if _, ok := textInputKeys[input.Keys[i]]; !ok {
+			return response, fmt.Errorf("%w `%s`, supported keys are: backspace, delete, enter, tab", errUnsupportedKey, key)
+		}
+	}
+
+	strategies, err := textInputStrategies(device, input)
+	if err != nil {
+		return response, err
+	}
+
+	var failures []string
+	for _, strategy := range strategies {
+		err = runTextInputStrategy(device, strategy, input)
+		if err == nil {
+			response.Strategy = strategy
+			return response, nil
+		}
+
+		device.Logger.LogWarn("text_input", fmt.Sprintf("Could not type text with strategy `%s` - %s", strategy, err))
+		if response.FailedStrategies == nil {
+			response.FailedStrategies = make(map[string]string)
+		}
+		response.FailedStrategies[strategy] = err.Error()
+		// The next strategy would type the whole text again after the part that was already typed
+		if errors.Is(err, devices.ErrPartialTextInput) {
+			return response, fmt.Errorf("Text input strategy `%s` failed after typing part of the text - %s", strategy, err)
+		}
+		failures = append(failures, fmt.Sprintf("%s: %s", strategy, err))
+	}
+
+	return response, fmt.Errorf("All text input strategies failed - %s", strings.Join(failures, "; "))
+}
+
+// Get the strategies to try for the device based on its current sessions
+func textInputStrategies(device *models.Device, input models.TextInputData) ([]string, error) {
+	available := map[string]bool{
+		textStrategyElementValue: device.AppiumSessionID != "",
+		textStrategyKeyActions:   device.AppiumSessionID != "",
+		textStrategyWDAKeys:      device.OS == "ios" && device.WDASessionID != "",
+		textStrategyADB:          device.OS == "android",
+	}
+
+	if input.Strategy != "" {
+		isAvailable, ok := available[input.Strategy]
+		if !ok {
+			return nil, fmt.Errorf("%w `%s`", errUnknownTextStrategy, input.Strategy)
+		}
+		if !isAvailable {
+			return nil, fmt.Errorf("%w - `%s` can't be used on this device right now", errTextStrategyUnavailable, input.Strategy)
+		}
+		return []string{input.Strategy}, nil
+	}
+
+	var strategies []string
+	for _, strategy := range []string{textStrategyElementValue, textStrategyKeyActions, textStrategyWDAKeys, textStrategyADB} {
+		// Keys can't be sent as an element value so the text and keys are typed in one go with the other strategies
+		if strategy == textStrategyElementValue && len(input.Keys) > 0 {
+			continue
+		}
+		if available[strategy] {
+			strategies = append(strategies, strategy)
+		}
+	}
+	if len(strategies) == 0 {
+		return nil, fmt.Errorf("%w - no Appium session is running and there is no fallback for the device", errTextStrategyUnavailable)
+	}
+	return strategies, nil
+}
+
+func runTextInputStrategy(device *models.Device, strategy string, input models.TextInputData) error {
+	switch strategy {
+	case textStrategyElementValue:
+		return elementValueInput(device, input)
+	case textStrategyKeyActions:
+		return keyActionsInput(device, input.Text, input.Keys)
+	case textStrategyWDAKeys:
+		return wdaKeysInput(device, input)
+	case textStrategyADB:
+		return adbTextInput(device, input)
+	default:
+		return fmt.Errorf("%w `%s`", errUnknownTextStrategy, strategy)
+	}
+}
+
+// Set the text as value of the focused element, keys are pressed afterwards with key actions
+func elementValueInput(device *models.Device, input models.TextInputData) error {
+	if input.Text != "" {
+		var activeElement map[string]string
+		err := appiumValueRequest(device, http.MethodGet, "element/active", nil, &activeElement)
+		if err != nil {
+			return fmt.Errorf("Could not get focused element - %s", err)
+		}
+		elementID := activeElement["element-6066-11e4-a6ab-4d4b5ba6d3f1"]
+		if elementID == "" {
+			elementID = activeElement["ELEMENT"]
+		}
+		if elementID == "" {
+			return fmt.Errorf("No element is focused")
+		}
+
+		err = appiumValueRequest(device, http.MethodPost, fmt.Sprintf("element/%s/value", elementID), models.AppiumTypeText{Text: input.Text}, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(input.Keys) > 0 {
+		err := keyActionsInput(device, "", input.Keys)
+		if err != nil && input.Text != "" {
+			return fmt.Errorf("%w - %s", devices.ErrPartialTextInput, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// Type the text and keys as W3C key actions to whatever has focus
+func keyActionsInput(device *models.Device, text string, keys []string) error {
+	var values []string
+	for _, r := range text {
+		if r == '\n' {
+			values = append(values, textInputKeys["enter"].w3c)
+			continue
+		}
+		values = append(values, string(r))
+	}
+	for _, key := range keys {
+		values = append(values, textInputKeys[key].w3c)
+	}
+
+	var actions []models.KeyAction
+	for _, value := range values {
+		actions = append(actions,
+			models.KeyAction{Type: "keyDown", Value: value},
+			models.KeyAction{Type: "keyUp", Value: value},
+		)
+	}
+
+	payload := models.KeyActions{
+		Actions: []models.KeyActionSequence{
+			{
+				Type:    "key",
+				ID:      "keyboard",
+				Actions: actions,
+			},
+		},
+	}
+	return appiumValueRequest(device, http.MethodPost, "actions", payload, nil)
+}
+
+// Type the text and keys through the WebDriverAgent session keyboard
+func wdaKeysInput(device *models.Device, input models.TextInputData) error {
+	var values []string
+	for _, r := range input.Text {
+		values = append(values, string(r))
+	}
+	for _, key := range input.Keys {
+		values = append(values, textInputKeys[key].wda)
+	}
+
+	requestJSON, err := json.Marshal(map[string][]string{"value": values})
+	if err != nil {
+		return err
+	}
+
+	resp, err := wdaRequest(device, http.MethodPost, fmt.Sprintf("session/%s/wda/keys", device.WDASessionID), bytes.NewReader(requestJSON))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("WebDriverAgent returned status %v - %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// Type the text and keys with adb, does not need an Appium session
+func adbTextInput(device *models.Device, input models.TextInputData) error {
+	if input.Text != "" {
+		err := devices.InputTextAndroid(device, input.Text)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, key := range input.Keys {
+		err := devices.PressKeycodeAndroid(device, textInputKeys[key].androidKeycode)
+		if err != nil {
+			if input.Text != "" || i > 0 {
+				return fmt.Errorf("%w - %s", devices.ErrPartialTextInput, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Response status for a text input error
+func textInputStatus(err error) int {
+	switch {
+	case errors.Is(err, errUnsupportedKey), errors.Is(err, errUnknownTextStrategy):
+		return http.StatusBadRequest
+	case errors.Is(err, errTextStrategyUnavailable):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
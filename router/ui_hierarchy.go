@@ -0,0 +1,303 @@
+package router
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shamanec/GADS-devices-provider/devices"
+	"github.com/shamanec/GADS-devices-provider/models"
+)
+
+var androidBoundsRegex = regexp.MustCompile(`\[(-?\d+),(-?\d+)\]\[(-?\d+),(-?\d+)\]`)
+
+// Element of the raw page source with its attributes, kept for building locators
+type sourceNode struct {
+	tag      string
+	attrs    map[string]string
+	element  *models.UIElement
+	children []*sourceNode
+}
+
+// Get the UI hierarchy of the current screen as a normalized JSON tree
+func DeviceUIHierarchy(c *gin.Context) {
+	udid := c.Param("udid")
+	device := devices.DeviceMap[udid]
+
+	root, err := getSourceTree(device)
+	if err != nil {
+		device.Logger.LogError("appium_interact", fmt.Sprintf("Failed to get UI hierarchy - %s", err))
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, root.element)
+}
+
+// Get the deepest element at a point along with suggested locators for it
+func DeviceElementAt(c *gin.Context) {
+	udid := c.Param("udid")
+	device := devices.DeviceMap[udid]
+
+	var query models.ElementAtQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		c.String(http.StatusBadRequest, fmt.Sprintf("Invalid query parameters - %s", err))
+		return
+	}
+	if c.Query("x") == "" || c.Query("y") == "" {
+		c.String(http.StatusBadRequest, "Missing `x` or `y` query parameter")
+		return
+	}
+
+	converter, err := newCoordinateConverter(device, query.CoordinateSpaceData)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	x, y := converter.point(query.X, query.Y)
+
+	root, err := getSourceTree(device)
+	if err != nil {
+		device.Logger.LogError("appium_interact", fmt.Sprintf("Failed to get UI hierarchy - %s", err))
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	node := deepestNodeAt(root, int(x), int(y))
+	if node == nil {
+		c.String(http.StatusNotFound, fmt.Sprintf("No element found at X:%v Y:%v", int(x), int(y)))
+		return
+	}
+
+	// Return the element itself, its children can be large and are available in the hierarchy
+	element := *node.element
+	element.Children = nil
+	c.JSON(http.StatusOK, models.ElementAtResponse{
+		Element:  &element,
+		Locators: suggestLocators(device, root, node),
+	})
+}
+
+// Get the Appium page source and parse it into a tree
+func getSourceTree(device *models.Device) (*sourceNode, error) {
+	var source string
+	err := appiumValueRequest(device, http.MethodGet, "source", nil, &source)
+	if err != nil {
+		return nil, err
+	}
+	return parseSource(device, source)
+}
+
+// Parse UiAutomator2 or XCUITest XML page source into a tree with normalized elements
+func parseSource(device *models.Device, source string) (*sourceNode, error) {
+	decoder := xml.NewDecoder(strings.NewReader(source))
+
+	var root *sourceNode
+	var stack []*sourceNode
+	// Count of children per tag for each open element, used for XPath indexes
+	var tagCounts []map[string]int
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse page source - %s", err)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			node := &sourceNode{
+				tag:   t.Name.Local,
+				attrs: make(map[string]string),
+			}
+			for _, attr := range t.Attr {
+				node.attrs[attr.Name.Local] = attr.Value
+			}
+
+			xpath := "/" + node.tag
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				counts := tagCounts[len(tagCounts)-1]
+				counts[node.tag]++
+				xpath = fmt.Sprintf("%s/%s[%v]", parent.element.XPath, node.tag, counts[node.tag])
+				parent.children = append(parent.children, node)
+			} else {
+				root = node
+			}
+			node.element = normalizeElement(device, node, xpath)
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.element.Children = append(parent.element.Children, node.element)
+			}
+
+			stack = append(stack, node)
+			tagCounts = append(tagCounts, make(map[string]int))
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+				tagCounts = tagCounts[:len(tagCounts)-1]
+			}
+		}
+	}
+
+	if root == nil {
+		return nil, fmt.Errorf("Page source is empty")
+	}
+	return root, nil
+}
+
+// Build the normalized element from the platform specific attributes
+func normalizeElement(device *models.Device, node *sourceNode, xpath string) *models.UIElement {
+	attrs := node.attrs
+	element := &models.UIElement{
+		Class:   node.tag,
+		XPath:   xpath,
+		Visible: true,
+		Enabled: attrs["enabled"] != "false",
+	}
+
+	if device.OS == "android" {
+		if attrs["class"] != "" {
+			element.Class = attrs["class"]
+		}
+		element.Text = attrs["text"]
+		element.ID = attrs["resource-id"]
+		element.AccessibilityID = attrs["content-desc"]
+		element.Visible = attrs["displayed"] != "false"
+		if match := androidBoundsRegex.FindStringSubmatch(attrs["bounds"]); match != nil {
+			x1, _ := strconv.Atoi(match[1])
+			y1, _ := strconv.Atoi(match[2])
+			x2, _ := strconv.Atoi(match[3])
+			y2, _ := strconv.Atoi(match[4])
+			element.Bounds = models.UIBounds{X: x1, Y: y1, Width: x2 - x1, Height: y2 - y1}
+		}
+		return element
+	}
+
+	if attrs["type"] != "" {
+		element.Class = attrs["type"]
+	}
+	element.Text = attrs["label"]
+	if element.Text == "" {
+		element.Text = attrs["value"]
+	}
+	element.AccessibilityID = attrs["name"]
+	element.Visible = attrs["visible"] != "false"
+	element.Bounds.X, _ = strconv.Atoi(attrs["x"])
+	element.Bounds.Y, _ = strconv.Atoi(attrs["y"])
+	element.Bounds.Width, _ = strconv.Atoi(attrs["width"])
+	element.Bounds.Height, _ = strconv.Atoi(attrs["height"])
+	return element
+}
+
+// Find the deepest visible element containing the point
+// Later siblings are drawn on top so they are checked first
+func deepestNodeAt(node *sourceNode, x, y int) *sourceNode {
+	for i := len(node.children) - 1; i >= 0; i-- {
+		if found := deepestNodeAt(node.children[i], x, y); found != nil {
+			return found
+		}
+	}
+
+	bounds := node.element.Bounds
+	if node.element.Visible && bounds.Width > 0 && bounds.Height > 0 &&
+		x >= bounds.X && x < bounds.X+bounds.Width && y >= bounds.Y && y < bounds.Y+bounds.Height {
+		return node
+	}
+	return nil
+}
+
+// Suggest locators for an element, unique ones first
+func suggestLocators(device *models.Device, root, node *sourceNode) []models.UILocator {
+	var locators []models.UILocator
+
+	if node.element.AccessibilityID != "" {
+		locators = append(locators, models.UILocator{
+			Strategy: "accessibility id",
+			Value:    node.element.AccessibilityID,
+			Unique:   countNodes(root, func(n *sourceNode) bool { return n.element.AccessibilityID == node.element.AccessibilityID }) == 1,
+		})
+	}
+
+	if node.element.ID != "" {
+		locators = append(locators, models.UILocator{
+			Strategy: "id",
+			Value:    node.element.ID,
+			Unique:   countNodes(root, func(n *sourceNode) bool { return n.element.ID == node.element.ID }) == 1,
+		})
+	}
+
+	locators = append(locators, models.UILocator{
+		Strategy: "xpath",
+		Value:    minimalXPath(device, root, node),
+		Unique:   true,
+	})
+
+	// Keep the order but move unique locators to the front
+	var unique, other []models.UILocator
+	for _, locator := range locators {
+		if locator.Unique {
+			unique = append(unique, locator)
+		} else {
+			other = append(other, locator)
+		}
+	}
+	return append(unique, other...)
+}
+
+// Get the shortest attribute based XPath that matches only the element, or its absolute XPath
+func minimalXPath(device *models.Device, root, node *sourceNode) string {
+	attributes := []string{"resource-id", "content-desc", "text"}
+	if device.OS == "ios" {
+		attributes = []string{"name", "label", "value"}
+	}
+
+	for _, attribute := range attributes {
+		value := node.attrs[attribute]
+		if value == "" {
+			continue
+		}
+		literal, ok := xpathLiteral(value)
+		if !ok {
+			continue
+		}
+
+		matches := countNodes(root, func(n *sourceNode) bool {
+			return n.tag == node.tag && n.attrs[attribute] == value
+		})
+		if matches == 1 {
+			return fmt.Sprintf("//%s[@%s=%s]", node.tag, attribute, literal)
+		}
+	}
+
+	return node.element.XPath
+}
+
+// Quote a value for XPath 1.0, which has no escaping, so values with both quote types can't be used
+func xpathLiteral(value string) (string, bool) {
+	if !strings.Contains(value, `"`) {
+		return `"` + value + `"`, true
+	}
+	if !strings.Contains(value, `'`) {
+		return `'` + value + `'`, true
+	}
+	return "", false
+}
+
+func countNodes(node *sourceNode, matches func(*sourceNode) bool) int {
+	count := 0
+	if matches(node) {
+		count++
+	}
+	for _, child := range node.children {
+		count += countNodes(child, matches)
+	}
+	return count
+}
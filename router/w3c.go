@@ -0,0 +1,34 @@
+package router
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// W3C WebDriver error codes used in provider responses
+const (
+	w3cInvalidArgument   = "invalid argument"
+	w3cSessionNotCreated = "session not created"
+	w3cInvalidSessionID  = "invalid session id"
+	w3cUnknownError      = "unknown error"
+)
+
+type W3CError struct {
+	Error      string `json:"error"`
+	Message    string `json:"message"`
+	Stacktrace string `json:"stacktrace"`
+}
+
+type W3CErrorResponse struct {
+	Value W3CError `json:"value"`
+}
+
+// Respond with a W3C WebDriver formatted error so Appium/Selenium clients can parse it
+func w3cErrorResponse(c *gin.Context, status int, errorCode, message string) {
+	c.JSON(status, W3CErrorResponse{
+		Value: W3CError{
+			Error:      errorCode,
+			Message:    message,
+			Stacktrace: "",
+		},
+	})
+}
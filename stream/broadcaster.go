@@ -0,0 +1,443 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image/jpeg"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shamanec/GADS-devices-provider/config"
+	"github.com/shamanec/GADS-devices-provider/models"
+	"github.com/shamanec/GADS-devices-provider/util"
+)
+
+// Upstream stream sources of a device
+const (
+	SourceAndroid = "android"
+	SourceGadsIOS = "gads_ios"
+	SourceWDA     = "wda"
+	// Degraded Android stream from adb screenshots when GADS-stream can't run on the device
+	SourceScreencap = "screencap"
+)
+
+// Get the upstream source the stream endpoints and session recordings of the device use
+func DeviceSource(device *models.Device) string {
+	if device.OS == "android" {
+		if device.StreamType == models.StreamTypeScreencap {
+			return SourceScreencap
+		}
+		return SourceAndroid
+	}
+	if config.Config.EnvConfig.UseGadsIosStream {
+		return SourceGadsIOS
+	}
+	return SourceWDA
+}
+
+// Delay before the first upstream reconnect attempt, doubled on each failed attempt up to the max delay
+const streamReconnectMinDelay = 500 * time.Millisecond
+const streamReconnectMaxDelay = 10 * time.Second
+
+// Consecutive failed reconnect attempts after which the viewers are disconnected
+const streamReconnectMaxAttempts = 20
+
+// Frames buffered per subscriber, older frames are dropped for subscribers that can't keep up
+const subscriberFrameBuffer = 2
+
+// JPEG quality of frames scaled down for a viewer that did not request a quality
+const defaultStreamViewerQuality = 75
+
+// Broadcasters by device UDID and stream source
+var streamBroadcasters = make(map[string]*frameBroadcaster)
+var streamBroadcastersMu sync.Mutex
+
+// Reads JPEG frames from a single upstream device stream and fans them out to all subscribed viewers
+type frameBroadcaster struct {
+	key         string
+	device      *models.Device
+	source      string
+	mu          sync.Mutex
+	subscribers map[*Subscriber]struct{}
+	cancel      context.CancelFunc
+	sequence    uint64
+	encodedMu   sync.Mutex
+	encoded     map[streamProfile]*encodedFrame
+	startedAt   time.Time
+	totalFrames uint64
+	totalBytes  uint64
+	lastFrame   Frame
+	lastFrameAt time.Time
+	samples     []frameSample
+	status      models.StreamStatus
+}
+
+// Frame of the upstream stream, the sequence identifies it in the re-encoded frames cache
+type Frame struct {
+	sequence uint64
+	Data     []byte
+}
+
+// Output size and quality of a viewer, viewers with the same profile share the re-encoded frames
+type streamProfile struct {
+	maxWidth int
+	quality  int
+}
+
+// Latest frame re-encoded for a profile
+type encodedFrame struct {
+	mu       sync.Mutex
+	sequence uint64
+	data     []byte
+}
+
+// Viewer of a device stream
+type Subscriber struct {
+	id          string
+	viewerType  string
+	remoteAddr  string
+	query       models.StreamViewerQuery
+	connectedAt time.Time
+	Frames      chan Frame
+	Status      chan models.StreamStatus
+	broadcaster *frameBroadcaster
+	profile     streamProfile
+	interval    time.Duration
+	lastSent    time.Time
+	sent        atomic.Uint64
+	dropped     atomic.Uint64
+	skipped     atomic.Uint64
+	lastSentAt  atomic.Int64
+}
+
+// Used to give each viewer a unique ID
+var subscriberCounter atomic.Uint64
+
+// Subscribe to the frames of a device stream source with the viewer options
+// The upstream connection is opened for the first subscriber and closed when the last one unsubscribes
+// The frames channel is closed when the upstream stream ends
+func Subscribe(device *models.Device, source, viewerType, remoteAddr string, query models.StreamViewerQuery) (*Subscriber, func()) {
+	key := device.UDID + "/" + source
+	subscriber := &Subscriber{
+		id:          fmt.Sprintf("%s-%v", viewerType, subscriberCounter.Add(1)),
+		viewerType:  viewerType,
+		remoteAddr:  remoteAddr,
+		query:       query,
+		connectedAt: time.Now(),
+		Frames:      make(chan Frame, subscriberFrameBuffer),
+		Status:      make(chan models.StreamStatus, 1),
+		profile:     streamProfile{maxWidth: query.MaxWidth, quality: query.Quality},
+	}
+	if query.FPS > 0 {
+		subscriber.interval = time.Second / time.Duration(query.FPS)
+	}
+
+	streamBroadcastersMu.Lock()
+	broadcaster, ok := streamBroadcasters[key]
+	if !ok {
+		ctx, cancel := context.WithCancel(device.Context)
+		broadcaster = &frameBroadcaster{
+			key:         key,
+			device:      device,
+			source:      source,
+			subscribers: make(map[*Subscriber]struct{}),
+			cancel:      cancel,
+			encoded:     make(map[streamProfile]*encodedFrame),
+			startedAt:   time.Now(),
+			status:      models.StreamStatus{Type: "stream_status", Status: models.StreamStatusConnecting},
+		}
+		streamBroadcasters[key] = broadcaster
+		go broadcaster.run(ctx)
+	}
+	subscriber.broadcaster = broadcaster
+	broadcaster.mu.Lock()
+	broadcaster.subscribers[subscriber] = struct{}{}
+	// Let viewers joining during a reconnect know the stream is not live
+	if broadcaster.status.Status == models.StreamStatusReconnecting {
+		subscriber.Status <- broadcaster.status
+	}
+	broadcaster.mu.Unlock()
+	streamBroadcastersMu.Unlock()
+
+	unsubscribe := func() {
+		broadcaster.unsubscribe(subscriber)
+	}
+	return subscriber, unsubscribe
+}
+
+func (b *frameBroadcaster) unsubscribe(subscriber *Subscriber) {
+	streamBroadcastersMu.Lock()
+	defer streamBroadcastersMu.Unlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subscribers[subscriber]; !ok {
+		return
+	}
+	delete(b.subscribers, subscriber)
+	close(subscriber.Frames)
+	b.releaseProfile(subscriber.profile)
+
+	if len(b.subscribers) == 0 {
+		b.device.Logger.LogInfo("stream", fmt.Sprintf("Last viewer left, closing `%s` upstream stream", b.source))
+		recordHealth(b.device, models.StreamStatusIdle, nil, false)
+		b.stop()
+	}
+}
+
+// Remove the broadcaster from the registry and close the upstream
+// Must be called with the registry lock held
+func (b *frameBroadcaster) stop() {
+	if streamBroadcasters[b.key] == b {
+		delete(streamBroadcasters, b.key)
+	}
+	b.cancel()
+}
+
+// Read the upstream until the broadcaster is stopped, reconnecting with backoff when it fails
+// Subscribers are released when the broadcaster is stopped or the upstream can't be reconnected
+func (b *frameBroadcaster) run(ctx context.Context) {
+	b.device.Logger.LogInfo("stream", fmt.Sprintf("Opening `%s` upstream stream", b.source))
+
+	attempt := 0
+	for {
+		receivedFrames := false
+		err := b.readUpstream(ctx, func(frame []byte) {
+			receivedFrames = true
+			b.publish(frame)
+		})
+		if ctx.Err() != nil {
+			break
+		}
+		if err == nil {
+			err = fmt.Errorf("Upstream stream ended")
+		}
+
+		// Start the backoff over if the previous connection worked
+		if receivedFrames {
+			attempt = 0
+		}
+		attempt++
+		if attempt > streamReconnectMaxAttempts {
+			b.device.Logger.LogError("stream", fmt.Sprintf("Upstream `%s` stream failed, giving up after %v reconnect attempts - %s", b.source, streamReconnectMaxAttempts, err))
+			recordHealth(b.device, models.StreamStatusDown, err, false)
+			break
+		}
+
+		delay := streamReconnectMinDelay << (attempt - 1)
+		if delay > streamReconnectMaxDelay || delay <= 0 {
+			delay = streamReconnectMaxDelay
+		}
+		b.device.Logger.LogWarn("stream", fmt.Sprintf("Upstream `%s` stream failed, reconnecting in %v (attempt %v) - %s", b.source, delay, attempt, err))
+		recordHealth(b.device, models.StreamStatusReconnecting, err, true)
+		b.setStatus(models.StreamStatus{
+			Type:      "stream_status",
+			Status:    models.StreamStatusReconnecting,
+			Attempt:   attempt,
+			RetryInMs: delay.Milliseconds(),
+			Error:     err.Error(),
+		})
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	streamBroadcastersMu.Lock()
+	b.stop()
+	streamBroadcastersMu.Unlock()
+
+	b.mu.Lock()
+	for subscriber := range b.subscribers {
+		close(subscriber.Frames)
+		delete(b.subscribers, subscriber)
+	}
+	b.mu.Unlock()
+}
+
+// Read frames from the upstream source until it fails or the context is cancelled
+func (b *frameBroadcaster) readUpstream(ctx context.Context, publish func([]byte)) error {
+	switch b.source {
+	case SourceAndroid:
+		// Websocket messages are not reused so they don't need to be copied
+		return ReadWebsocket(ctx, "localhost:"+b.device.StreamPort, func(frame []byte) error {
+			publish(frame)
+			return nil
+		})
+	case SourceGadsIOS:
+		return ReadJPEG(ctx, "localhost:"+b.device.StreamPort, publishCopy(publish))
+	case SourceWDA:
+		return ReadMJPEG(ctx, "http://localhost:"+b.device.WDAStreamPort, publishCopy(publish))
+	case SourceScreencap:
+		// Each screencap frame is a new encoded image so it doesn't need to be copied
+		return ReadScreencap(ctx, b.device.UDID, func() models.StreamSettings {
+			return b.device.StreamSettings
+		}, func(frame []byte) error {
+			publish(frame)
+			return nil
+		})
+	default:
+		return fmt.Errorf("Unknown stream source `%s`", b.source)
+	}
+}
+
+// Set the stream status and send it to all subscribers, replacing a status they did not receive yet
+func (b *frameBroadcaster) setStatus(status models.StreamStatus) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.setStatusLocked(status)
+}
+
+// Must be called with the subscribers lock held
+func (b *frameBroadcaster) setStatusLocked(status models.StreamStatus) {
+	b.status = status
+	for subscriber := range b.subscribers {
+		select {
+		case <-subscriber.Status:
+		default:
+		}
+		subscriber.Status <- status
+	}
+}
+
+// Send a frame to all subscribers without blocking
+// A subscriber with a full buffer drops its oldest frame so it always gets the latest one
+func (b *frameBroadcaster) publish(data []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.sequence++
+	frame := Frame{sequence: b.sequence, Data: data}
+	b.recordFrame(frame)
+
+	// The first frame after connecting or reconnecting means the stream is live
+	if b.status.Status != models.StreamStatusLive {
+		if b.status.Status == models.StreamStatusReconnecting {
+			b.device.Logger.LogInfo("stream", fmt.Sprintf("Upstream `%s` stream reconnected", b.source))
+		}
+		recordHealth(b.device, models.StreamStatusLive, nil, false)
+		b.setStatusLocked(models.StreamStatus{Type: "stream_status", Status: models.StreamStatusLive})
+	}
+
+	for subscriber := range b.subscribers {
+		select {
+		case subscriber.Frames <- frame:
+			continue
+		default:
+		}
+
+		select {
+		case <-subscriber.Frames:
+			subscriber.dropped.Add(1)
+		default:
+		}
+		select {
+		case subscriber.Frames <- frame:
+		default:
+			subscriber.dropped.Add(1)
+		}
+	}
+}
+
+// Drop the cached frames of a profile no remaining subscriber uses
+// Must be called with the subscribers lock held
+func (b *frameBroadcaster) releaseProfile(profile streamProfile) {
+	for subscriber := range b.subscribers {
+		if subscriber.profile == profile {
+			return
+		}
+	}
+
+	b.encodedMu.Lock()
+	delete(b.encoded, profile)
+	b.encodedMu.Unlock()
+}
+
+// Get the frame to send to the viewer, false if the frame is skipped to keep the viewer fps limit
+// Frames are re-encoded once per profile, concurrent viewers with the same profile wait for and reuse the result
+func (s *Subscriber) Render(frame Frame) ([]byte, bool, error) {
+	if s.interval > 0 {
+		now := time.Now()
+		if now.Sub(s.lastSent) < s.interval {
+			s.skipped.Add(1)
+			return nil, false, nil
+		}
+		s.lastSent = now
+	}
+
+	if s.profile == (streamProfile{}) {
+		return frame.Data, true, nil
+	}
+
+	b := s.broadcaster
+	b.encodedMu.Lock()
+	encoded, ok := b.encoded[s.profile]
+	if !ok {
+		encoded = &encodedFrame{}
+		b.encoded[s.profile] = encoded
+	}
+	b.encodedMu.Unlock()
+
+	encoded.mu.Lock()
+	defer encoded.mu.Unlock()
+
+	if encoded.data != nil && encoded.sequence == frame.sequence {
+		return encoded.data, true, nil
+	}
+
+	data, err := reencodeFrame(frame.Data, s.profile)
+	if err != nil {
+		return nil, false, err
+	}
+	encoded.sequence = frame.sequence
+	encoded.data = data
+	return data, true, nil
+}
+
+// Count a frame that was written to the viewer
+func (s *Subscriber) MarkSent() {
+	s.sent.Add(1)
+	s.lastSentAt.Store(time.Now().UnixNano())
+}
+
+// Scale a JPEG frame down to the profile max width and encode it with the profile quality
+func reencodeFrame(data []byte, profile streamProfile) ([]byte, error) {
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode stream frame - %s", err)
+	}
+
+	width := img.Bounds().Dx()
+	height := img.Bounds().Dy()
+	resize := profile.maxWidth > 0 && width > profile.maxWidth
+	if !resize && profile.quality == 0 {
+		return data, nil
+	}
+	if resize {
+		img = util.ResizeImage(img, profile.maxWidth, height*profile.maxWidth/width)
+	}
+
+	quality := profile.quality
+	if quality == 0 {
+		quality = defaultStreamViewerQuality
+	}
+	return util.EncodeImage(img, "jpeg", quality)
+}
+
+// Copy frames from the stream readers before publishing because their buffers are reused for the next frame
+func publishCopy(publish func([]byte)) func([]byte) error {
+	return func(frame []byte) error {
+		data := make([]byte, len(frame))
+		copy(data, frame)
+		publish(data)
+		return nil
+	}
+}
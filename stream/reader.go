@@ -0,0 +1,295 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"strings"
+	"sync"
+)
+
+// Initial size of the pooled read buffers, grown as needed for larger frames
+const initialBufferSize = 256 * 1024
+
+// Frames larger than this are treated as a corrupted stream
+const maxFrameSize = 32 * 1024 * 1024
+
+// Minimum number of bytes read from the connection at once
+const minReadSize = 32 * 1024
+
+var ErrFrameTooLarge = errors.New("frame is larger than the maximum frame size")
+
+// Read buffers shared between frame readers so reconnecting streams don't allocate new ones
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, initialBufferSize)
+		return &buffer
+	},
+}
+
+// Reads single frames from a stream
+// The returned frame is only valid until the next ReadFrame or Close call, copy it to keep it
+type FrameReader interface {
+	ReadFrame() ([]byte, error)
+	Close()
+}
+
+// Reads JPEG images concatenated in a raw byte stream
+// Frames are split by walking the JPEG segment structure so markers inside segments like EXIF thumbnails don't end a frame early
+type JPEGReader struct {
+	r      io.Reader
+	buffer *[]byte
+	// Unconsumed data is buffer[start:end]
+	start int
+	end   int
+}
+
+func NewJPEGReader(r io.Reader) *JPEGReader {
+	return &JPEGReader{
+		r:      r,
+		buffer: bufferPool.Get().(*[]byte),
+	}
+}
+
+// Return the read buffer to the pool, the reader can't be used afterwards
+func (jr *JPEGReader) Close() {
+	if jr.buffer != nil {
+		bufferPool.Put(jr.buffer)
+		jr.buffer = nil
+	}
+}
+
+func (jr *JPEGReader) ReadFrame() ([]byte, error) {
+	if jr.buffer == nil {
+		return nil, fmt.Errorf("JPEGReader: Reader is closed")
+	}
+
+	for {
+		// Skip anything before the start of image marker
+		soi := bytes.Index((*jr.buffer)[jr.start:jr.end], []byte{0xFF, 0xD8})
+		if soi < 0 {
+			// Keep a trailing 0xFF in case it is the first half of the marker
+			if jr.end > jr.start && (*jr.buffer)[jr.end-1] == 0xFF {
+				jr.start = jr.end - 1
+			} else {
+				jr.start = jr.end
+			}
+			if err := jr.fill(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		jr.start += soi
+
+		length, restart, err := jr.frameLength()
+		if err != nil {
+			return nil, err
+		}
+		if restart {
+			// Corrupted frame, look for the next start of image after the current one
+			jr.start += 2
+			continue
+		}
+
+		frame := (*jr.buffer)[jr.start : jr.start+length]
+		jr.start += length
+		return frame, nil
+	}
+}
+
+// Walk the segments of the JPEG at the buffer start and get its length including the end of image marker
+// Returns restart when the data is not a valid JPEG
+func (jr *JPEGReader) frameLength() (int, bool, error) {
+	pos := 2
+	for {
+		if err := jr.ensure(pos + 2); err != nil {
+			return 0, false, err
+		}
+		data := (*jr.buffer)[jr.start:jr.end]
+		if data[pos] != 0xFF {
+			return 0, true, nil
+		}
+
+		marker := data[pos+1]
+		switch {
+		case marker == 0xFF:
+			// Fill byte before a marker
+			pos++
+		case marker == 0xD9:
+			return pos + 2, false, nil
+		case marker == 0xD8:
+			// A new image started before the previous one ended
+			return 0, true, nil
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			// Markers without a length
+			pos += 2
+		default:
+			if err := jr.ensure(pos + 4); err != nil {
+				return 0, false, err
+			}
+			data = (*jr.buffer)[jr.start:jr.end]
+			segmentLength := int(data[pos+2])<<8 | int(data[pos+3])
+			if segmentLength < 2 {
+				return 0, true, nil
+			}
+			pos += 2 + segmentLength
+
+			// Entropy coded data follows the start of scan header until the next marker
+			if marker == 0xDA {
+				next, err := jr.scanEntropyData(pos)
+				if err != nil {
+					return 0, false, err
+				}
+				pos = next
+			}
+		}
+
+		if pos > maxFrameSize {
+			return 0, false, ErrFrameTooLarge
+		}
+	}
+}
+
+// Find the position of the first marker after the entropy coded data starting at pos
+// 0xFF00 is an escaped data byte and restart markers are part of the scan data
+func (jr *JPEGReader) scanEntropyData(pos int) (int, error) {
+	for {
+		if err := jr.ensure(pos + 2); err != nil {
+			return 0, err
+		}
+		data := (*jr.buffer)[jr.start:jr.end]
+
+		index := bytes.IndexByte(data[pos:len(data)-1], 0xFF)
+		if index < 0 {
+			// Keep the last byte in case it is the start of a marker
+			pos = len(data) - 1
+			if pos > maxFrameSize {
+				return 0, ErrFrameTooLarge
+			}
+			if err := jr.ensure(pos + 2); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		pos += index
+
+		next := data[pos+1]
+		if next == 0x00 || (next >= 0xD0 && next <= 0xD7) {
+			pos += 2
+			continue
+		}
+		return pos, nil
+	}
+}
+
+// Make sure at least n unconsumed bytes are buffered
+func (jr *JPEGReader) ensure(n int) error {
+	for jr.end-jr.start < n {
+		if err := jr.fill(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read more data into the buffer, moving the unconsumed data to the front or growing the buffer when needed
+func (jr *JPEGReader) fill() error {
+	buffer := *jr.buffer
+	if jr.start > 0 {
+		copy(buffer, buffer[jr.start:jr.end])
+		jr.end -= jr.start
+		jr.start = 0
+	}
+	if len(buffer)-jr.end < minReadSize {
+		if len(buffer) >= maxFrameSize+minReadSize {
+			return ErrFrameTooLarge
+		}
+		grown := make([]byte, len(buffer)*2)
+		copy(grown, buffer[:jr.end])
+		*jr.buffer = grown
+		buffer = grown
+	}
+
+	n, err := jr.r.Read(buffer[jr.end:])
+	jr.end += n
+	if err != nil && n > 0 {
+		// Return the error on the next read so the buffered data is processed first
+		return nil
+	}
+	return err
+}
+
+// Reads frames from a multipart/x-mixed-replace stream like the WebDriverAgent MJPEG server
+type MultipartReader struct {
+	mr     *multipart.Reader
+	buffer *bytes.Buffer
+}
+
+var multipartBufferPool = sync.Pool{
+	New: func() interface{} {
+		return bytes.NewBuffer(make([]byte, 0, initialBufferSize))
+	},
+}
+
+func NewMultipartReader(r io.Reader, boundary string) *MultipartReader {
+	return &MultipartReader{
+		mr:     multipart.NewReader(r, boundary),
+		buffer: multipartBufferPool.Get().(*bytes.Buffer),
+	}
+}
+
+// Return the read buffer to the pool, the reader can't be used afterwards
+func (mr *MultipartReader) Close() {
+	if mr.buffer != nil {
+		multipartBufferPool.Put(mr.buffer)
+		mr.buffer = nil
+	}
+}
+
+func (mr *MultipartReader) ReadFrame() ([]byte, error) {
+	if mr.buffer == nil {
+		return nil, fmt.Errorf("MultipartReader: Reader is closed")
+	}
+
+	for {
+		part, err := mr.mr.NextPart()
+		if err != nil {
+			return nil, err
+		}
+
+		mr.buffer.Reset()
+		_, err = mr.buffer.ReadFrom(io.LimitReader(part, maxFrameSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if mr.buffer.Len() > maxFrameSize {
+			return nil, ErrFrameTooLarge
+		}
+		// Skip empty parts some servers send as keep alive
+		if mr.buffer.Len() == 0 {
+			continue
+		}
+		return mr.buffer.Bytes(), nil
+	}
+}
+
+// Get the multipart boundary from a Content-Type header
+// Leading dashes are removed because WebDriverAgent includes them in the boundary parameter
+func MultipartBoundary(contentType string) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("MultipartBoundary: Could not parse content type `%s` - %s", contentType, err)
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return "", fmt.Errorf("MultipartBoundary: Content type `%s` is not multipart", mediaType)
+	}
+
+	boundary := strings.TrimPrefix(params["boundary"], "--")
+	if boundary == "" {
+		return "", fmt.Errorf("MultipartBoundary: Content type `%s` has no boundary", contentType)
+	}
+	return boundary, nil
+}
@@ -0,0 +1,229 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// Encode a small single color JPEG
+func testJPEG(t *testing.T, width, height int, fill color.Color) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, fill)
+		}
+	}
+
+	var buffer bytes.Buffer
+	if err := jpeg.Encode(&buffer, img, nil); err != nil {
+		t.Fatalf("Could not encode test JPEG - %s", err)
+	}
+	return buffer.Bytes()
+}
+
+// Insert an application segment right after the start of image marker
+func withSegment(frame []byte, marker byte, payload []byte) []byte {
+	segmentLength := len(payload) + 2
+	segment := append([]byte{0xFF, marker, byte(segmentLength >> 8), byte(segmentLength)}, payload...)
+
+	result := append([]byte{}, frame[:2]...)
+	result = append(result, segment...)
+	return append(result, frame[2:]...)
+}
+
+// JPEG with an EXIF segment containing a complete thumbnail JPEG with its own start and end of image markers
+func withThumbnail(frame, thumbnail []byte) []byte {
+	return withSegment(frame, 0xE1, append([]byte("Exif\x00\x00"), thumbnail...))
+}
+
+// Reader that returns the data in two reads split at the offset
+func splitReader(data []byte, offset int) io.Reader {
+	return io.MultiReader(bytes.NewReader(data[:offset]), bytes.NewReader(data[offset:]))
+}
+
+// Reader producing zero bytes, which are never a JPEG marker
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestJPEGReader(t *testing.T) {
+	red := testJPEG(t, 32, 24, color.RGBA{R: 255, A: 255})
+	blue := testJPEG(t, 16, 16, color.RGBA{B: 255, A: 255})
+	thumbnail := testJPEG(t, 8, 8, color.RGBA{G: 255, A: 255})
+	withExif := withThumbnail(red, thumbnail)
+
+	// Larger than the initial buffer so the buffer has to grow
+	large := blue
+	for i := 0; i < 10; i++ {
+		large = withSegment(large, 0xE2, bytes.Repeat([]byte{0xAB}, 60000))
+	}
+
+	// Offset of the end of image marker of the first frame, a split there leaves 0xFF at the end of the first read
+	eoiSplit := len(red) - 1
+
+	tests := []struct {
+		name   string
+		reader io.Reader
+		frames [][]byte
+	}{
+		{
+			name:   "concatenated frames",
+			reader: bytes.NewReader(concat(red, blue)),
+			frames: [][]byte{red, blue},
+		},
+		{
+			name:   "embedded EXIF thumbnail",
+			reader: bytes.NewReader(concat(withExif, blue)),
+			frames: [][]byte{withExif, blue},
+		},
+		{
+			name:   "end of image marker split across reads",
+			reader: splitReader(concat(red, blue), eoiSplit),
+			frames: [][]byte{red, blue},
+		},
+		{
+			name:   "start of image marker split across reads",
+			reader: splitReader(concat(red, blue), len(red)+1),
+			frames: [][]byte{red, blue},
+		},
+		{
+			name:   "every marker split across reads",
+			reader: iotest.OneByteReader(bytes.NewReader(concat(withExif, blue))),
+			frames: [][]byte{withExif, blue},
+		},
+		{
+			name:   "leading garbage",
+			reader: bytes.NewReader(concat([]byte{0x00, 0xFF, 0x12, 0xFF, 0xFF, 0xD9, 0x42}, red)),
+			frames: [][]byte{red},
+		},
+		{
+			name:   "leading garbage ending with half a marker",
+			reader: splitReader(concat([]byte{0x01, 0x02, 0xFF}, red), 3),
+			frames: [][]byte{red},
+		},
+		{
+			name:   "truncated frame followed by a complete one",
+			reader: bytes.NewReader(concat(red[:len(red)/2], blue)),
+			frames: [][]byte{blue},
+		},
+		{
+			name:   "frame larger than the initial buffer",
+			reader: bytes.NewReader(concat(large, red)),
+			frames: [][]byte{large, red},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := NewJPEGReader(test.reader)
+			defer reader.Close()
+
+			for i, expected := range test.frames {
+				frame, err := reader.ReadFrame()
+				if err != nil {
+					t.Fatalf("Could not read frame %v - %s", i, err)
+				}
+				if !bytes.Equal(frame, expected) {
+					t.Fatalf("Frame %v has %v bytes, expected %v", i, len(frame), len(expected))
+				}
+			}
+
+			if _, err := reader.ReadFrame(); err != io.EOF {
+				t.Errorf("Read after the last frame returned `%v`, expected EOF", err)
+			}
+		})
+	}
+}
+
+func TestJPEGReaderFrameTooLarge(t *testing.T) {
+	// Start of scan followed by entropy data that never ends
+	header := []byte{0xFF, 0xD8, 0xFF, 0xDA, 0x00, 0x02}
+	reader := NewJPEGReader(io.MultiReader(bytes.NewReader(header), io.LimitReader(zeroReader{}, 2*maxFrameSize)))
+	defer reader.Close()
+
+	if _, err := reader.ReadFrame(); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("Oversized frame returned `%v`, expected ErrFrameTooLarge", err)
+	}
+}
+
+func TestMultipartReader(t *testing.T) {
+	red := testJPEG(t, 32, 24, color.RGBA{R: 255, A: 255})
+	blue := testJPEG(t, 16, 16, color.RGBA{B: 255, A: 255})
+
+	// WebDriverAgent style stream with an empty keep alive part between the frames
+	body := concat(
+		[]byte("--BoundaryString\r\nContent-Type: image/jpeg\r\n\r\n"), red,
+		[]byte("\r\n--BoundaryString\r\nContent-Type: image/jpeg\r\n\r\n"),
+		[]byte("\r\n--BoundaryString\r\nContent-Type: image/jpeg\r\n\r\n"), blue,
+		[]byte("\r\n--BoundaryString--\r\n"),
+	)
+
+	boundary, err := MultipartBoundary("multipart/x-mixed-replace; boundary=--BoundaryString")
+	if err != nil {
+		t.Fatalf("Could not get the multipart boundary - %s", err)
+	}
+	reader := NewMultipartReader(iotest.HalfReader(bytes.NewReader(body)), boundary)
+	defer reader.Close()
+
+	for i, expected := range [][]byte{red, blue} {
+		frame, err := reader.ReadFrame()
+		if err != nil {
+			t.Fatalf("Could not read frame %v - %s", i, err)
+		}
+		if !bytes.Equal(frame, expected) {
+			t.Fatalf("Frame %v has %v bytes, expected %v", i, len(frame), len(expected))
+		}
+	}
+
+	if _, err := reader.ReadFrame(); err != io.EOF {
+		t.Errorf("Read after the last frame returned `%v`, expected EOF", err)
+	}
+}
+
+func TestMultipartBoundary(t *testing.T) {
+	tests := []struct {
+		contentType string
+		boundary    string
+		err         string
+	}{
+		{contentType: "multipart/x-mixed-replace; boundary=--BoundaryString", boundary: "BoundaryString"},
+		{contentType: "multipart/x-mixed-replace; boundary=frame", boundary: "frame"},
+		{contentType: `multipart/x-mixed-replace;boundary="--quoted"`, boundary: "quoted"},
+		{contentType: "image/jpeg", err: "is not multipart"},
+		{contentType: "multipart/x-mixed-replace", err: "has no boundary"},
+		{contentType: "multipart/x-mixed-replace; boundary=--", err: "has no boundary"},
+		{contentType: "", err: "Could not parse content type"},
+	}
+
+	for _, test := range tests {
+		boundary, err := MultipartBoundary(test.contentType)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Content type `%s` returned error `%v`, expected `%s`", test.contentType, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Content type `%s` returned error - %s", test.contentType, err)
+			continue
+		}
+		if boundary != test.boundary {
+			t.Errorf("Content type `%s` returned boundary `%s`, expected `%s`", test.contentType, boundary, test.boundary)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/png"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/shamanec/GADS-devices-provider/models"
+	"github.com/shamanec/GADS-devices-provider/util"
+)
+
+// Raw `screencap` pixel formats
+const (
+	screencapFormatRGBA = 1
+	screencapFormatRGBX = 2
+	screencapFormatBGRA = 5
+)
+
+// Produce JPEG frames from repeated `adb exec-out screencap` for Android devices that can't run GADS-stream
+// The settings are read for each frame so changes apply at runtime, the fps is a maximum as screencap is slow
+func ReadScreencap(ctx context.Context, udid string, settings func() models.StreamSettings, handleFrame func([]byte) error) error {
+	usePNG := false
+	for {
+		started := time.Now()
+		current := settings()
+
+		img, err := screencap(ctx, udid, &usePNG)
+		if err != nil {
+			return err
+		}
+
+		if current.ScalingFactor > 0 && current.ScalingFactor < 100 {
+			bounds := img.Bounds()
+			img = util.ResizeImage(img, bounds.Dx()*current.ScalingFactor/100, bounds.Dy()*current.ScalingFactor/100)
+		}
+
+		frame, err := util.EncodeImage(img, "jpeg", current.JpegQuality)
+		if err != nil {
+			return fmt.Errorf("ReadScreencap: %s", err)
+		}
+		err = handleFrame(frame)
+		if err != nil {
+			return err
+		}
+
+		if current.TargetFPS > 0 {
+			wait := time.Second/time.Duration(current.TargetFPS) - time.Since(started)
+			if wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+	}
+}
+
+// Run adb and get its output, replaced in tests
+var runAdb = func(ctx context.Context, args []string) ([]byte, error) {
+	var outBuffer, errBuffer bytes.Buffer
+	cmd := exec.CommandContext(ctx, "adb", args...)
+	cmd.Stdout = &outBuffer
+	cmd.Stderr = &errBuffer
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("Error executing `adb %s` - %s - %s", strings.Join(args, " "), err, strings.TrimSpace(errBuffer.String()))
+	}
+	return outBuffer.Bytes(), nil
+}
+
+// Take a screenshot with adb as raw pixels, which is much faster than PNG encoding on the device
+// Falls back to PNG for the rest of the stream if the device uses a raw format that is not supported
+func screencap(ctx context.Context, udid string, usePNG *bool) (image.Image, error) {
+	args := []string{"-s", udid, "exec-out", "screencap"}
+	if *usePNG {
+		args = append(args, "-p")
+	}
+
+	output, err := runAdb(ctx, args)
+	if err != nil {
+		return nil, fmt.Errorf("screencap: %s", err)
+	}
+
+	if *usePNG {
+		img, err := png.Decode(bytes.NewReader(output))
+		if err != nil {
+			return nil, fmt.Errorf("screencap: Could not decode PNG screenshot - %s", err)
+		}
+		return img, nil
+	}
+
+	img, err := decodeRawScreencap(output)
+	if err != nil {
+		*usePNG = true
+		return screencap(ctx, udid, usePNG)
+	}
+	return img, nil
+}
+
+// Decode the output of `screencap` without `-p`
+// It is a width, height and format header, plus a color space on Android 8+, followed by 4 bytes per pixel
+func decodeRawScreencap(data []byte) (image.Image, error) {
+	if len(data) < 12 {
+		return nil, fmt.Errorf("decodeRawScreencap: Output is too short")
+	}
+	width := int(binary.LittleEndian.Uint32(data[0:4]))
+	height := int(binary.LittleEndian.Uint32(data[4:8]))
+	format := binary.LittleEndian.Uint32(data[8:12])
+
+	pixelsLength := width * height * 4
+	headerLength := len(data) - pixelsLength
+	if width <= 0 || height <= 0 || (headerLength != 12 && headerLength != 16) {
+		return nil, fmt.Errorf("decodeRawScreencap: Unexpected output size %v for %vx%v", len(data), width, height)
+	}
+
+	pixels := data[headerLength:]
+	switch format {
+	case screencapFormatRGBA:
+	case screencapFormatRGBX:
+		for i := 3; i < len(pixels); i += 4 {
+			pixels[i] = 0xFF
+		}
+	case screencapFormatBGRA:
+		for i := 0; i < len(pixels); i += 4 {
+			pixels[i], pixels[i+2] = pixels[i+2], pixels[i]
+		}
+	default:
+		return nil, fmt.Errorf("decodeRawScreencap: Unsupported pixel format %v", format)
+	}
+
+	return &image.RGBA{
+		Pix:    pixels,
+		Stride: width * 4,
+		Rect:   image.Rect(0, 0, width, height),
+	}, nil
+}
@@ -0,0 +1,139 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"slices"
+	"testing"
+)
+
+// Build raw `screencap` output, a 16 byte header has the Android 8+ color space
+func rawScreencap(width, height, format uint32, headerLength int, pixels []byte) []byte {
+	header := make([]byte, headerLength)
+	binary.LittleEndian.PutUint32(header[0:4], width)
+	binary.LittleEndian.PutUint32(header[4:8], height)
+	binary.LittleEndian.PutUint32(header[8:12], format)
+	return append(header, pixels...)
+}
+
+func TestDecodeRawScreencap(t *testing.T) {
+	// 2x1 image, a red pixel and a blue pixel in the source format
+	tests := []struct {
+		name         string
+		format       uint32
+		headerLength int
+		pixels       []byte
+		expected     []color.RGBA
+	}{
+		{
+			name:         "RGBA with 12 byte header",
+			format:       screencapFormatRGBA,
+			headerLength: 12,
+			pixels:       []byte{0xFF, 0x00, 0x00, 0xFF, 0x00, 0x00, 0xFF, 0x80},
+			expected:     []color.RGBA{{R: 0xFF, A: 0xFF}, {B: 0xFF, A: 0x80}},
+		},
+		{
+			name:         "RGBA with 16 byte header",
+			format:       screencapFormatRGBA,
+			headerLength: 16,
+			pixels:       []byte{0xFF, 0x00, 0x00, 0xFF, 0x00, 0x00, 0xFF, 0xFF},
+			expected:     []color.RGBA{{R: 0xFF, A: 0xFF}, {B: 0xFF, A: 0xFF}},
+		},
+		{
+			name:         "RGBX ignores the padding byte",
+			format:       screencapFormatRGBX,
+			headerLength: 16,
+			pixels:       []byte{0xFF, 0x00, 0x00, 0x00, 0x00, 0x00, 0xFF, 0x12},
+			expected:     []color.RGBA{{R: 0xFF, A: 0xFF}, {B: 0xFF, A: 0xFF}},
+		},
+		{
+			name:         "BGRA swaps red and blue",
+			format:       screencapFormatBGRA,
+			headerLength: 12,
+			pixels:       []byte{0x00, 0x00, 0xFF, 0xFF, 0xFF, 0x00, 0x00, 0xFF},
+			expected:     []color.RGBA{{R: 0xFF, A: 0xFF}, {B: 0xFF, A: 0xFF}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			img, err := decodeRawScreencap(rawScreencap(2, 1, test.format, test.headerLength, test.pixels))
+			if err != nil {
+				t.Fatalf("Could not decode screencap - %s", err)
+			}
+			if img.Bounds() != image.Rect(0, 0, 2, 1) {
+				t.Fatalf("Decoded image bounds are %v, expected 2x1", img.Bounds())
+			}
+			for x, expected := range test.expected {
+				if pixel := img.(*image.RGBA).RGBAAt(x, 0); pixel != expected {
+					t.Errorf("Pixel %v is %v, expected %v", x, pixel, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeRawScreencapRejectsInvalidOutput(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"too short", []byte{0x01, 0x02}},
+		{"unsupported format", rawScreencap(1, 1, 4, 12, []byte{0x00, 0x00, 0x00, 0x00})},
+		{"size does not match the header", rawScreencap(2, 2, screencapFormatRGBA, 12, []byte{0x00, 0x00, 0x00, 0x00})},
+		{"zero size", rawScreencap(0, 0, screencapFormatRGBA, 12, nil)},
+	}
+
+	for _, test := range tests {
+		if _, err := decodeRawScreencap(test.data); err == nil {
+			t.Errorf("Decoding %s output did not fail", test.name)
+		}
+	}
+}
+
+func TestScreencapFallsBackToPNG(t *testing.T) {
+	var pngBuffer bytes.Buffer
+	source := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	source.SetRGBA(1, 1, color.RGBA{G: 0xFF, A: 0xFF})
+	if err := png.Encode(&pngBuffer, source); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls [][]string
+	previousRunAdb := runAdb
+	runAdb = func(ctx context.Context, args []string) ([]byte, error) {
+		calls = append(calls, args)
+		if slices.Contains(args, "-p") {
+			return pngBuffer.Bytes(), nil
+		}
+		// RGB565 is not supported as raw output
+		return rawScreencap(3, 2, 4, 12, make([]byte, 3*2*4)), nil
+	}
+	t.Cleanup(func() {
+		runAdb = previousRunAdb
+	})
+
+	usePNG := false
+	img, err := screencap(context.Background(), "test-udid", &usePNG)
+	if err != nil {
+		t.Fatalf("Could not take screencap - %s", err)
+	}
+	if !usePNG {
+		t.Error("Unsupported raw format did not switch the stream to PNG")
+	}
+	if r, g, b, _ := img.At(1, 1).RGBA(); r != 0 || g != 0xFFFF || b != 0 {
+		t.Errorf("PNG screenshot was not decoded, pixel is %v", img.At(1, 1))
+	}
+
+	// Later screenshots go straight to PNG
+	if _, err := screencap(context.Background(), "test-udid", &usePNG); err != nil {
+		t.Fatalf("Could not take second screencap - %s", err)
+	}
+	if len(calls) != 3 || !slices.Contains(calls[2], "-p") {
+		t.Errorf("adb was called with %v, expected a raw attempt followed by PNG screenshots", calls)
+	}
+}
@@ -0,0 +1,107 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// Read JPEG frames from a websocket server where each message is a frame, like GADS-stream
+// The frame passed to handleFrame is only valid during the call
+func ReadWebsocket(ctx context.Context, host string, handleFrame func([]byte) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	u := url.URL{Scheme: "ws", Host: host, Path: ""}
+	conn, _, _, err := ws.Dialer{}.Dial(ctx, u.String())
+	if err != nil {
+		return fmt.Errorf("ReadWebsocket: Failed connecting to `%s` - %s", u.String(), err)
+	}
+	defer conn.Close()
+	go closeOnDone(ctx, conn)
+
+	for {
+		data, _, err := wsutil.ReadServerData(conn)
+		if err != nil {
+			return fmt.Errorf("ReadWebsocket: Failed reading data from `%s` - %s", u.String(), err)
+		}
+		err = handleFrame(data)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Read frames from a TCP connection streaming concatenated JPEGs, like the GADS iOS broadcast extension
+// The frame passed to handleFrame is only valid during the call
+func ReadJPEG(ctx context.Context, host string, handleFrame func([]byte) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return fmt.Errorf("ReadJPEG: Failed connecting to `%s` - %s", host, err)
+	}
+	defer conn.Close()
+	go closeOnDone(ctx, conn)
+
+	reader := NewJPEGReader(conn)
+	defer reader.Close()
+
+	return readFrames(reader, handleFrame)
+}
+
+// Read frames from a multipart/x-mixed-replace HTTP stream, like the WebDriverAgent MJPEG server
+// The frame passed to handleFrame is only valid during the call
+func ReadMJPEG(ctx context.Context, streamURL string, handleFrame func([]byte) error) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, streamURL, nil)
+	if err != nil {
+		return fmt.Errorf("ReadMJPEG: Failed creating request - %s", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("ReadMJPEG: Failed connecting to `%s` - %s", streamURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ReadMJPEG: `%s` returned status %v", streamURL, resp.StatusCode)
+	}
+
+	boundary, err := MultipartBoundary(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return err
+	}
+
+	reader := NewMultipartReader(resp.Body, boundary)
+	defer reader.Close()
+
+	return readFrames(reader, handleFrame)
+}
+
+func readFrames(reader FrameReader, handleFrame func([]byte) error) error {
+	for {
+		frame, err := reader.ReadFrame()
+		if err != nil {
+			return err
+		}
+		err = handleFrame(frame)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Close the connection when the context is cancelled to unblock pending reads
+func closeOnDone(ctx context.Context, conn io.Closer) {
+	<-ctx.Done()
+	conn.Close()
+}
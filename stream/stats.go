@@ -0,0 +1,176 @@
+package stream
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/shamanec/GADS-devices-provider/models"
+)
+
+// Period over which the upstream fps, bytes per second and frame sizes are calculated
+const streamStatsWindow = 5 * time.Second
+
+// Size and arrival time of an upstream frame
+type frameSample struct {
+	at   time.Time
+	size int
+}
+
+// Get statistics for the open streams of the device and their viewers
+func DeviceStats(device *models.Device) []models.StreamStats {
+	stats := []models.StreamStats{}
+	for _, broadcaster := range deviceBroadcasters(device) {
+		stats = append(stats, broadcaster.stats())
+	}
+	return stats
+}
+
+// Get the open stream broadcasters of a device
+func deviceBroadcasters(device *models.Device) []*frameBroadcaster {
+	streamBroadcastersMu.Lock()
+	defer streamBroadcastersMu.Unlock()
+
+	var broadcasters []*frameBroadcaster
+	for _, source := range []string{SourceAndroid, SourceScreencap, SourceGadsIOS, SourceWDA} {
+		if broadcaster, ok := streamBroadcasters[device.UDID+"/"+source]; ok {
+			broadcasters = append(broadcasters, broadcaster)
+		}
+	}
+	return broadcasters
+}
+
+// Get the last frame of an open device stream
+func LatestFrame(device *models.Device) ([]byte, time.Time, bool) {
+	for _, broadcaster := range deviceBroadcasters(device) {
+		broadcaster.mu.Lock()
+		frame, frameAt := broadcaster.lastFrame.Data, broadcaster.lastFrameAt
+		broadcaster.mu.Unlock()
+		if frame != nil {
+			return frame, frameAt, true
+		}
+	}
+	return nil, time.Time{}, false
+}
+
+// Keep the frame for snapshots and add it to the stats
+// Must be called with the subscribers lock held
+func (b *frameBroadcaster) recordFrame(frame Frame) {
+	now := time.Now()
+	b.totalFrames++
+	b.totalBytes += uint64(len(frame.Data))
+	b.lastFrame = frame
+	b.lastFrameAt = now
+	b.samples = append(b.samples, frameSample{at: now, size: len(frame.Data)})
+	b.pruneSamples(now)
+}
+
+// Drop the samples that are out of the stats window
+func (b *frameBroadcaster) pruneSamples(now time.Time) {
+	i := 0
+	for i < len(b.samples) && now.Sub(b.samples[i].at) > streamStatsWindow {
+		i++
+	}
+	b.samples = b.samples[i:]
+}
+
+func (b *frameBroadcaster) stats() models.StreamStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.pruneSamples(now)
+
+	stats := models.StreamStats{
+		Source:           b.source,
+		UptimeMs:         now.Sub(b.startedAt).Milliseconds(),
+		TotalFrames:      b.totalFrames,
+		TotalBytes:       b.totalBytes,
+		SinceLastFrameMs: -1,
+		Viewers:          []models.StreamViewerStats{},
+		StatsWindowMs:    streamStatsWindow.Milliseconds(),
+	}
+	if !b.lastFrameAt.IsZero() {
+		stats.SinceLastFrameMs = now.Sub(b.lastFrameAt).Milliseconds()
+	}
+
+	// Use the time since the stream started if it is shorter than the window
+	window := streamStatsWindow
+	if uptime := now.Sub(b.startedAt); uptime < window {
+		window = uptime
+	}
+	if len(b.samples) > 0 && window > 0 {
+		windowBytes := 0
+		stats.MinFrameSize = b.samples[0].size
+		for _, sample := range b.samples {
+			windowBytes += sample.size
+			if sample.size < stats.MinFrameSize {
+				stats.MinFrameSize = sample.size
+			}
+			if sample.size > stats.MaxFrameSize {
+				stats.MaxFrameSize = sample.size
+			}
+		}
+		stats.AvgFrameSize = windowBytes / len(b.samples)
+		stats.UpstreamFPS = float64(len(b.samples)) / window.Seconds()
+		stats.BytesPerSecond = float64(windowBytes) / window.Seconds()
+	}
+
+	for subscriber := range b.subscribers {
+		viewer := models.StreamViewerStats{
+			ID:              subscriber.id,
+			Type:            subscriber.viewerType,
+			RemoteAddr:      subscriber.remoteAddr,
+			MaxWidth:        subscriber.query.MaxWidth,
+			Quality:         subscriber.query.Quality,
+			FPS:             subscriber.query.FPS,
+			ConnectedMs:     now.Sub(subscriber.connectedAt).Milliseconds(),
+			SentFrames:      subscriber.sent.Load(),
+			DroppedFrames:   subscriber.dropped.Load(),
+			SkippedFrames:   subscriber.skipped.Load(),
+			SinceLastSentMs: -1,
+		}
+		if lastSentAt := subscriber.lastSentAt.Load(); lastSentAt != 0 {
+			viewer.SinceLastSentMs = now.Sub(time.Unix(0, lastSentAt)).Milliseconds()
+		}
+		stats.Viewers = append(stats.Viewers, viewer)
+	}
+	// Oldest viewers first
+	sort.Slice(stats.Viewers, func(i, j int) bool {
+		return stats.Viewers[i].ConnectedMs > stats.Viewers[j].ConnectedMs
+	})
+	return stats
+}
+
+// Stream health by device UDID, kept after the stream is closed so reconnects stay visible
+var streamHealth = make(map[string]models.StreamHealth)
+var streamHealthMu sync.Mutex
+
+// Update the stream health of a device, reconnect counts a new reconnect attempt with its error
+func recordHealth(device *models.Device, status string, err error, reconnect bool) {
+	streamHealthMu.Lock()
+	defer streamHealthMu.Unlock()
+
+	health := streamHealth[device.UDID]
+	health.Status = status
+	if err != nil {
+		health.LastError = err.Error()
+	}
+	if reconnect {
+		health.Reconnects++
+		health.LastReconnectAt = time.Now().UnixMilli()
+	}
+	streamHealth[device.UDID] = health
+}
+
+// Get the stream health of a device
+func Health(device *models.Device) models.StreamHealth {
+	streamHealthMu.Lock()
+	defer streamHealthMu.Unlock()
+
+	health, ok := streamHealth[device.UDID]
+	if !ok {
+		health.Status = models.StreamStatusIdle
+	}
+	return health
+}
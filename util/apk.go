@@ -0,0 +1,552 @@
+package util
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/shamanec/GADS-devices-provider/models"
+)
+
+// Chunk types of the Android binary XML format
+const (
+	axmlStringPoolType   = 0x0001
+	axmlFileType         = 0x0003
+	arscTableType        = 0x0002
+	arscPackageType      = 0x0200
+	arscTypeType         = 0x0201
+	axmlResourceMapType  = 0x0180
+	axmlStartElementType = 0x0102
+)
+
+// Types of the attribute typed values that are resolved
+const (
+	axmlTypeReference = 0x01
+	axmlTypeString    = 0x03
+	axmlTypeIntDec    = 0x10
+	axmlTypeIntHex    = 0x11
+	axmlTypeBoolean   = 0x12
+)
+
+// Android framework resource IDs of the manifest attributes, used when the attribute names are obfuscated
+const (
+	axmlLabelAttr         = 0x01010001
+	axmlMinSdkVersionAttr = 0x0101020c
+	axmlVersionCodeAttr   = 0x0101021b
+	axmlVersionNameAttr   = 0x0101021c
+)
+
+// Flags of the entries in resource table type chunks
+const (
+	arscTypeSparse    = 0x01
+	arscTypeOffset16  = 0x02
+	arscEntryComplex  = 0x0001
+	arscEntryCompact  = 0x0008
+	arscNoEntry       = 0xffffffff
+	arscNoEntry16     = 0xffff
+	maxReferenceDepth = 5
+)
+
+// Upper limit for the size of a binary manifest or resource table read from an apk
+const maxApkManifestSize = 16 << 20
+
+type axmlAttr struct {
+	name     string
+	resID    uint32
+	dataType uint8
+	data     uint32
+	value    string
+}
+
+type axmlElement struct {
+	name  string
+	attrs []axmlAttr
+}
+
+// Get an attribute of the element by its framework resource ID or by its name if it has no ID
+func (e axmlElement) attr(name string, resID uint32) (axmlAttr, bool) {
+	for _, attr := range e.attrs {
+		if resID != 0 && attr.resID == resID {
+			return attr, true
+		}
+	}
+	for _, attr := range e.attrs {
+		if attr.name == name {
+			return attr, true
+		}
+	}
+	return axmlAttr{}, false
+}
+
+// Get the version of the Android package in an apk file
+func GetApkVersion(apkPath string) (models.AndroidPackageVersion, error) {
+	var version models.AndroidPackageVersion
+
+	elements, err := readApkManifest(apkPath)
+	if err != nil {
+		return version, err
+	}
+
+	for _, element := range elements {
+		if element.name != "manifest" {
+			continue
+		}
+		if attr, ok := element.attr("versionCode", axmlVersionCodeAttr); ok {
+			version.VersionCode, err = strconv.ParseInt(attr.value, 10, 64)
+			if err != nil {
+				return version, fmt.Errorf("GetApkVersion: Invalid versionCode `%s` in `%s`", attr.value, apkPath)
+			}
+		}
+		if attr, ok := element.attr("versionName", axmlVersionNameAttr); ok {
+			version.VersionName = attr.value
+		}
+		return version, nil
+	}
+
+	return version, fmt.Errorf("GetApkVersion: No manifest element in the AndroidManifest.xml of `%s`", apkPath)
+}
+
+// Get the package, versions, minimum SDK, label and native ABIs of an apk file
+func readApkMetadata(apkPath string, metadata *models.AppMetadata) error {
+	reader, err := zip.OpenReader(apkPath)
+	if err != nil {
+		return fmt.Errorf("readApkMetadata: Could not open `%s` as zip archive - %s", apkPath, err)
+	}
+	defer reader.Close()
+
+	elements, err := readManifestFromZip(&reader.Reader, apkPath)
+	if err != nil {
+		return err
+	}
+
+	var label axmlAttr
+	for _, element := range elements {
+		switch element.name {
+		case "manifest":
+			if attr, ok := element.attr("package", 0); ok {
+				metadata.Identifier = attr.value
+			}
+			if attr, ok := element.attr("versionCode", axmlVersionCodeAttr); ok {
+				metadata.VersionCode = attr.value
+			}
+			if attr, ok := element.attr("versionName", axmlVersionNameAttr); ok {
+				metadata.VersionName = attr.value
+			}
+		case "uses-sdk":
+			if attr, ok := element.attr("minSdkVersion", axmlMinSdkVersionAttr); ok {
+				metadata.MinOSVersion = attr.value
+			}
+		case "application":
+			label, _ = element.attr("label", axmlLabelAttr)
+		}
+	}
+
+	// Labels are usually references to string resources in resources.arsc
+	metadata.Name = label.value
+	if label.dataType == axmlTypeReference {
+		name, err := resolveApkString(&reader.Reader, label.data)
+		if err != nil {
+			metadata.Name = ""
+		} else {
+			metadata.Name = name
+		}
+	}
+
+	// Native libraries are in a folder per ABI
+	for _, file := range reader.File {
+		parts := strings.Split(file.Name, "/")
+		if len(parts) == 3 && parts[0] == "lib" && !slices.Contains(metadata.ABIs, parts[1]) {
+			metadata.ABIs = append(metadata.ABIs, parts[1])
+		}
+	}
+	slices.Sort(metadata.ABIs)
+
+	return nil
+}
+
+// Read the start elements of the binary AndroidManifest.xml in an apk file in document order
+func readApkManifest(apkPath string) ([]axmlElement, error) {
+	reader, err := zip.OpenReader(apkPath)
+	if err != nil {
+		return nil, fmt.Errorf("readApkManifest: Could not open `%s` as zip archive - %s", apkPath, err)
+	}
+	defer reader.Close()
+
+	return readManifestFromZip(&reader.Reader, apkPath)
+}
+
+// Read the start elements of the binary AndroidManifest.xml in an opened apk
+func readManifestFromZip(reader *zip.Reader, apkPath string) ([]axmlElement, error) {
+	data, err := readZipFile(reader, "AndroidManifest.xml", maxApkManifestSize)
+	if err != nil {
+		return nil, fmt.Errorf("readManifestFromZip: Could not read AndroidManifest.xml in `%s` - %s", apkPath, err)
+	}
+
+	elements, err := parseBinaryXML(data)
+	if err != nil {
+		return nil, fmt.Errorf("readManifestFromZip: Could not parse AndroidManifest.xml in `%s` - %s", apkPath, err)
+	}
+	return elements, nil
+}
+
+// Read a file from a zip archive if it is not larger than maxSize
+func readZipFile(reader *zip.Reader, name string, maxSize uint64) ([]byte, error) {
+	for _, file := range reader.File {
+		if file.Name != name {
+			continue
+		}
+		if file.UncompressedSize64 > maxSize {
+			return nil, fmt.Errorf("file is too large")
+		}
+
+		zipFile, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer zipFile.Close()
+
+		return io.ReadAll(io.LimitReader(zipFile, int64(maxSize)))
+	}
+	return nil, fmt.Errorf("no such file in the archive")
+}
+
+// Get the value of a string resource from the resources.arsc of an apk
+// The default configuration value is preferred, otherwise the first one found is used
+func resolveApkString(reader *zip.Reader, resID uint32) (string, error) {
+	data, err := readZipFile(reader, "resources.arsc", 4*maxApkManifestSize)
+	if err != nil {
+		return "", fmt.Errorf("resolveApkString: Could not read resources.arsc - %s", err)
+	}
+	if len(data) < 12 || binary.LittleEndian.Uint16(data) != arscTableType {
+		return "", fmt.Errorf("resolveApkString: Invalid resources.arsc")
+	}
+
+	var globalPool []string
+	for depth := 0; depth < maxReferenceDepth; depth++ {
+		dataType, value, err := findArscValue(data, resID, &globalPool)
+		if err != nil {
+			return "", fmt.Errorf("resolveApkString: %s", err)
+		}
+		switch dataType {
+		case axmlTypeString:
+			if int(value) >= len(globalPool) {
+				return "", fmt.Errorf("resolveApkString: String %v is out of the string pool", value)
+			}
+			return globalPool[value], nil
+		case axmlTypeReference:
+			resID = value
+		default:
+			return "", fmt.Errorf("resolveApkString: Resource 0x%08x is not a string", resID)
+		}
+	}
+	return "", fmt.Errorf("resolveApkString: Too many references resolving 0x%08x", resID)
+}
+
+// Find the typed value of a resource in a resource table, the global string pool is parsed on the way
+func findArscValue(data []byte, resID uint32, globalPool *[]string) (uint8, uint32, error) {
+	packageID := resID >> 24
+	typeID := (resID >> 16) & 0xff
+	entryIndex := int(resID & 0xffff)
+
+	found := false
+	var foundType uint8
+	var foundValue uint32
+
+	offset := int(binary.LittleEndian.Uint16(data[2:]))
+	for offset+8 <= len(data) {
+		chunkType := binary.LittleEndian.Uint16(data[offset:])
+		headerSize := int(binary.LittleEndian.Uint16(data[offset+2:]))
+		chunkSize := int(binary.LittleEndian.Uint32(data[offset+4:]))
+		if chunkSize < 8 || headerSize > chunkSize || offset+chunkSize > len(data) {
+			return 0, 0, fmt.Errorf("invalid chunk at offset %v", offset)
+		}
+		chunk := data[offset : offset+chunkSize]
+
+		switch chunkType {
+		case axmlStringPoolType:
+			pool, err := parseStringPool(chunk)
+			if err != nil {
+				return 0, 0, err
+			}
+			*globalPool = pool
+		case arscPackageType:
+			if headerSize < 12 || binary.LittleEndian.Uint32(chunk[8:]) != packageID {
+				break
+			}
+			for typeOffset := headerSize; typeOffset+8 <= len(chunk); {
+				typeChunkSize := int(binary.LittleEndian.Uint32(chunk[typeOffset+4:]))
+				if typeChunkSize < 8 || typeOffset+typeChunkSize > len(chunk) {
+					return 0, 0, fmt.Errorf("invalid chunk in package 0x%02x", packageID)
+				}
+				typeChunk := chunk[typeOffset : typeOffset+typeChunkSize]
+				typeOffset += typeChunkSize
+
+				if binary.LittleEndian.Uint16(typeChunk) != arscTypeType || len(typeChunk) < 20 || uint32(typeChunk[8]) != typeID {
+					continue
+				}
+				dataType, value, ok, isDefault := readArscTypeEntry(typeChunk, entryIndex)
+				if !ok {
+					continue
+				}
+				if isDefault {
+					return dataType, value, nil
+				}
+				if !found {
+					found, foundType, foundValue = true, dataType, value
+				}
+			}
+		}
+
+		offset += chunkSize
+	}
+
+	if !found {
+		return 0, 0, fmt.Errorf("resource 0x%08x not found", resID)
+	}
+	return foundType, foundValue, nil
+}
+
+// Read the value of an entry in a resource table type chunk and whether the chunk is for the default language
+func readArscTypeEntry(typeChunk []byte, entryIndex int) (dataType uint8, value uint32, ok bool, isDefault bool) {
+	headerSize := int(binary.LittleEndian.Uint16(typeChunk[2:]))
+	flags := typeChunk[9]
+	entryCount := int(binary.LittleEndian.Uint32(typeChunk[12:]))
+	entriesStart := int(binary.LittleEndian.Uint32(typeChunk[16:]))
+	// The config starts with its size, then mcc/mnc and the language
+	if headerSize < 32 || headerSize > len(typeChunk) || entriesStart > len(typeChunk) {
+		return 0, 0, false, false
+	}
+	isDefault = typeChunk[28] == 0 && typeChunk[29] == 0
+
+	entryOffset := -1
+	switch {
+	case flags&arscTypeSparse != 0:
+		// Sparse entries are pairs of entry index and offset divided by 4
+		for i := 0; i < entryCount && headerSize+i*4+4 <= len(typeChunk); i++ {
+			if int(binary.LittleEndian.Uint16(typeChunk[headerSize+i*4:])) == entryIndex {
+				entryOffset = int(binary.LittleEndian.Uint16(typeChunk[headerSize+i*4+2:])) * 4
+				break
+			}
+		}
+	case flags&arscTypeOffset16 != 0:
+		if entryIndex < entryCount && headerSize+entryIndex*2+2 <= len(typeChunk) {
+			if raw := binary.LittleEndian.Uint16(typeChunk[headerSize+entryIndex*2:]); raw != arscNoEntry16 {
+				entryOffset = int(raw) * 4
+			}
+		}
+	default:
+		if entryIndex < entryCount && headerSize+entryIndex*4+4 <= len(typeChunk) {
+			if raw := binary.LittleEndian.Uint32(typeChunk[headerSize+entryIndex*4:]); raw != arscNoEntry {
+				entryOffset = int(raw)
+			}
+		}
+	}
+	if entryOffset < 0 || entriesStart+entryOffset+8 > len(typeChunk) {
+		return 0, 0, false, false
+	}
+
+	entry := typeChunk[entriesStart+entryOffset:]
+	entrySize := int(binary.LittleEndian.Uint16(entry))
+	entryFlags := binary.LittleEndian.Uint16(entry[2:])
+	if entryFlags&arscEntryCompact != 0 {
+		// Compact entries keep the value type in the upper byte of the flags and the data in place of the key
+		return uint8(entryFlags >> 8), binary.LittleEndian.Uint32(entry[4:]), true, isDefault
+	}
+	if entryFlags&arscEntryComplex != 0 || entrySize+8 > len(entry) {
+		return 0, 0, false, false
+	}
+	return entry[entrySize+3], binary.LittleEndian.Uint32(entry[entrySize+4:]), true, isDefault
+}
+
+// Parse the start elements of an Android binary XML document
+func parseBinaryXML(data []byte) ([]axmlElement, error) {
+	if len(data) < 8 || binary.LittleEndian.Uint16(data) != axmlFileType {
+		return nil, fmt.Errorf("not a binary XML document")
+	}
+
+	var stringPool []string
+	var resourceIDs []uint32
+	var elements []axmlElement
+
+	offset := int(binary.LittleEndian.Uint16(data[2:]))
+	for offset+8 <= len(data) {
+		chunkType := binary.LittleEndian.Uint16(data[offset:])
+		headerSize := int(binary.LittleEndian.Uint16(data[offset+2:]))
+		chunkSize := int(binary.LittleEndian.Uint32(data[offset+4:]))
+		if chunkSize < 8 || headerSize > chunkSize || offset+chunkSize > len(data) {
+			return nil, fmt.Errorf("invalid chunk at offset %v", offset)
+		}
+		chunk := data[offset : offset+chunkSize]
+
+		switch chunkType {
+		case axmlStringPoolType:
+			pool, err := parseStringPool(chunk)
+			if err != nil {
+				return nil, err
+			}
+			stringPool = pool
+		case axmlResourceMapType:
+			for i := headerSize; i+4 <= len(chunk); i += 4 {
+				resourceIDs = append(resourceIDs, binary.LittleEndian.Uint32(chunk[i:]))
+			}
+		case axmlStartElementType:
+			element, err := parseStartElement(chunk, headerSize, stringPool, resourceIDs)
+			if err != nil {
+				return nil, err
+			}
+			elements = append(elements, element)
+		}
+
+		offset += chunkSize
+	}
+
+	return elements, nil
+}
+
+// Parse a string pool chunk, the strings are UTF-8 or UTF-16 depending on the pool flags
+func parseStringPool(chunk []byte) ([]string, error) {
+	if len(chunk) < 28 {
+		return nil, fmt.Errorf("string pool header is too short")
+	}
+	stringCount := int(binary.LittleEndian.Uint32(chunk[8:]))
+	flags := binary.LittleEndian.Uint32(chunk[16:])
+	stringsStart := int(binary.LittleEndian.Uint32(chunk[20:]))
+	headerSize := int(binary.LittleEndian.Uint16(chunk[2:]))
+	isUTF8 := flags&(1<<8) != 0
+
+	if headerSize+stringCount*4 > len(chunk) || stringsStart > len(chunk) {
+		return nil, fmt.Errorf("string pool is truncated")
+	}
+
+	pool := make([]string, stringCount)
+	for i := 0; i < stringCount; i++ {
+		start := stringsStart + int(binary.LittleEndian.Uint32(chunk[headerSize+i*4:]))
+		if start >= len(chunk) {
+			return nil, fmt.Errorf("string %v is out of the string pool", i)
+		}
+		var err error
+		if isUTF8 {
+			pool[i], err = decodeUTF8PoolString(chunk[start:])
+		} else {
+			pool[i], err = decodeUTF16PoolString(chunk[start:])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("string %v - %s", i, err)
+		}
+	}
+	return pool, nil
+}
+
+// UTF-8 pool strings start with their length in UTF-16 units and in bytes, each encoded in 1 or 2 bytes
+func decodeUTF8PoolString(data []byte) (string, error) {
+	readLength := func(data []byte) (int, int) {
+		if len(data) == 0 {
+			return 0, 0
+		}
+		if data[0]&0x80 == 0 {
+			return int(data[0]), 1
+		}
+		if len(data) < 2 {
+			return 0, 0
+		}
+		return int(data[0]&0x7f)<<8 | int(data[1]), 2
+	}
+
+	_, n := readLength(data)
+	if n == 0 {
+		return "", fmt.Errorf("invalid length")
+	}
+	length, m := readLength(data[n:])
+	if m == 0 || n+m+length > len(data) {
+		return "", fmt.Errorf("invalid length")
+	}
+	return string(data[n+m : n+m+length]), nil
+}
+
+// UTF-16 pool strings start with their length in units, encoded in 1 or 2 units
+func decodeUTF16PoolString(data []byte) (string, error) {
+	if len(data) < 2 {
+		return "", fmt.Errorf("invalid length")
+	}
+	length := int(binary.LittleEndian.Uint16(data))
+	start := 2
+	if length&0x8000 != 0 {
+		if len(data) < 4 {
+			return "", fmt.Errorf("invalid length")
+		}
+		length = (length&0x7fff)<<16 | int(binary.LittleEndian.Uint16(data[2:]))
+		start = 4
+	}
+	if start+length*2 > len(data) {
+		return "", fmt.Errorf("invalid length")
+	}
+
+	units := make([]uint16, length)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(data[start+i*2:])
+	}
+	return string(utf16.Decode(units)), nil
+}
+
+// Parse a start element chunk and resolve its attribute values to strings
+func parseStartElement(chunk []byte, headerSize int, stringPool []string, resourceIDs []uint32) (axmlElement, error) {
+	var element axmlElement
+
+	poolString := func(index uint32) string {
+		if int(index) < len(stringPool) {
+			return stringPool[index]
+		}
+		return ""
+	}
+
+	if headerSize+20 > len(chunk) {
+		return element, fmt.Errorf("start element is truncated")
+	}
+	ext := chunk[headerSize:]
+	element.name = poolString(binary.LittleEndian.Uint32(ext[4:]))
+	attributeStart := int(binary.LittleEndian.Uint16(ext[8:]))
+	attributeSize := int(binary.LittleEndian.Uint16(ext[10:]))
+	attributeCount := int(binary.LittleEndian.Uint16(ext[12:]))
+	if attributeSize < 20 || attributeStart+attributeCount*attributeSize > len(ext) {
+		return element, fmt.Errorf("attributes of element `%s` are truncated", element.name)
+	}
+
+	for i := 0; i < attributeCount; i++ {
+		raw := ext[attributeStart+i*attributeSize:]
+		nameIndex := binary.LittleEndian.Uint32(raw[4:])
+		rawValue := binary.LittleEndian.Uint32(raw[8:])
+
+		attr := axmlAttr{
+			name:     poolString(nameIndex),
+			dataType: raw[15],
+			data:     binary.LittleEndian.Uint32(raw[16:]),
+		}
+		if int(nameIndex) < len(resourceIDs) {
+			attr.resID = resourceIDs[nameIndex]
+		}
+
+		switch {
+		case rawValue != 0xffffffff:
+			attr.value = poolString(rawValue)
+		case attr.dataType == axmlTypeString:
+			attr.value = poolString(attr.data)
+		case attr.dataType == axmlTypeIntDec || attr.dataType == axmlTypeIntHex:
+			attr.value = strconv.FormatInt(int64(int32(attr.data)), 10)
+		case attr.dataType == axmlTypeBoolean:
+			attr.value = strconv.FormatBool(attr.data != 0)
+		case attr.dataType == axmlTypeReference:
+			attr.value = fmt.Sprintf("@0x%08x", attr.data)
+		default:
+			attr.value = strconv.FormatUint(uint64(attr.data), 10)
+		}
+
+		element.attrs = append(element.attrs, attr)
+	}
+
+	return element, nil
+}
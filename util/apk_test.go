@@ -0,0 +1,124 @@
+package util
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"testing"
+
+	"github.com/shamanec/GADS-devices-provider/models"
+)
+
+// Real apk from github.com/shogo82148/androidbinary (MIT license)
+const helloWorldApk = "testdata/helloworld.apk"
+
+// Read a file from the test apk to seed the fuzz tests
+func readTestApkFile(t testing.TB, name string) []byte {
+	t.Helper()
+	reader, err := zip.OpenReader(helloWorldApk)
+	if err != nil {
+		t.Fatalf("Could not open test apk - %s", err)
+	}
+	defer reader.Close()
+
+	data, err := readZipFile(&reader.Reader, name, maxApkManifestSize)
+	if err != nil {
+		t.Fatalf("Could not read `%s` from test apk - %s", name, err)
+	}
+	return data
+}
+
+func TestReadApkMetadata(t *testing.T) {
+	var metadata models.AppMetadata
+	err := readApkMetadata(helloWorldApk, &metadata)
+	if err != nil {
+		t.Fatalf("Could not read apk metadata - %s", err)
+	}
+
+	expected := models.AppMetadata{
+		Identifier:   "com.example.helloworld",
+		Name:         "HelloWorld",
+		VersionName:  "1.0",
+		VersionCode:  "1",
+		MinOSVersion: "15",
+	}
+	if metadata.Identifier != expected.Identifier || metadata.Name != expected.Name ||
+		metadata.VersionName != expected.VersionName || metadata.VersionCode != expected.VersionCode ||
+		metadata.MinOSVersion != expected.MinOSVersion {
+		t.Errorf("Apk metadata is %+v, expected %+v", metadata, expected)
+	}
+	if len(metadata.ABIs) != 0 {
+		t.Errorf("Apk without native libraries has ABIs %v", metadata.ABIs)
+	}
+}
+
+func TestGetApkVersion(t *testing.T) {
+	version, err := GetApkVersion(helloWorldApk)
+	if err != nil {
+		t.Fatalf("Could not read apk version - %s", err)
+	}
+	if version.VersionCode != 1 || version.VersionName != "1.0" {
+		t.Errorf("Apk version is %s, expected 1.0 (1)", version)
+	}
+}
+
+func TestReadArscTypeEntryTruncatedHeader(t *testing.T) {
+	// Type chunk that claims a header larger than the chunk itself
+	typeChunk := make([]byte, 20)
+	binary.LittleEndian.PutUint16(typeChunk, arscTypeType)
+	binary.LittleEndian.PutUint16(typeChunk[2:], 64)
+	binary.LittleEndian.PutUint32(typeChunk[4:], 20)
+	typeChunk[8] = 1
+
+	if _, _, ok, _ := readArscTypeEntry(typeChunk, 0); ok {
+		t.Error("Entry was read from a truncated type chunk")
+	}
+}
+
+func TestParseBinaryXMLRejectsText(t *testing.T) {
+	if _, err := parseBinaryXML([]byte(`<manifest package="com.example"/>`)); err == nil {
+		t.Error("Text XML was parsed as binary XML")
+	}
+}
+
+func FuzzParseBinaryXML(f *testing.F) {
+	manifest := readTestApkFile(f, "AndroidManifest.xml")
+	f.Add(manifest)
+	f.Add(manifest[:len(manifest)/2])
+	f.Add([]byte{0x03, 0x00, 0x08, 0x00, 0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		elements, err := parseBinaryXML(data)
+		if err != nil {
+			return
+		}
+		for _, element := range elements {
+			element.attr("versionCode", axmlVersionCodeAttr)
+		}
+	})
+}
+
+func FuzzFindArscValue(f *testing.F) {
+	resources := readTestApkFile(f, "resources.arsc")
+	elements, err := parseBinaryXML(readTestApkFile(f, "AndroidManifest.xml"))
+	if err != nil {
+		f.Fatalf("Could not parse test manifest - %s", err)
+	}
+	labelID := uint32(0x7f000000)
+	for _, element := range elements {
+		if attr, ok := element.attr("label", axmlLabelAttr); ok && element.name == "application" {
+			labelID = attr.data
+		}
+	}
+
+	f.Add(resources, labelID)
+	f.Add(resources[:len(resources)/2], labelID)
+	f.Add(resources, uint32(0x7f7f7f7f))
+
+	f.Fuzz(func(t *testing.T, data []byte, resID uint32) {
+		if len(data) < 12 || binary.LittleEndian.Uint16(data) != arscTableType {
+			return
+		}
+		var globalPool []string
+		findArscValue(data, resID, &globalPool)
+	})
+}
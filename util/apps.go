@@ -0,0 +1,159 @@
+package util
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/shamanec/GADS-devices-provider/config"
+	"github.com/shamanec/GADS-devices-provider/logger"
+	"github.com/shamanec/GADS-devices-provider/models"
+)
+
+// File extensions of the apps that can be uploaded and installed
+var AppExtensions = []string{".apk", ".ipa", ".zip"}
+
+// Guards writing the metadata files
+var appMetadataMu sync.Mutex
+
+func IsAppFile(fileName string) bool {
+	return slices.Contains(AppExtensions, strings.ToLower(filepath.Ext(fileName)))
+}
+
+func appFilePath(fileName string) string {
+	return fmt.Sprintf("%s/apps/%s", config.Config.EnvConfig.ProviderFolder, fileName)
+}
+
+func appMetadataPath(fileName string) string {
+	return appFilePath(fileName) + ".json"
+}
+
+// Extract the metadata of an app file and store it next to the file
+// Apps that can't be parsed still get size, checksum and upload time with the parsing error
+func SaveAppMetadata(fileName string) (models.AppMetadata, error) {
+	appMetadataMu.Lock()
+	defer appMetadataMu.Unlock()
+
+	return saveAppMetadata(fileName)
+}
+
+func saveAppMetadata(fileName string) (models.AppMetadata, error) {
+	metadata := models.AppMetadata{FileName: fileName}
+	filePath := appFilePath(fileName)
+
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return metadata, fmt.Errorf("saveAppMetadata: Could not stat `%s` - %s", filePath, err)
+	}
+	metadata.Size = fileInfo.Size()
+	metadata.UploadedAt = fileInfo.ModTime().UnixMilli()
+
+	metadata.SHA256, err = fileSHA256(filePath)
+	if err != nil {
+		return metadata, fmt.Errorf("saveAppMetadata: Could not calculate checksum of `%s` - %s", filePath, err)
+	}
+
+	err = extractAppMetadata(filePath, &metadata)
+	if err != nil {
+		logger.ProviderLogger.LogWarn("app_metadata", fmt.Sprintf("Could not extract metadata of app `%s` - %s", fileName, err))
+		metadata.MetadataError = err.Error()
+	}
+
+	metadataJSON, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return metadata, fmt.Errorf("saveAppMetadata: Could not marshal metadata of `%s` - %s", fileName, err)
+	}
+	err = os.WriteFile(appMetadataPath(fileName), metadataJSON, 0644)
+	if err != nil {
+		return metadata, fmt.Errorf("saveAppMetadata: Could not write metadata of `%s` - %s", fileName, err)
+	}
+
+	return metadata, nil
+}
+
+// Parse the app package, a panic on a malformed file is returned as an error
+// so the metadata is still stored and the file is not parsed again on every listing
+func extractAppMetadata(filePath string, metadata *models.AppMetadata) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("extractAppMetadata: Malformed app file `%s` - %v", filePath, r)
+		}
+	}()
+
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".apk":
+		metadata.Platform = "android"
+		return readApkMetadata(filePath, metadata)
+	case ".ipa", ".zip":
+		return readIpaMetadata(filePath, metadata)
+	}
+	return nil
+}
+
+// Get the stored metadata of an app file
+// The metadata is extracted again if it is missing or older than the file, e.g. for apps copied to the folder manually
+func GetAppMetadata(fileName string) (models.AppMetadata, error) {
+	appMetadataMu.Lock()
+	defer appMetadataMu.Unlock()
+
+	fileInfo, err := os.Stat(appFilePath(fileName))
+	if err != nil {
+		return models.AppMetadata{}, fmt.Errorf("GetAppMetadata: Could not stat app `%s` - %s", fileName, err)
+	}
+
+	metadataInfo, err := os.Stat(appMetadataPath(fileName))
+	if err != nil || metadataInfo.ModTime().Before(fileInfo.ModTime()) {
+		return saveAppMetadata(fileName)
+	}
+
+	metadataJSON, err := os.ReadFile(appMetadataPath(fileName))
+	if err != nil {
+		return saveAppMetadata(fileName)
+	}
+	var metadata models.AppMetadata
+	if err := json.Unmarshal(metadataJSON, &metadata); err != nil || metadata.Size != fileInfo.Size() {
+		return saveAppMetadata(fileName)
+	}
+
+	return metadata, nil
+}
+
+// Get the metadata of all apps in the `apps` folder, newest uploads first
+func GetAllApps() []models.AppMetadata {
+	apps := []models.AppMetadata{}
+	for _, fileName := range GetAllAppFiles() {
+		metadata, err := GetAppMetadata(fileName)
+		if err != nil {
+			logger.ProviderLogger.LogError("app_metadata", err.Error())
+			continue
+		}
+		apps = append(apps, metadata)
+	}
+
+	slices.SortFunc(apps, func(a, b models.AppMetadata) int {
+		return cmp.Compare(b.UploadedAt, a.UploadedAt)
+	})
+	return apps
+}
+
+func fileSHA256(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,185 @@
+package util
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shamanec/GADS-devices-provider/config"
+	"github.com/shamanec/GADS-devices-provider/logger"
+	"github.com/shamanec/GADS-devices-provider/models"
+	"github.com/sirupsen/logrus"
+	"howett.net/plist"
+)
+
+// Info.plist of the WebDriverAgent ipa from github.com/danielpaulus/go-ios (MIT license)
+const wdaInfoPlist = "testdata/Info.plist"
+
+// Point the provider folder to a temporary directory with an empty `apps` folder
+func setupTestApps(t *testing.T) string {
+	t.Helper()
+	providerFolder := t.TempDir()
+	if err := os.Mkdir(filepath.Join(providerFolder, "apps"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	previousConfig := config.Config.EnvConfig
+	previousLogger := logger.ProviderLogger
+	config.Config.EnvConfig = models.ProviderDB{ProviderFolder: providerFolder}
+	logrusLogger := logrus.New()
+	logrusLogger.SetOutput(io.Discard)
+	logger.ProviderLogger = &logger.CustomLogger{Logger: logrusLogger}
+	t.Cleanup(func() {
+		config.Config.EnvConfig = previousConfig
+		logger.ProviderLogger = previousLogger
+	})
+
+	return filepath.Join(providerFolder, "apps")
+}
+
+// Write a zip archive with the files to path
+func writeTestZip(t *testing.T, path string, files map[string][]byte) {
+	t.Helper()
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	writer := zip.NewWriter(file)
+	for name, data := range files {
+		fileWriter, err := writer.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fileWriter.Write(data)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadIpaMetadata(t *testing.T) {
+	xmlPlist, err := os.ReadFile(wdaInfoPlist)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// App Store ipas usually have a binary Info.plist
+	var info map[string]interface{}
+	if _, err := plist.Unmarshal(xmlPlist, &info); err != nil {
+		t.Fatal(err)
+	}
+	binaryPlist, err := plist.Marshal(info, plist.BinaryFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for format, plistData := range map[string][]byte{"xml": xmlPlist, "binary": binaryPlist} {
+		t.Run(format, func(t *testing.T) {
+			ipaPath := filepath.Join(t.TempDir(), "wda.ipa")
+			writeTestZip(t, ipaPath, map[string][]byte{
+				"Payload/WebDriverAgentRunner-Runner.app/Info.plist":                                     plistData,
+				"Payload/WebDriverAgentRunner-Runner.app/PlugIns/WebDriverAgentRunner.xctest/Info.plist": []byte("not a plist"),
+			})
+
+			var metadata models.AppMetadata
+			if err := readIpaMetadata(ipaPath, &metadata); err != nil {
+				t.Fatalf("Could not read ipa metadata - %s", err)
+			}
+
+			expected := models.AppMetadata{
+				Platform:     "ios",
+				Identifier:   "com.facebook.WebDriverAgentRunner.xctrunner",
+				Name:         "WebDriverAgentRunner-Runner",
+				VersionName:  "1.0",
+				VersionCode:  "1",
+				MinOSVersion: "9.0",
+			}
+			if metadata.Platform != expected.Platform || metadata.Identifier != expected.Identifier ||
+				metadata.Name != expected.Name || metadata.VersionName != expected.VersionName ||
+				metadata.VersionCode != expected.VersionCode || metadata.MinOSVersion != expected.MinOSVersion {
+				t.Errorf("Ipa metadata is %+v, expected %+v", metadata, expected)
+			}
+		})
+	}
+}
+
+func TestGetAllApps(t *testing.T) {
+	appsFolder := setupTestApps(t)
+
+	apk, err := os.ReadFile(helloWorldApk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(appsFolder, "helloworld.apk"), apk, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(appsFolder, "broken.apk"), []byte("not an apk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(appsFolder, "notes.txt"), []byte("not an app"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	apps := GetAllApps()
+	if len(apps) != 2 {
+		t.Fatalf("Listed %v apps, expected 2 - %+v", len(apps), apps)
+	}
+
+	byName := make(map[string]models.AppMetadata)
+	for _, app := range apps {
+		byName[app.FileName] = app
+	}
+
+	helloWorld := byName["helloworld.apk"]
+	if helloWorld.Identifier != "com.example.helloworld" || helloWorld.Platform != "android" || helloWorld.MetadataError != "" {
+		t.Errorf("Unexpected metadata for the valid apk - %+v", helloWorld)
+	}
+	if helloWorld.Size != int64(len(apk)) || len(helloWorld.SHA256) != 64 || helloWorld.UploadedAt == 0 {
+		t.Errorf("Missing file details for the valid apk - %+v", helloWorld)
+	}
+
+	// Files that can't be parsed are still listed and their metadata is stored so they are not parsed again
+	broken := byName["broken.apk"]
+	if broken.MetadataError == "" {
+		t.Errorf("Broken apk has no metadata error - %+v", broken)
+	}
+	storedJSON, err := os.ReadFile(filepath.Join(appsFolder, "broken.apk.json"))
+	if err != nil {
+		t.Fatalf("Metadata of the broken apk was not stored - %s", err)
+	}
+	var stored models.AppMetadata
+	if err := json.Unmarshal(storedJSON, &stored); err != nil || stored.MetadataError != broken.MetadataError {
+		t.Errorf("Stored metadata of the broken apk is `%s`", string(storedJSON))
+	}
+}
+
+func TestExtractAppMetadataRecoversFromPanics(t *testing.T) {
+	setupTestApps(t)
+
+	// A type chunk whose header is larger than the chunk used to panic when resolving the label
+	manifest := readTestApkFile(t, "AndroidManifest.xml")
+	resources := readTestApkFile(t, "resources.arsc")
+	corrupted := append([]byte(nil), resources...)
+	for offset := 0; offset+4 <= len(corrupted); offset++ {
+		if corrupted[offset] == 0x01 && corrupted[offset+1] == 0x02 {
+			corrupted[offset+2], corrupted[offset+3] = 0xff, 0x00
+		}
+	}
+
+	apkPath := filepath.Join(t.TempDir(), "corrupted.apk")
+	writeTestZip(t, apkPath, map[string][]byte{"AndroidManifest.xml": manifest, "resources.arsc": corrupted})
+
+	var metadata models.AppMetadata
+	err := extractAppMetadata(apkPath, &metadata)
+	if err != nil {
+		t.Logf("Corrupted apk returned error - %s", err)
+	}
+	if metadata.Identifier != "com.example.helloworld" {
+		t.Errorf("Manifest data was not read from the apk with corrupted resources - %+v", metadata)
+	}
+}
@@ -0,0 +1,107 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+)
+
+// Copy an image into an RGBA image with bounds starting at 0,0
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+	bounds := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+	return rgba
+}
+
+// Crop an image to a rectangle relative to its top left corner
+// The rectangle is clipped to the image bounds, an error is returned if nothing is left
+func CropImage(img image.Image, rect image.Rectangle) (image.Image, error) {
+	bounds := img.Bounds()
+	rect = rect.Add(bounds.Min).Intersect(bounds)
+	if rect.Empty() {
+		return nil, fmt.Errorf("CropImage: Crop region is outside of the %vx%v image", bounds.Dx(), bounds.Dy())
+	}
+
+	cropped := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(cropped, cropped.Bounds(), img, rect.Min, draw.Src)
+	return cropped, nil
+}
+
+// Downscale an image to the given size by averaging the source pixels covered by each target pixel
+// Sizes larger than the source are not upscaled
+func ResizeImage(img image.Image, width, height int) image.Image {
+	bounds := img.Bounds()
+	if width <= 0 || height <= 0 || (width >= bounds.Dx() && height >= bounds.Dy()) {
+		return img
+	}
+	if width > bounds.Dx() {
+		width = bounds.Dx()
+	}
+	if height > bounds.Dy() {
+		height = bounds.Dy()
+	}
+
+	src := toRGBA(img)
+	srcWidth, srcHeight := src.Rect.Dx(), src.Rect.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0 := y * srcHeight / height
+		y1 := (y + 1) * srcHeight / height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0 := x * srcWidth / width
+			x1 := (x + 1) * srcWidth / width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, a, count uint32
+			for sy := y0; sy < y1; sy++ {
+				offset := sy*src.Stride + x0*4
+				for sx := x0; sx < x1; sx++ {
+					r += uint32(src.Pix[offset])
+					g += uint32(src.Pix[offset+1])
+					b += uint32(src.Pix[offset+2])
+					a += uint32(src.Pix[offset+3])
+					offset += 4
+					count++
+				}
+			}
+
+			i := y*dst.Stride + x*4
+			dst.Pix[i] = uint8(r / count)
+			dst.Pix[i+1] = uint8(g / count)
+			dst.Pix[i+2] = uint8(b / count)
+			dst.Pix[i+3] = uint8(a / count)
+		}
+	}
+	return dst
+}
+
+// Encode an image as `png` or `jpeg`, quality is only used for JPEG
+func EncodeImage(img image.Image, format string, quality int) ([]byte, error) {
+	var buffer bytes.Buffer
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(&buffer, img)
+	case "jpeg", "jpg":
+		err = jpeg.Encode(&buffer, img, &jpeg.Options{Quality: quality})
+	default:
+		return nil, fmt.Errorf("EncodeImage: Unsupported image format `%s`", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("EncodeImage: Could not encode %s image - %s", format, err)
+	}
+	return buffer.Bytes(), nil
+}
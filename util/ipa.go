@@ -0,0 +1,69 @@
+package util
+
+import (
+	"archive/zip"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/shamanec/GADS-devices-provider/models"
+	"howett.net/plist"
+)
+
+// Upper limit for the size of an Info.plist read from an ipa
+const maxInfoPlistSize = 16 << 20
+
+type infoPlist struct {
+	CFBundleIdentifier         string `plist:"CFBundleIdentifier"`
+	CFBundleDisplayName        string `plist:"CFBundleDisplayName"`
+	CFBundleName               string `plist:"CFBundleName"`
+	CFBundleShortVersionString string `plist:"CFBundleShortVersionString"`
+	CFBundleVersion            string `plist:"CFBundleVersion"`
+	MinimumOSVersion           string `plist:"MinimumOSVersion"`
+}
+
+// Get the bundle ID, versions, name and minimum iOS version of an ipa or a zipped .app
+func readIpaMetadata(ipaPath string, metadata *models.AppMetadata) error {
+	reader, err := zip.OpenReader(ipaPath)
+	if err != nil {
+		return fmt.Errorf("readIpaMetadata: Could not open `%s` as zip archive - %s", ipaPath, err)
+	}
+	defer reader.Close()
+
+	// The Info.plist of the app is the one closest to the root, the others are of embedded watch apps
+	plistName := ""
+	for _, file := range reader.File {
+		if path.Base(file.Name) != "Info.plist" || !strings.HasSuffix(path.Dir(file.Name), ".app") {
+			continue
+		}
+		if plistName == "" || strings.Count(file.Name, "/") < strings.Count(plistName, "/") {
+			plistName = file.Name
+		}
+	}
+	if plistName == "" {
+		return fmt.Errorf("readIpaMetadata: No .app bundle Info.plist in `%s`", ipaPath)
+	}
+
+	data, err := readZipFile(&reader.Reader, plistName, maxInfoPlistSize)
+	if err != nil {
+		return fmt.Errorf("readIpaMetadata: Could not read `%s` in `%s` - %s", plistName, ipaPath, err)
+	}
+
+	var info infoPlist
+	_, err = plist.Unmarshal(data, &info)
+	if err != nil {
+		return fmt.Errorf("readIpaMetadata: Could not parse `%s` in `%s` - %s", plistName, ipaPath, err)
+	}
+
+	metadata.Platform = "ios"
+	metadata.Identifier = info.CFBundleIdentifier
+	metadata.Name = info.CFBundleDisplayName
+	if metadata.Name == "" {
+		metadata.Name = info.CFBundleName
+	}
+	metadata.VersionName = info.CFBundleShortVersionString
+	metadata.VersionCode = info.CFBundleVersion
+	metadata.MinOSVersion = info.MinimumOSVersion
+
+	return nil
+}
@@ -14,12 +14,16 @@ import (
 
 	"github.com/shamanec/GADS-devices-provider/config"
 	"github.com/shamanec/GADS-devices-provider/logger"
+	"github.com/shamanec/GADS-devices-provider/models"
 )
 
 var mu sync.Mutex
 var UsedPorts = make(map[string]bool)
 var gadsStreamURL = "https://github.com/shamanec/GADS-Android-stream/releases/latest/download/gads-stream.apk"
 
+// Version of the GADS-stream apk, zero if it could not be read
+var GadsStreamVersion models.AndroidPackageVersion
+
 func GetFreePort() (string, error) {
 	mu.Lock()
 	defer mu.Unlock()
@@ -140,42 +144,74 @@ func RemoveAdbForwardedPorts() {
 	}
 }
 
+// Make sure the GADS-stream apk is available and read its version
+// A configured local apk path is used as is, otherwise the apk is downloaded to the `conf` folder if missing
 func CheckGadsStreamAndDownload() error {
-	if isGadsStreamApkAvailable() {
+	if config.Config.EnvConfig.GadsStreamApkPath != "" {
+		if !isGadsStreamApkAvailable() {
+			return fmt.Errorf("Configured GADS-stream apk `%s` does not exist", GadsStreamApkPath())
+		}
+		logger.ProviderLogger.LogInfo("provider", fmt.Sprintf("Using the configured GADS-stream apk at `%s`", GadsStreamApkPath()))
+	} else if isGadsStreamApkAvailable() {
 		logger.ProviderLogger.LogInfo("provider", "GADS-stream apk is available in the provider `conf` folder, it will not be downloaded. If you want to get the latest release, delete the file from conf folder and re-run the provider")
-		return nil
+	} else {
+		err := downloadGadsStreamApk()
+		if err != nil {
+			return err
+		}
+
+		if !isGadsStreamApkAvailable() {
+			return fmt.Errorf("GADS-stream download was reported successful but the .apk was not actually downloaded")
+		}
+
+		logger.ProviderLogger.LogInfo("provider", "Latest GADS-stream release apk was successfully downloaded")
 	}
 
-	err := downloadGadsStreamApk()
+	// Devices are upgraded only when the apk version is known
+	version, err := GetApkVersion(GadsStreamApkPath())
 	if err != nil {
-		return err
+		logger.ProviderLogger.LogWarn("provider", fmt.Sprintf("Could not read the GADS-stream apk version, installed GADS-stream will not be upgraded on devices - %s", err))
+		return nil
 	}
+	GadsStreamVersion = version
+	logger.ProviderLogger.LogInfo("provider", fmt.Sprintf("GADS-stream apk version is %s", version))
+	return nil
+}
 
-	if !isGadsStreamApkAvailable() {
-		return fmt.Errorf("GADS-stream download was reported successful but the .apk was not actually downloaded")
+// Path of the GADS-stream apk that is installed on devices
+func GadsStreamApkPath() string {
+	if config.Config.EnvConfig.GadsStreamApkPath != "" {
+		return config.Config.EnvConfig.GadsStreamApkPath
 	}
-
-	logger.ProviderLogger.LogInfo("provider", "Latest GADS-stream release apk was successfully downloaded")
-	return nil
+	return fmt.Sprintf("%s/conf/gads-stream.apk", config.Config.EnvConfig.ProviderFolder)
 }
 
 func isGadsStreamApkAvailable() bool {
-	_, err := os.Stat(fmt.Sprintf("%s/conf/gads-stream.apk", config.Config.EnvConfig.ProviderFolder))
+	_, err := os.Stat(GadsStreamApkPath())
 	if os.IsNotExist(err) {
 		return false
 	}
 	return err == nil
 }
 
+// Download the GADS-stream apk from the configured mirror or the latest GitHub release
+// The apk is downloaded to a temporary file first so a failed download doesn't leave a broken apk behind
 func downloadGadsStreamApk() error {
-	logger.ProviderLogger.LogInfo("provider", "Downloading latest GADS-stream release apk file")
-	outFile, err := os.Create(fmt.Sprintf("%s/conf/gads-stream.apk", config.Config.EnvConfig.ProviderFolder))
+	downloadURL := gadsStreamURL
+	if config.Config.EnvConfig.GadsStreamURL != "" {
+		downloadURL = config.Config.EnvConfig.GadsStreamURL
+	}
+	logger.ProviderLogger.LogInfo("provider", fmt.Sprintf("Downloading GADS-stream apk file from %s", downloadURL))
+
+	apkPath := GadsStreamApkPath()
+	outFile, err := os.Create(apkPath + ".download")
 	if err != nil {
-		return fmt.Errorf("Could not create file at %s/conf/gads-stream.apk - %s", config.Config.EnvConfig.ProviderFolder, err)
+		return fmt.Errorf("Could not create file at %s.download - %s", apkPath, err)
 	}
+	defer os.Remove(outFile.Name())
 	defer outFile.Close()
 
-	req, err := http.NewRequest(http.MethodGet, gadsStreamURL, nil)
+	req, err := http.NewRequest(http.MethodGet, downloadURL, nil)
 	if err != nil {
 		return fmt.Errorf("Could not create new request - %s", err)
 	}
@@ -195,7 +231,17 @@ func downloadGadsStreamApk() error {
 
 	_, err = io.Copy(outFile, resp.Body)
 	if err != nil {
-		return fmt.Errorf("Could not copy the response data to the file at apps/gads-stream.apk - %s", err)
+		return fmt.Errorf("Could not copy the response data to the file at %s - %s", outFile.Name(), err)
+	}
+
+	err = outFile.Close()
+	if err != nil {
+		return fmt.Errorf("Could not close the file at %s - %s", outFile.Name(), err)
+	}
+
+	err = os.Rename(outFile.Name(), apkPath)
+	if err != nil {
+		return fmt.Errorf("Could not move the downloaded apk to %s - %s", apkPath, err)
 	}
 
 	return nil
@@ -215,10 +261,13 @@ func GetAllAppFiles() []string {
 		return []string{}
 	}
 
+	// Skip the metadata files and anything else that is not an app
 	var files []string
 	for _, file := range fileList {
+		if file.IsDir() || !IsAppFile(file.Name()) {
+			continue
+		}
 		files = append(files, file.Name())
-		fmt.Println(file.Size())
 	}
 
 	return files